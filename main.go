@@ -0,0 +1,79 @@
+// Command streamwithfriends-whip-server serves the relay's HTTP API, or with
+// -ingest runs a single relay; see package relay.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tonyissa/streamwithfriends-whip-server/relay"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+func main() {
+	ingestURL := flag.String("ingest", "", "run a single relay to this WHIP URL without the HTTP server")
+	videoPort := flag.Int("video-port", 5004, "RTP video port for -ingest mode")
+	audioPort := flag.Int("audio-port", 5006, "RTP audio port for -ingest mode")
+	iceServerRef := flag.String("ice-server-ref", "", "named ICE server set for -ingest mode")
+	configPath := flag.String("config", "", "path to a JSON config file")
+	metricsAddr := flag.String("metrics-addr", "", "serve /metrics and /health on this address instead of the main port")
+	idleTimeout := flag.Duration("idle-timeout", 0, "exit after this long with no sessions; overrides the idleTimeout config")
+	metricsOnMain := flag.Bool("metrics-on-main", false, "with -metrics-addr, keep serving /metrics and /health on the main port too")
+	testMode := flag.Bool("test-mode", false, "serve /test/generate; with -ingest, feed every track synthetic RTP instead of waiting for ffmpeg")
+	flag.Parse()
+
+	relay.SetBuildInfo(version, commit)
+	c, err := relay.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relay.SetConfig(c)
+	if err := relay.CleanupState(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *ingestURL != "" {
+		relay.RunOnce(relay.StartRequest{
+			IngestURL:    *ingestURL,
+			VideoPort:    *videoPort,
+			AudioPort:    *audioPort,
+			ICEServerRef: *iceServerRef,
+		}, *testMode)
+		return
+	}
+
+	go relay.WatchIdle(*idleTimeout)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Printf("Got %s, shutting down", <-sig)
+		relay.Shutdown(relay.ShutdownSignal)
+	}()
+	go func() {
+		<-relay.Stopped()
+		os.Exit(0)
+	}()
+
+	handler := relay.Handler(*testMode, *metricsAddr == "" || *metricsOnMain)
+	if *metricsAddr != "" {
+		srv := &http.Server{Addr: *metricsAddr, Handler: relay.ObservabilityHandler()}
+		go func() {
+			log.Printf("Serving metrics on %s", *metricsAddr)
+			log.Fatal(srv.ListenAndServe())
+		}()
+	}
+
+	log.Println("Pion WHIP relay server running on :8084")
+	log.Fatal(http.ListenAndServe(":8084", handler))
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the ID accessLog gives each request. A client
+// may send its own, to correlate with its logs.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs clients may choose to what is safe to log
+// and echo.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// accessLog wraps next to tag every request with an ID, echoed in the
+// X-Request-ID response header, and, with the accessLog config, log it on
+// completion. The line names the auth scheme but never the credentials,
+// and the path without its query.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		if !cfg.Load().AccessLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		log.Printf("http %s %s %s from %s: %d in %s (auth=%s)",
+			id, r.Method, r.URL.Path, r.RemoteAddr, rec.status(), time.Since(start).Round(time.Microsecond), authScheme(r))
+	})
+}
+
+// authScheme names how r authenticates, without the credentials.
+func authScheme(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return "none"
+	}
+	scheme, _, _ := strings.Cut(h, " ")
+	return strings.ToLower(scheme)
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// status is the answered status; a handler that wrote nothing got 200.
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
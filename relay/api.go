@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/webrtc/v4"
+)
+
+// mdnsModes are the values of the mdns config.
+var mdnsModes = map[string]ice.MulticastDNSMode{
+	"":       ice.MulticastDNSModeQueryOnly,
+	"query":  ice.MulticastDNSModeQueryOnly,
+	"gather": ice.MulticastDNSModeQueryAndGather,
+	"off":    ice.MulticastDNSModeDisabled,
+}
+
+// newAPI builds a pion API offering codecs and exts, with its sockets
+// marked with dscp if non-zero, candidates gathered where c's iceFilter and
+// mdns allow, and c's ICE timeouts. It registers pion's default
+// interceptors, NACK, RTCP reports and TWCC, as c's senderReportInterval
+// and strictInterceptors say.
+func newAPI(codecs []codec, exts []HeaderExtension, dscp int, c *Config) (*webrtc.API, error) {
+	m, err := newMediaEngine(codecs)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerHeaderExtensions(m, exts); err != nil {
+		return nil, err
+	}
+	ir, err := newInterceptors(m, time.Duration(c.SenderReportInterval), c.StrictInterceptors)
+	if err != nil {
+		return nil, err
+	}
+
+	var se webrtc.SettingEngine
+	if dscp != 0 {
+		n, err := newDSCPNet(dscp)
+		if err != nil {
+			return nil, err
+		}
+		se.SetNet(n)
+	}
+	c.ICEFilter.apply(&se)
+	se.SetICEMulticastDNSMode(mdnsModes[c.MDNS])
+	se.SetICETimeouts(time.Duration(c.ICEDisconnectedTimeout), time.Duration(c.ICEFailedTimeout), time.Duration(c.ICEKeepaliveInterval))
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se), webrtc.WithInterceptorRegistry(ir)), nil
+}
+
+// newInterceptors is webrtc.RegisterDefaultInterceptors with the sender
+// report interval set. The sender reports map the RTP timestamps of each
+// track to wall-clock time, which receivers need to keep audio and video in
+// sync; they're computed from the packets written to the tracks, so
+// relayed RTP gets them like any other.
+//
+// With strict, an interceptor that fails to register fails the API;
+// otherwise it is logged and left out, and the rest are registered.
+func newInterceptors(m *webrtc.MediaEngine, srInterval time.Duration, strict bool) (*interceptor.Registry, error) {
+	ir := &interceptor.Registry{}
+	for _, i := range []struct {
+		name     string
+		register func() error
+	}{
+		{"nack", func() error { return webrtc.ConfigureNack(m, ir) }},
+		{"receiver reports", func() error {
+			receiver, err := report.NewReceiverInterceptor()
+			if err == nil {
+				ir.Add(receiver)
+			}
+			return err
+		}},
+		{"sender reports", func() error {
+			sender, err := report.NewSenderInterceptor(report.SenderInterval(srInterval))
+			if err == nil {
+				ir.Add(sender)
+			}
+			return err
+		}},
+		{"simulcast", func() error { return webrtc.ConfigureSimulcastExtensionHeaders(m) }},
+		{"twcc", func() error { return webrtc.ConfigureTWCCSender(m, ir) }},
+	} {
+		if err := i.register(); err != nil {
+			if strict {
+				return nil, fmt.Errorf("failed to register %s interceptor: %w", i.name, err)
+			}
+			log.Printf("Failed to register %s interceptor, continuing without it: %v", i.name, err)
+		}
+	}
+	return ir, nil
+}
+
+// api returns the API for s's PeerConnections. That is the config's
+// shared one, unless s changed what it is built from: the codecs (an
+// allowlist, audio FEC, REMB or detection), header extensions, or the
+// DSCP value since a /reload. Those get the current iceFilter and sender
+// report interval.
+func (s *session) api() (*webrtc.API, error) {
+	c := cfg.Load()
+	if s.dscp == c.DSCP && len(s.extensions) == 0 && reflect.DeepEqual(s.codecs, defaultCodecs) {
+		return c.api, nil
+	}
+	return newAPI(s.codecs, s.extensions, s.dscp, c)
+}
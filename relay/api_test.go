@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// ntpTime converts a 64-bit NTP timestamp to a time.
+func ntpTime(ntp uint64) time.Time {
+	const ntpEpochOffset = 2208988800 // 1900 to 1970, in seconds
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nanos := (int64(ntp&0xffffffff) * int64(time.Second)) >> 32
+	return time.Unix(secs, nanos)
+}
+
+// TestSenderReports writes a known run of RTP to a track through the
+// interceptors newAPI registers, and checks the sender reports that come
+// out: one per senderReportInterval, counting the packets and payload
+// bytes written, and mapping the last in-order packet's RTP timestamp to
+// the wall clock at the track's clock rate.
+func TestSenderReports(t *testing.T) {
+	useConfig(t, `{"senderReportInterval": "200ms"}`)
+	interval := time.Duration(cfg.Load().SenderReportInterval)
+
+	ir, err := newInterceptors(&webrtc.MediaEngine{}, interval, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := ir.Build("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+
+	type report struct {
+		sr *rtcp.SenderReport
+		at time.Time
+	}
+	reports := make(chan report, 16)
+	chain.BindRTCPWriter(interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, _ interceptor.Attributes) (int, error) {
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				select {
+				case reports <- report{sr, time.Now()}:
+				default:
+				}
+			}
+		}
+		return 0, nil
+	}))
+
+	const (
+		ssrc      = 0xdeadbeef
+		clockRate = 90000
+	)
+	track := chain.BindLocalStream(
+		&interceptor.StreamInfo{SSRC: ssrc, ClockRate: clockRate, MimeType: webrtc.MimeTypeVP8, PayloadType: 102},
+		interceptor.RTPWriterFunc(func(h *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+			return len(payload), nil
+		}),
+	)
+	defer chain.UnbindLocalStream(&interceptor.StreamInfo{SSRC: ssrc})
+
+	// Ten in-order packets at 30 fps, then a late retransmission of the
+	// sixth, which is counted but doesn't move the timestamp mapping.
+	write := func(seq uint16, ts uint32, size int) {
+		h := &rtp.Header{Version: 2, PayloadType: 102, SequenceNumber: seq, Timestamp: ts, SSRC: ssrc}
+		if _, err := track.Write(h, make([]byte, size), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 10 {
+		write(uint16(100+i), uint32(1000+3000*i), 100)
+	}
+	lastWrite := time.Now()
+	const lastTS = 1000 + 3000*9
+	write(105, 1000+3000*5, 50)
+
+	var prev time.Time
+	for n := range 3 {
+		var r report
+		select {
+		case r = <-reports:
+		case <-time.After(5 * interval):
+			t.Fatalf("no sender report %d within %s", n, 5*interval)
+		}
+		sr := r.sr
+		if sr.SSRC != ssrc || sr.PacketCount != 11 || sr.OctetCount != 1050 {
+			t.Errorf("report %d: ssrc %#x, %d packets, %d bytes; want %#x, 11, 1050",
+				n, sr.SSRC, sr.PacketCount, sr.OctetCount, uint32(ssrc))
+		}
+
+		ntp := ntpTime(sr.NTPTime)
+		if d := r.at.Sub(ntp); d < 0 || d > 50*time.Millisecond {
+			t.Errorf("report %d: NTP time %s is %s before it was sent", n, ntp.Format(time.StampMicro), d)
+		}
+		// The RTP time advances from the last in-order packet's timestamp
+		// at the clock rate, to the report's NTP time.
+		want := lastTS + uint32(ntp.Sub(lastWrite).Seconds()*clockRate)
+		if diff := int64(sr.RTPTime) - int64(want); diff < -clockRate/100 || diff > clockRate/100 {
+			t.Errorf("report %d: RTP time %d, want %d±%d", n, sr.RTPTime, want, clockRate/100)
+		}
+
+		if !prev.IsZero() {
+			if gap := ntp.Sub(prev); gap < interval/2 || gap > 2*interval {
+				t.Errorf("report %d came %s after the last, want about %s", n, gap, interval)
+			}
+		}
+		prev = ntp
+	}
+}
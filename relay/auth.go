@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAuth rejects requests that don't carry the configured API key. The
+// key is accepted as "Authorization: Bearer <key>" for scripts, or as the
+// basic auth password so a browser can log in to the web UI. With no key
+// configured every request is let through.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := cfg.Load().APIKey
+		if key == "" || validKey(r, key) {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="whip-relay"`)
+		writeError(w, errUnauthorized)
+	}
+}
+
+func validKey(r *http.Request, key string) bool {
+	var got string
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		got = token
+	} else if _, password, ok := r.BasicAuth(); ok {
+		got = password
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1
+}
@@ -0,0 +1,90 @@
+package relay
+
+import "time"
+
+const defaultBitrateWindow = 5 * time.Second
+
+// BitrateEvent is POSTed to the webhookUrl config when a track's bitrate
+// falls below its StartRequest minimum (bitrate.low) and when it is back
+// (bitrate.recovered).
+type BitrateEvent struct {
+	Event   string            `json:"event"`
+	ID      string            `json:"id"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Kind    string            `json:"kind"`
+	Kbps    uint64            `json:"kbps"`
+	MinKbps uint64            `json:"minKbps"`
+	Window  Duration          `json:"window"`
+	Time    time.Time         `json:"time"`
+}
+
+// watchBitrate samples the byte counters of the tracks with a minKbps
+// every second and compares the bitrate over the last window with it. A
+// track is only judged once a full window has passed since its first
+// packet, and not while the session is paused, so a slow start or a pause
+// isn't taken for a throttled feed; a source that stops altogether is
+// maxSourceGap's to handle. It returns when the session is closed.
+func (s *session) watchBitrate(window time.Duration) {
+	type sampler struct {
+		mt      *mediaTrack
+		samples []uint64 // bytes relayed at each of the last seconds
+	}
+	var tracks []*sampler
+	for _, mt := range s.media() {
+		if mt.minKbps > 0 {
+			tracks = append(tracks, &sampler{mt: mt})
+		}
+	}
+	secs := int(window / time.Second)
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		}
+		for _, t := range tracks {
+			bytes := t.mt.stats.bytes.Load()
+			if s.paused.Load() || (bytes == 0 && len(t.samples) == 0) {
+				t.samples = t.samples[:0]
+				continue
+			}
+			t.samples = append(t.samples, bytes)
+			if len(t.samples) <= secs {
+				continue
+			}
+			t.samples = t.samples[len(t.samples)-secs-1:]
+			kbps := (bytes - t.samples[0]) * 8 / uint64(secs) / 1000
+			t.mt.windowKbps.Store(kbps)
+			s.checkBitrate(t.mt, kbps, window)
+		}
+	}
+}
+
+// checkBitrate reports mt's bitrate crossing its minimum, either way.
+func (s *session) checkBitrate(mt *mediaTrack, kbps uint64, window time.Duration) {
+	low := kbps < mt.minKbps
+	if mt.lowBitrate.Swap(low) == low {
+		return
+	}
+	ev := BitrateEvent{
+		Event:   "bitrate.recovered",
+		ID:      s.id,
+		Labels:  s.labels,
+		Kind:    mt.kind.String(),
+		Kbps:    kbps,
+		MinKbps: mt.minKbps,
+		Window:  Duration(window),
+		Time:    time.Now(),
+	}
+	if low {
+		ev.Event = "bitrate.low"
+		s.event("warning", "%s bitrate dropped to %d kbps over %s, below the minimum %d kbps",
+			mt.kind, kbps, window, mt.minKbps)
+	} else {
+		s.event("recovered", "%s bitrate back to %d kbps", mt.kind, kbps)
+	}
+	postWebhook(ev)
+}
@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// breaker is the circuit breaker for one WHIP host. It opens after
+// breakerThreshold consecutive failures and refuses new negotiations until
+// breakerCooldown has passed. Then it is half-open: one negotiation is let
+// through as a trial, and its outcome closes or reopens the breaker.
+type breaker struct {
+	failures int
+	openedAt time.Time // zero while closed
+	trial    bool      // a half-open trial is in flight
+}
+
+// BreakerStats is a breaker's state in /stats.
+type BreakerStats struct {
+	Host      string     `json:"host"`
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+// breakerHost keys breakers by host and port, so one failing server
+// doesn't block others on the same machine.
+func breakerHost(ingestURL string) string {
+	u, err := url.Parse(ingestURL)
+	if err != nil {
+		return ingestURL
+	}
+	return strings.ToLower(u.Host)
+}
+
+// breakerAllow reports whether a negotiation with host may go ahead, and
+// if not, the error to fail it with.
+func breakerAllow(host string) error {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[host]
+	if b == nil || b.openedAt.IsZero() {
+		return nil
+	}
+	until := b.openedAt.Add(time.Duration(cfg.Load().BreakerCooldown))
+	if time.Now().Before(until) || b.trial {
+		return newRelayError(CodeCircuitOpen, http.StatusServiceUnavailable,
+			fmt.Errorf("%s failed %d times in a row; not retrying until %s", host, b.failures, until.Format(time.RFC3339)))
+	}
+	b.trial = true
+	return nil
+}
+
+// breakerRecord counts the outcome of a negotiation with host. Only
+// failures that say the server is down or broken count: an unreachable
+// server, a 5xx, or one that stalled past the negotiation timeout. A bad
+// request or token is the caller's problem, and so is a negotiation its
+// caller canceled, which negotiationTimedOut doesn't report as a timeout.
+func breakerRecord(host string, err error) {
+	var re *RelayError
+	failed := errors.As(err, &re) &&
+		(re.Code == CodeWHIPUnreachable || re.Code == CodeWHIPUpstream5xx || re.Code == CodeNegotiationTimeout)
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[host]
+	if !failed {
+		if b != nil && err == nil {
+			delete(breakers, host)
+		} else if b != nil {
+			b.trial = false
+		}
+		return
+	}
+	if b == nil {
+		b = &breaker{}
+		breakers[host] = b
+	}
+	b.failures++
+	b.trial = false
+	if b.failures >= cfg.Load().BreakerThreshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// breakerStats lists the hosts with failures, open breakers first.
+func breakerStats() []BreakerStats {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	cooldown := time.Duration(cfg.Load().BreakerCooldown)
+	var out []BreakerStats
+	for host, b := range breakers {
+		st := BreakerStats{Host: host, State: "closed", Failures: b.failures}
+		if !b.openedAt.IsZero() {
+			until := b.openedAt.Add(cooldown)
+			st.OpenUntil = &until
+			st.State = "open"
+			if time.Now().After(until) {
+				st.State = "half-open"
+			}
+		}
+		out = append(out, st)
+	}
+	slices.SortFunc(out, func(a, b BreakerStats) int {
+		if (a.OpenUntil == nil) != (b.OpenUntil == nil) {
+			if a.OpenUntil != nil {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Host, b.Host)
+	})
+	return out
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerRecord(t *testing.T) {
+	useConfig(t, `{"breakerThreshold": 1}`)
+	tests := []struct {
+		name     string
+		err      error
+		wantOpen bool
+	}{
+		{"unreachable", newRelayError(CodeWHIPUnreachable, http.StatusBadGateway, errors.New("refused")), true},
+		{"5xx", newRelayError(CodeWHIPUpstream5xx, http.StatusBadGateway, errors.New("503")), true},
+		{"stalled", newRelayError(CodeNegotiationTimeout, http.StatusGatewayTimeout, errors.New("took longer")), true},
+		{"4xx", newRelayError(CodeWHIPUpstream4xx, http.StatusBadGateway, errors.New("400")), false},
+		{"auth", newRelayError(CodeWHIPAuthFailed, http.StatusBadGateway, errors.New("401")), false},
+		{"canceled", fmt.Errorf("negotiation stopped: %w", context.Canceled), false},
+		{"ok", nil, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := fmt.Sprintf("whip%d.example:443", i)
+			breakerRecord(host, tt.err)
+			if open := breakerAllow(host) != nil; open != tt.wantOpen {
+				t.Errorf("breaker open = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+// TestBreakerOpensOnStall checks that a WHIP server that accepts the POST
+// and never answers opens its breaker, unless the caller gave up first.
+func TestBreakerOpensOnStall(t *testing.T) {
+	useConfig(t, `{"allowedIngestHosts": ["127.0.0.1"], "breakerThreshold": 1, "negotiationTimeout": "1s"}`)
+	unstall := make(chan struct{})
+	stalled := func() *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-unstall:
+			case <-r.Context().Done():
+			}
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	defer close(unstall)
+
+	for _, tt := range []struct {
+		name     string
+		timeout  time.Duration
+		wantOpen bool
+	}{
+		{"timed out", time.Minute, true},
+		{"canceled", 100 * time.Millisecond, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := stalled()
+			ports := freePorts(t, 2)
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if _, err := start(ctx, StartRequest{IngestURL: ts.URL, VideoPort: ports[0], AudioPort: ports[1]}); err == nil {
+				t.Fatal("start succeeded")
+			}
+			if open := breakerAllow(breakerHost(ts.URL)) != nil; open != tt.wantOpen {
+				t.Errorf("breaker open = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
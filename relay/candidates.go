@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+// LocalCandidate is an ICE candidate the relay gathered for an upstream.
+// Related is the address a srflx or relay candidate was derived from.
+type LocalCandidate struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     uint16 `json:"port"`
+	Priority uint32 `json:"priority"`
+	Related  string `json:"related,omitempty"`
+}
+
+// watchCandidates records up's local candidates as pion gathers them,
+// starting over when an ICE restart gathers new ones.
+func (up *upstream) watchCandidates() {
+	up.pc.OnICEGatheringStateChange(func(state webrtc.ICEGatheringState) {
+		if state == webrtc.ICEGatheringStateGathering {
+			up.candidatesMu.Lock()
+			up.candidates = nil
+			up.candidatesMu.Unlock()
+		}
+	})
+	up.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return // gathering is complete
+		}
+		lc := LocalCandidate{
+			Type:     c.Typ.String(),
+			Protocol: c.Protocol.String(),
+			Address:  c.Address,
+			Port:     c.Port,
+			Priority: c.Priority,
+		}
+		if c.RelatedAddress != "" {
+			lc.Related = candidateAddr(c.RelatedAddress, c.RelatedPort)
+		}
+		up.candidatesMu.Lock()
+		up.candidates = append(up.candidates, lc)
+		up.candidatesMu.Unlock()
+	})
+}
+
+// localCandidates returns a copy of the candidates up has gathered so far.
+func (up *upstream) localCandidates() []LocalCandidate {
+	up.candidatesMu.Lock()
+	defer up.candidatesMu.Unlock()
+	return append([]LocalCandidate(nil), up.candidates...)
+}
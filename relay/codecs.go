@@ -0,0 +1,390 @@
+package relay
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// codec is a codec the relay knows how to register in a MediaEngine.
+type codec struct {
+	kind   webrtc.RTPCodecType
+	params webrtc.RTPCodecParameters
+
+	// optIn codecs are only offered when a codec allowlist names them, so
+	// that a session's offer starts out with one codec per kind.
+	optIn bool
+
+	// rtxPayloadType is the payload type reserved for this codec's RTX
+	// (RFC 4588), which is offered with it if rtx is set.
+	rtxPayloadType uint8
+	rtx            bool
+}
+
+// supportedCodecs lists every codec the relay can offer, in registration
+// order, which is also the order of preference in the offer. It is the
+// table of their default payload types, clock rates, channels and fmtp;
+// checkPayloadTypes keeps the payload types, including the ones reserved
+// for RTX, from colliding.
+var supportedCodecs = []codec{
+	{
+		kind: webrtc.RTPCodecTypeAudio,
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
+			},
+			PayloadType: 111,
+		},
+	},
+	{
+		kind: webrtc.RTPCodecTypeVideo,
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType: webrtc.MimeTypeVP8, ClockRate: 90000,
+			},
+			PayloadType: 102,
+		},
+		rtxPayloadType: 103,
+	},
+	{
+		kind: webrtc.RTPCodecTypeVideo,
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			},
+			PayloadType: 106,
+		},
+		rtxPayloadType: 107,
+		optIn:          true,
+	},
+}
+
+func init() {
+	// Every supported codec can be offered at once, with RTX.
+	if err := checkPayloadTypes(withVideoRTX(supportedCodecs)); err != nil {
+		panic(err)
+	}
+}
+
+// checkPayloadTypes reports two of codecs, or their RTX, sharing a payload
+// type, or one outside the 7-bit range RTP has for it.
+func checkPayloadTypes(codecs []codec) error {
+	owners := make(map[uint8]string)
+	claim := func(pt uint8, owner string) error {
+		if pt > 127 {
+			return fmt.Errorf("%s has payload type %d, above 127", owner, pt)
+		}
+		if other, ok := owners[pt]; ok {
+			return fmt.Errorf("%s and %s both have payload type %d", other, owner, pt)
+		}
+		owners[pt] = owner
+		return nil
+	}
+	for _, c := range codecs {
+		if err := claim(uint8(c.params.PayloadType), c.params.MimeType); err != nil {
+			return err
+		}
+		if c.rtx {
+			if err := claim(c.rtxPayloadType, c.params.MimeType+" rtx"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// defaultCodecs are the supported codecs offered without an allowlist.
+var defaultCodecs = slices.DeleteFunc(slices.Clone(supportedCodecs), func(c codec) bool { return c.optIn })
+
+// selectCodecs returns the supported codecs permitted by allowlist. Entries
+// match either the full MIME type ("video/VP8") or just the codec name
+// ("vp8"), case-insensitively. An empty allowlist selects defaultCodecs.
+// Each of the required kinds must keep at least one codec; naming several
+// of a kind offers them all and lets the WHIP server pick, see codecTrack.
+func selectCodecs(allowlist []string, required []webrtc.RTPCodecType) ([]codec, error) {
+	if len(allowlist) == 0 {
+		return defaultCodecs, nil
+	}
+
+	var selected []codec
+	for _, c := range supportedCodecs {
+		if slices.ContainsFunc(allowlist, c.is) {
+			selected = append(selected, c)
+		}
+	}
+
+	for _, kind := range required {
+		if !hasKind(selected, kind) {
+			return nil, fmt.Errorf("codec allowlist leaves no %s codec", kind)
+		}
+	}
+	return selected, nil
+}
+
+// is reports whether name refers to c, by full MIME type ("video/VP8") or
+// just the codec name ("vp8"), case-insensitively.
+func (c codec) is(name string) bool {
+	_, codecName, _ := strings.Cut(c.params.MimeType, "/")
+	return strings.EqualFold(name, c.params.MimeType) || strings.EqualFold(name, codecName)
+}
+
+// withClockRates returns a copy of codecs with the clock rates in rates,
+// which are keyed by codec like a codec allowlist. Every key has to name
+// one of codecs, with a rate in its kind's range; zero keeps the codec's
+// standard rate.
+func withClockRates(codecs []codec, rates map[string]uint32) ([]codec, error) {
+	if len(rates) == 0 {
+		return codecs, nil
+	}
+	codecs = slices.Clone(codecs)
+	for _, name := range slices.Sorted(maps.Keys(rates)) {
+		i := slices.IndexFunc(codecs, func(c codec) bool { return c.is(name) })
+		if i < 0 {
+			return nil, fmt.Errorf("clockRates names %q, which is not an offered codec", name)
+		}
+		limit := audioClockRateLimit
+		if codecs[i].kind == webrtc.RTPCodecTypeVideo {
+			limit = videoClockRateLimit
+		}
+		limit.name = "clockRates." + name
+		limit.def = int(codecs[i].params.ClockRate)
+		rate := int(rates[name])
+		if err := limit.apply(&rate); err != nil {
+			return nil, err
+		}
+		codecs[i].params.ClockRate = uint32(rate)
+	}
+	return codecs, nil
+}
+
+// withPreference returns a copy of codecs with the ones named in
+// preference, like a codec allowlist, moved to the front in that order; the
+// rest keep theirs. Every entry has to name one of codecs. The offer lists
+// each kind's codecs in registration order, which servers that pick the
+// first one they support take as the preference.
+func withPreference(codecs []codec, preference []string) ([]codec, error) {
+	if len(preference) == 0 {
+		return codecs, nil
+	}
+	ordered := make([]codec, 0, len(codecs))
+	for _, name := range preference {
+		i := slices.IndexFunc(codecs, func(c codec) bool { return c.is(name) })
+		if i < 0 {
+			return nil, fmt.Errorf("codecPreference names %q, which is not an offered codec", name)
+		}
+		if !slices.ContainsFunc(ordered, func(c codec) bool { return c.is(name) }) {
+			ordered = append(ordered, codecs[i])
+		}
+	}
+	for _, c := range codecs {
+		if !slices.ContainsFunc(ordered, func(o codec) bool { return o.params.PayloadType == c.params.PayloadType }) {
+			ordered = append(ordered, c)
+		}
+	}
+	return ordered, nil
+}
+
+// codecOrder lists codecs' MIME types in offer order, for logging.
+func codecOrder(codecs []codec) string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.params.MimeType
+	}
+	return strings.Join(names, ",")
+}
+
+// opusFECFmtp enables Opus in-band FEC (RFC 7587). The encoder still has to
+// produce it, e.g. ffmpeg's libopus with -fec 1 -packet_loss 10.
+const opusFECFmtp = "minptime=10;useinbandfec=1"
+
+// withAudioFEC returns a copy of codecs that offers Opus with in-band FEC.
+func withAudioFEC(codecs []codec) []codec {
+	codecs = slices.Clone(codecs)
+	for i, c := range codecs {
+		if strings.EqualFold(c.params.MimeType, webrtc.MimeTypeOpus) {
+			codecs[i].params.SDPFmtpLine = opusFECFmtp
+		}
+	}
+	return codecs
+}
+
+// withREMB returns a copy of codecs whose video codecs ask for REMB
+// feedback, so the receiver reports its bandwidth estimate.
+func withREMB(codecs []codec) []codec {
+	codecs = slices.Clone(codecs)
+	for i, c := range codecs {
+		if c.kind == webrtc.RTPCodecTypeVideo {
+			fb := slices.Clone(c.params.RTCPFeedback)
+			codecs[i].params.RTCPFeedback = append(fb, webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB})
+		}
+	}
+	return codecs
+}
+
+// withVideoRTX returns a copy of codecs whose video codecs are offered
+// with RTX, on the payload types supportedCodecs reserves for it.
+func withVideoRTX(codecs []codec) []codec {
+	codecs = slices.Clone(codecs)
+	for i, c := range codecs {
+		if c.kind == webrtc.RTPCodecTypeVideo && c.rtxPayloadType != 0 {
+			codecs[i].rtx = true
+		}
+	}
+	return codecs
+}
+
+// withOptions returns codecs with req's audioFec, videoRtx, maxBitrateKbps
+// and h264Profile options applied.
+func (req StartRequest) withOptions(codecs []codec) []codec {
+	if req.AudioFEC {
+		codecs = withAudioFEC(codecs)
+	}
+	if req.VideoRTX {
+		codecs = withVideoRTX(codecs)
+	}
+	if req.MaxBitrateKbps > 0 {
+		codecs = withREMB(codecs)
+	}
+	if req.H264Profile != "" {
+		codecs = withH264Profile(codecs, req.H264Profile)
+	}
+	return codecs
+}
+
+// withH264Profile returns a copy of codecs that offers H.264 with
+// profile-level-id profile.
+func withH264Profile(codecs []codec, profile string) []codec {
+	codecs = slices.Clone(codecs)
+	for i, c := range codecs {
+		if c.is("h264") {
+			params := strings.Split(c.params.SDPFmtpLine, ";")
+			for j, p := range params {
+				if strings.HasPrefix(p, "profile-level-id=") {
+					params[j] = "profile-level-id=" + strings.ToLower(profile)
+				}
+			}
+			codecs[i].params.SDPFmtpLine = strings.Join(params, ";")
+		}
+	}
+	return codecs
+}
+
+// fmtpParam returns the value of key in an fmtp parameter list.
+func fmtpParam(fmtp, key string) string {
+	for _, p := range strings.Split(fmtp, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// answerKeepsFEC reports whether answer accepted Opus with in-band FEC.
+func answerKeepsFEC(answer *webrtc.SessionDescription) bool {
+	parsed, err := answer.Unmarshal()
+	if err != nil {
+		return false
+	}
+	pt, err := parsed.GetPayloadTypeForCodec(sdp.Codec{Name: "opus"})
+	if err != nil {
+		return false
+	}
+	c, err := parsed.GetCodecForPayloadType(pt)
+	return err == nil && strings.Contains(c.Fmtp, "useinbandfec=1")
+}
+
+func hasKind(codecs []codec, kind webrtc.RTPCodecType) bool {
+	for _, c := range codecs {
+		if c.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// newMediaEngine registers codecs in a fresh MediaEngine, each followed by
+// its RTX codec if it has one.
+func newMediaEngine(codecs []codec) (*webrtc.MediaEngine, error) {
+	if err := checkPayloadTypes(codecs); err != nil {
+		return nil, err
+	}
+	m := &webrtc.MediaEngine{}
+	for _, c := range codecs {
+		if err := m.RegisterCodec(c.params, c.kind); err != nil {
+			return nil, fmt.Errorf("failed to register %s codec: %w", c.kind, err)
+		}
+		if !c.rtx {
+			continue
+		}
+		rtx := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType: webrtc.MimeTypeRTX, ClockRate: c.params.ClockRate,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", c.params.PayloadType),
+			},
+			PayloadType: webrtc.PayloadType(c.rtxPayloadType),
+		}
+		if err := m.RegisterCodec(rtx, c.kind); err != nil {
+			return nil, fmt.Errorf("failed to register %s rtx codec: %w", c.kind, err)
+		}
+	}
+	return m, nil
+}
+
+// rtxSSRC returns the SSRC pc sends kind's retransmissions with, or 0 if
+// the answer didn't accept RTX and they are resent on the media SSRC.
+func rtxSSRC(pc *webrtc.PeerConnection, kind webrtc.RTPCodecType) webrtc.SSRC {
+	for _, t := range pc.GetTransceivers() {
+		sender := t.Sender()
+		if sender == nil || sender.Track() == nil || sender.Track().Kind() != kind {
+			continue
+		}
+		if enc := sender.GetParameters().Encodings; len(enc) > 0 {
+			return enc[0].RTX.SSRC
+		}
+	}
+	return 0
+}
+
+// CodecInfo is a supported codec's defaults, as GET /codecs lists them.
+// Name is how a codec allowlist, clockRates or codecPreference refers to
+// it, and RTXPayloadType is used with videoRtx. ffmpeg has to send the
+// payload type the relay offers, e.g. -payload_type 102 for VP8.
+type CodecInfo struct {
+	Name           string `json:"name"`
+	Kind           string `json:"kind"`
+	MimeType       string `json:"mimeType"`
+	PayloadType    uint8  `json:"payloadType"`
+	RTXPayloadType uint8  `json:"rtxPayloadType,omitempty"`
+	ClockRate      uint32 `json:"clockRate"`
+	Channels       uint16 `json:"channels,omitempty"`
+	Fmtp           string `json:"fmtp,omitempty"`
+
+	// OptIn codecs are only offered when a codec allowlist names them.
+	OptIn bool `json:"optIn,omitempty"`
+}
+
+func codecsHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]CodecInfo, 0, len(supportedCodecs))
+	for _, c := range supportedCodecs {
+		_, name, _ := strings.Cut(c.params.MimeType, "/")
+		list = append(list, CodecInfo{
+			Name:           strings.ToLower(name),
+			Kind:           c.kind.String(),
+			MimeType:       c.params.MimeType,
+			PayloadType:    uint8(c.params.PayloadType),
+			RTXPayloadType: c.rtxPayloadType,
+			ClockRate:      c.params.ClockRate,
+			Channels:       c.params.Channels,
+			Fmtp:           c.params.SDPFmtpLine,
+			OptIn:          c.optIn,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// codecTrack is a kind's local track, offered with one or more codecs so
+// the WHIP server can pick. pion binds a TrackLocalStaticRTP to a single
+// codec, so there is one per offered codec, under the same track and
+// stream IDs, and each PeerConnection binds the one for the codec its
+// answer picked.
+//
+// ffmpeg sends one codec, which the relay tells by payload type: it has to
+// be the PT the picked codec has in our offer. Packets are routed to the
+// track of the codec their PT names; with a single codec, every packet
+// goes to its track and pion rewrites the PT as before.
+type codecTrack struct {
+	codecs []codec
+	tracks []*webrtc.TrackLocalStaticRTP
+
+	mu sync.Mutex
+	// bound maps each binding's ID to the index of the track it bound.
+	bound map[string]int
+}
+
+// errCodecNotNegotiated is returned by WriteRTP for a packet whose codec
+// was offered but isn't the one picked by any bound PeerConnection.
+var errCodecNotNegotiated = errors.New("codec not negotiated")
+
+func newCodecTrack(kind webrtc.RTPCodecType, codecs []codec) (*codecTrack, error) {
+	t := &codecTrack{bound: make(map[string]int)}
+	for _, c := range codecs {
+		if c.kind != kind {
+			continue
+		}
+		local, err := webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{MimeType: c.params.MimeType, ClockRate: c.params.ClockRate},
+			kind.String(), "pion-"+kind.String(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		t.codecs = append(t.codecs, c)
+		t.tracks = append(t.tracks, local)
+	}
+	if len(t.tracks) == 0 {
+		return nil, fmt.Errorf("no %s codec selected", kind)
+	}
+	return t, nil
+}
+
+// Bind binds the track of the first codec in the answer's order that was
+// offered, which is the one pion sends with.
+func (t *codecTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	for _, negotiated := range ctx.CodecParameters() {
+		for i, c := range t.codecs {
+			if !c.is(negotiated.MimeType) {
+				continue
+			}
+			params, err := t.tracks[i].Bind(ctx)
+			if err != nil {
+				return params, err
+			}
+			t.mu.Lock()
+			t.bound[ctx.ID()] = i
+			t.mu.Unlock()
+			return params, nil
+		}
+	}
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+func (t *codecTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	i, ok := t.bound[ctx.ID()]
+	delete(t.bound, ctx.ID())
+	t.mu.Unlock()
+	if !ok {
+		return webrtc.ErrUnbindFailed
+	}
+	return t.tracks[i].Unbind(ctx)
+}
+
+func (t *codecTrack) ID() string                { return t.tracks[0].ID() }
+func (t *codecTrack) RID() string               { return t.tracks[0].RID() }
+func (t *codecTrack) StreamID() string          { return t.tracks[0].StreamID() }
+func (t *codecTrack) Kind() webrtc.RTPCodecType { return t.tracks[0].Kind() }
+
+// Codec is the first offered codec, the only one unless several were.
+func (t *codecTrack) Codec() webrtc.RTPCodecCapability { return t.tracks[0].Codec() }
+
+// multi reports whether several codecs are offered.
+func (t *codecTrack) multi() bool { return len(t.codecs) > 1 }
+
+// index returns the index of the codec offered with payload type pt, or -1.
+func (t *codecTrack) index(pt uint8) int {
+	return slices.IndexFunc(t.codecs, func(c codec) bool { return uint8(c.params.PayloadType) == pt })
+}
+
+// codecFor returns the offered codec payload type pt is relayed as: the
+// one it names if several are offered, and the only one otherwise.
+func (t *codecTrack) codecFor(pt uint8) (codec, bool) {
+	i := 0
+	if t.multi() {
+		if i = t.index(pt); i < 0 {
+			return codec{}, false
+		}
+	}
+	return t.codecs[i], true
+}
+
+// find returns the index of the offered codec name refers to, or -1.
+func (t *codecTrack) find(name string) int {
+	return slices.IndexFunc(t.codecs, func(c codec) bool { return c.is(name) })
+}
+
+// WriteRTP writes pkt to the track of the codec its payload type names.
+// It fails with errCodecNotNegotiated if PeerConnections are bound, but
+// none of them picked that codec.
+func (t *codecTrack) WriteRTP(pkt *rtp.Packet) error {
+	i := 0
+	if t.multi() {
+		if i = t.index(pkt.PayloadType); i < 0 {
+			return fmt.Errorf("payload type %d is none of the offered codecs", pkt.PayloadType)
+		}
+		t.mu.Lock()
+		picked := len(t.bound) == 0
+		for _, j := range t.bound {
+			picked = picked || j == i
+		}
+		t.mu.Unlock()
+		if !picked {
+			return fmt.Errorf("%s: %w", t.codecs[i].params.MimeType, errCodecNotNegotiated)
+		}
+	}
+	return t.tracks[i].WriteRTP(pkt)
+}
+
+// checkProfile fails the negotiation if H.264 was picked with another
+// profile-level-id than the StartRequest's h264Profile.
+func (s *session) checkProfile(up *upstream) error {
+	if s.h264Profile == "" {
+		return nil
+	}
+	for _, nc := range up.negotiated {
+		if strings.EqualFold(nc.MimeType, webrtc.MimeTypeH264) && nc.Profile != s.h264Profile {
+			return newRelayError(CodeCodecMismatch, http.StatusBadGateway,
+				fmt.Errorf("%s negotiated H.264 profile-level-id %q, but h264Profile requires %q",
+					redactURL(up.ingestURL), nc.Profile, s.h264Profile))
+		}
+	}
+	return nil
+}
+
+// checkPicked reconciles the codecs up's answer picked for tracks offered
+// with several with what ffmpeg sends, which fails the negotiation if
+// they differ. Before any media arrives, it reports the PT ffmpeg has to
+// send instead.
+func (s *session) checkPicked(up *upstream) error {
+	for _, nc := range up.negotiated {
+		mt := s.mediaTrack(webrtc.NewRTPCodecType(nc.Kind))
+		if mt == nil || !mt.local.multi() {
+			continue
+		}
+		i := mt.local.find(nc.MimeType)
+		if i < 0 {
+			continue // Bind would have failed
+		}
+		want := uint8(mt.local.codecs[i].params.PayloadType)
+		src := uint8(mt.sourcePT.Load())
+		switch {
+		case src == 0:
+			s.event("negotiated", "%s: %s was picked, ffmpeg has to send it with pt=%d", nc.Kind, nc.MimeType, want)
+		case src != want:
+			sending := mt.local.codecs[mt.local.index(src)].params.MimeType
+			return newRelayError(CodeCodecMismatch, http.StatusBadGateway,
+				fmt.Errorf("%s codec mismatch: %s picked %s (pt=%d), but ffmpeg sends %s (pt=%d)",
+					nc.Kind, redactURL(up.ingestURL), nc.MimeType, want, sending, src))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,670 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Config is the server-side configuration, loaded once at startup from an
+// optional JSON file and the environment.
+type Config struct {
+	// ICEServers are named ICE server sets that a StartRequest can refer to
+	// via iceServerRef, so TURN credentials never travel in request bodies.
+	ICEServers map[string][]webrtc.ICEServer `json:"iceServers"`
+
+	// Profiles are named StartRequest objects, e.g. {"chat-audio-only":
+	// {"audioPort": 5006, "codecAllowlist": ["opus"]}}, that a /start can
+	// refer to via profile instead of repeating their fields.
+	Profiles map[string]json.RawMessage `json:"profiles"`
+
+	// RelayOnly forces every session to use only TURN relay candidates.
+	RelayOnly bool `json:"relayOnly"`
+
+	// MaxSessions caps concurrently running sessions. It defaults to 1,
+	// i.e. one relay at a time.
+	MaxSessions int `json:"maxSessions"`
+
+	// RejectDuplicateIngest answers a /start with 409 DUPLICATE_INGEST
+	// while another session relays to the same ingest URL, unless it sets
+	// replace; most WHIP servers let the second publisher clobber the
+	// first. Leave it off to fan several sessions in to one URL.
+	RejectDuplicateIngest bool `json:"rejectDuplicateIngest"`
+
+	// APIKey, when set, is required on the control endpoints and the web
+	// UI, either as a bearer token or as the basic auth password.
+	APIKey string `json:"apiKey"`
+
+	// WHIPToken is the WHIP bearer token for sessions that don't bring
+	// their own, including -ingest mode.
+	WHIPToken string `json:"whipToken"`
+
+	// MaxAnswerBytes caps how much of a WHIP response body is read, so a
+	// misbehaving server can't exhaust memory. Defaults to 256 KiB.
+	MaxAnswerBytes int `json:"maxAnswerBytes"`
+
+	// DeleteAttempts is how many times the WHIP DELETE is tried on teardown,
+	// with DeleteBackoff (doubling) between tries. Defaults to 3 and 500ms.
+	DeleteAttempts int      `json:"deleteAttempts"`
+	DeleteBackoff  Duration `json:"deleteBackoff"`
+
+	// RTPReadRetries is how many consecutive transient errors reading an
+	// RTP port are retried, with RTPReadBackoff (doubling) between tries,
+	// before relaying the track stops. Defaults to 5 and 20ms.
+	RTPReadRetries int      `json:"rtpReadRetries"`
+	RTPReadBackoff Duration `json:"rtpReadBackoff"`
+
+	// BreakerThreshold consecutive failures to reach a WHIP host, or 5xx
+	// answers from it, open its circuit breaker: negotiations with it fail
+	// fast with 503 CIRCUIT_OPEN for BreakerCooldown, after which one trial
+	// is let through. Defaults to 5 and 30s.
+	BreakerThreshold int      `json:"breakerThreshold"`
+	BreakerCooldown  Duration `json:"breakerCooldown"`
+
+	// MaxSessionBytes, MaxSessionDuration and MaxPacketsPerSecond are the
+	// default and largest per-session quotas; see StartRequest. Zero is
+	// unlimited.
+	MaxSessionBytes     int      `json:"maxSessionBytes"`
+	MaxSessionDuration  Duration `json:"maxSessionDuration"`
+	MaxPacketsPerSecond int      `json:"maxPacketsPerSecond"`
+
+	// MinFrameRate, if set, flags video tracks relaying fewer frames per
+	// second in /stats and the event log.
+	MinFrameRate int `json:"minFrameRate"`
+
+	// WriteLatencyWarning, if set, logs a warning event when writing a
+	// packet to the PeerConnection takes longer, at most every 10s per
+	// track.
+	WriteLatencyWarning Duration `json:"writeLatencyWarning"`
+
+	// StateFile, if set, keeps the WHIP resources of running sessions and
+	// their tokens, so a restart after a crash can delete the ones left
+	// behind.
+	StateFile string `json:"stateFile"`
+
+	// WebhookURL, if set, is POSTed a JSON event when a session ends, and
+	// a ShutdownEvent when the server shuts down.
+	WebhookURL string `json:"webhookUrl"`
+
+	// MetricLabels names the StartRequest labels /metrics adds to each
+	// session's series, e.g. ["region"]. Every distinct value makes new
+	// series, so name only labels with a few values. Other labels are
+	// still in the logs, the session endpoints and webhooks.
+	MetricLabels []string `json:"metricLabels"`
+
+	// TeardownTimeout bounds closing a session, including the DELETE
+	// retries. When it runs out the WHIP resource is abandoned and recorded
+	// as a failed teardown. Defaults to 10s.
+	TeardownTimeout Duration `json:"teardownTimeout"`
+
+	// ICEDisconnectGrace, if set, ends a session whose ICE connection
+	// fails, or stays disconnected for longer than this. Unset, ICE state
+	// is only logged. pion reports a connection that has been disconnected
+	// for iceFailedTimeout as failed, so longer grace periods have no
+	// effect.
+	ICEDisconnectGrace Duration `json:"iceDisconnectGrace"`
+
+	// ICEDisconnectedTimeout, ICEFailedTimeout and ICEKeepaliveInterval
+	// tune how pion's ICE agent judges a connection. It is disconnected
+	// after ICEDisconnectedTimeout without traffic from the WHIP server
+	// (default 5s, 1s to 1m), and failed ICEFailedTimeout after that
+	// (default 25s, 1s to 5m). While no media flows it sends a keepalive
+	// every ICEKeepaliveInterval (default 2s, 100ms to 30s), which has to
+	// be shorter than ICEDisconnectedTimeout. Longer timeouts ride out
+	// brief network interruptions; shorter ones notice a dead path sooner,
+	// for iceDisconnectGrace or an ICE restart to act on.
+	ICEDisconnectedTimeout Duration `json:"iceDisconnectedTimeout"`
+	ICEFailedTimeout       Duration `json:"iceFailedTimeout"`
+	ICEKeepaliveInterval   Duration `json:"iceKeepaliveInterval"`
+
+	// STUNPrecheckTimeout bounds the stunPrecheck of a /start. Defaults to
+	// 3s.
+	STUNPrecheckTimeout Duration `json:"stunPrecheckTimeout"`
+
+	// NegotiationTimeout bounds negotiating a session's upstream, from
+	// creating the offer through the WHIP POST to applying the answer, for
+	// sessions that don't set their own. Defaults to 30s.
+	NegotiationTimeout Duration `json:"negotiationTimeout"`
+
+	// DSCP (0-63) marks the PeerConnection's outgoing packets for QoS, e.g.
+	// 46 for Expedited Forwarding. Zero leaves them unmarked. Supported on
+	// Linux, macOS and FreeBSD.
+	DSCP int `json:"dscp"`
+
+	// SenderReportInterval is how often RTCP sender reports are sent for
+	// each relayed track, for the receiver's lip-sync. Defaults to 1s.
+	SenderReportInterval Duration `json:"senderReportInterval"`
+
+	// StrictInterceptors fails building a PeerConnection API, and with it
+	// the config or a /start, when one of the NACK, RTCP report, simulcast
+	// or TWCC interceptors fails to register. By default that is logged,
+	// and sessions run without the failed one: e.g. without NACK, lost
+	// packets aren't resent.
+	StrictInterceptors bool `json:"strictInterceptors"`
+
+	// IdleTimeout exits the process after it has run this long with no
+	// sessions, for deployments that scale relays to zero. Zero disables
+	// it. The -idle-timeout flag takes precedence.
+	IdleTimeout Duration `json:"idleTimeout"`
+
+	// AllowedIngestHosts, when set, limits the WHIP servers sessions may
+	// use, so the API can't be used to reach arbitrary hosts. Entries
+	// starting with "." also match subdomains. Loopback and link-local
+	// hosts, including cloud metadata addresses, are refused even without
+	// a list unless an entry names them exactly, e.g. "localhost".
+	AllowedIngestHosts []string `json:"allowedIngestHosts"`
+
+	// SRTP, if set, is the SRTP ffmpeg sends every session's media with.
+	SRTP SRTPConfig `json:"srtp"`
+
+	// ICEFilter limits where ICE candidates are gathered.
+	ICEFilter ICEFilter `json:"iceFilter"`
+
+	// MDNS is how ICE uses mDNS .local hostnames. "query" (the default)
+	// gathers only IP candidates but resolves .local ones in WHIP answers.
+	// "gather" also hides the relay's host addresses behind .local names,
+	// which WHIP servers outside the relay's LAN can't resolve, so only
+	// reflexive or relayed candidates reach them. "off" neither gathers nor
+	// resolves them, and doesn't open the mDNS socket, for hosts where
+	// multicast is blocked or port 5353 is taken.
+	MDNS string `json:"mdns"`
+
+	// SDPTransforms edit every session's offer before it is POSTed, ahead
+	// of the StartRequest's own transforms.
+	SDPTransforms []SDPTransform `json:"sdpTransforms"`
+
+	// RecordDir, when set, confines StartRequest recordPaths to it, so
+	// API clients can't write elsewhere on the host.
+	RecordDir string `json:"recordDir"`
+
+	// AnswerCandidates is what to do with a WHIP answer without ICE
+	// candidates: "require" (the default) fails the negotiation with 502
+	// WHIP_BAD_ANSWER, "warn" only logs it.
+	AnswerCandidates string `json:"answerCandidates"`
+
+	// EmptyAnswer is what to do when the WHIP server answers 201 with no
+	// SDP in the body: "fetch" (the default) GETs the answer from the
+	// resource URL, "fail" fails the negotiation with 502 WHIP_BAD_ANSWER
+	// straight away.
+	EmptyAnswer string `json:"emptyAnswer"`
+
+	// BundlePolicy and RTCPMuxPolicy are the defaults for the StartRequest
+	// fields of the same name: "max-bundle" and "require" if unset.
+	BundlePolicy  string `json:"bundlePolicy"`
+	RTCPMuxPolicy string `json:"rtcpMuxPolicy"`
+
+	// AccessLog logs every HTTP request with its status and duration.
+	AccessLog bool `json:"accessLog"`
+
+	// Debug includes WHIP answers in the logs and in the error responses
+	// of answers that fail to apply.
+	Debug bool `json:"debug"`
+
+	// WHIPClient tunes the HTTP client used to talk to WHIP servers.
+	WHIPClient HTTPClientConfig `json:"whipClient"`
+
+	whipClient *http.Client
+
+	// api is shared by the sessions that don't override what it is built
+	// from; see session.api.
+	api *webrtc.API
+}
+
+// HTTPClientConfig tunes the WHIP HTTP transport. Zero durations fall back
+// to the defaults below.
+type HTTPClientConfig struct {
+	DialTimeout         Duration `json:"dialTimeout"`
+	TLSHandshakeTimeout Duration `json:"tlsHandshakeTimeout"`
+	IdleConnTimeout     Duration `json:"idleConnTimeout"`
+
+	// KeepAlive is the TCP keep-alive period; DisableKeepAlives turns off
+	// connection reuse between WHIP requests altogether.
+	KeepAlive         Duration `json:"keepAlive"`
+	DisableKeepAlives bool     `json:"disableKeepAlives"`
+
+	// ForceHTTP1 disables HTTP/2 for servers or proxies that mishandle it.
+	ForceHTTP1 bool `json:"forceHttp1"`
+
+	// CertFile and KeyFile are a PEM client certificate and key presented
+	// to WHIP servers that require mutual TLS. CAFile, if set, is a PEM
+	// bundle that replaces the system roots for verifying WHIP servers.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	CAFile   string `json:"caFile"`
+
+	// SigV4, if its service is set, signs WHIP requests for AWS.
+	SigV4 SigV4Config `json:"sigv4"`
+
+	// UserAgent is sent with every WHIP request, for servers that log or
+	// allowlist by it. Defaults to streamwithfriends-whip-server/<version>.
+	UserAgent string `json:"userAgent"`
+}
+
+const (
+	defaultMaxAnswerBytes       = 256 << 10
+	defaultDeleteAttempts       = 3
+	defaultDeleteBackoff        = 500 * time.Millisecond
+	defaultRTPReadRetries       = 5
+	defaultRTPReadBackoff       = 20 * time.Millisecond
+	defaultTeardownTimeout      = 10 * time.Second
+	defaultSTUNPrecheckTimeout  = 3 * time.Second
+	defaultNegotiationTimeout   = 30 * time.Second
+	defaultSenderReportInterval = time.Second
+	defaultICEDisconnected      = 5 * time.Second
+	defaultICEFailed            = 25 * time.Second
+	defaultICEKeepalive         = 2 * time.Second
+	defaultBreakerThreshold     = 5
+	defaultBreakerCooldown      = 30 * time.Second
+	defaultDialTimeout          = 10 * time.Second
+	defaultTLSHandshakeTimeout  = 10 * time.Second
+	defaultIdleConnTimeout      = 90 * time.Second
+	defaultKeepAlive            = 30 * time.Second
+)
+
+// Duration is a time.Duration that reads from JSON as a string like "5s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// or returns d, or def if d is zero.
+func (d Duration) or(def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// ConfigSummary is the non-secret part of a Config, safe to return from
+// /reload.
+type ConfigSummary struct {
+	MaxSessions   int      `json:"maxSessions"`
+	ICEServerRefs []string `json:"iceServerRefs"`
+	Profiles      []string `json:"profiles"`
+}
+
+// cfg is the active configuration. It is replaced wholesale by /reload.
+var cfg atomic.Pointer[Config]
+
+func init() {
+	c := &Config{
+		MaxSessions:    1,
+		MaxAnswerBytes: defaultMaxAnswerBytes,
+		DeleteAttempts: defaultDeleteAttempts,
+		DeleteBackoff:  Duration(defaultDeleteBackoff),
+		RTPReadRetries: defaultRTPReadRetries,
+		RTPReadBackoff: Duration(defaultRTPReadBackoff),
+
+		TeardownTimeout:     Duration(defaultTeardownTimeout),
+		STUNPrecheckTimeout: Duration(defaultSTUNPrecheckTimeout),
+		NegotiationTimeout:  Duration(defaultNegotiationTimeout),
+
+		SenderReportInterval: Duration(defaultSenderReportInterval),
+
+		ICEDisconnectedTimeout: Duration(defaultICEDisconnected),
+		ICEFailedTimeout:       Duration(defaultICEFailed),
+		ICEKeepaliveInterval:   Duration(defaultICEKeepalive),
+
+		BreakerThreshold: defaultBreakerThreshold,
+		BreakerCooldown:  Duration(defaultBreakerCooldown),
+	}
+	c.whipClient, _ = newWHIPClient(c.WHIPClient, nil)
+	c.api, _ = newAPI(defaultCodecs, nil, 0, c)
+	cfg.Store(c)
+}
+
+// loadConfig reads path (if non-empty) and then applies environment
+// overrides. A set named NAME can be defined or replaced with
+// ICE_SERVER_<NAME>_URLS (comma separated), ICE_SERVER_<NAME>_USERNAME and
+// ICE_SERVER_<NAME>_CREDENTIAL. Secrets (API_KEY, WHIP_TOKEN, SRTP_KEY and
+// the ICE credentials) can instead be read from the file named by the same
+// variable with a _FILE suffix. Scalar settings are overridden by their
+// upper snake case name, e.g. MAX_SESSIONS for maxSessions.
+func loadConfig(path string) (*Config, error) {
+	c := &Config{}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+	if c.ICEServers == nil {
+		c.ICEServers = make(map[string][]webrtc.ICEServer)
+	}
+
+	for _, kv := range os.Environ() {
+		key, urls, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, "ICE_SERVER_")
+		if !ok {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, "_URLS")
+		if !ok {
+			continue
+		}
+		server := webrtc.ICEServer{
+			URLs:     strings.Split(urls, ","),
+			Username: os.Getenv("ICE_SERVER_" + name + "_USERNAME"),
+		}
+		var credential string
+		if err := envSecret("ICE_SERVER_"+name+"_CREDENTIAL", &credential); err != nil {
+			return nil, err
+		}
+		server.Credential = credential
+		c.ICEServers[strings.ToLower(name)] = []webrtc.ICEServer{server}
+	}
+
+	if err := envSecret("API_KEY", &c.APIKey); err != nil {
+		return nil, err
+	}
+	if err := envSecret("WHIP_TOKEN", &c.WHIPToken); err != nil {
+		return nil, err
+	}
+	if err := envSecret("SRTP_KEY", &c.SRTP.Key); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("SRTP_SUITE"); v != "" {
+		c.SRTP.Suite = v
+	}
+	if v := os.Getenv("ANSWER_CANDIDATES"); v != "" {
+		c.AnswerCandidates = v
+	}
+	if v := os.Getenv("EMPTY_ANSWER"); v != "" {
+		c.EmptyAnswer = v
+	}
+	if v := os.Getenv("BUNDLE_POLICY"); v != "" {
+		c.BundlePolicy = v
+	}
+	if v := os.Getenv("RTCP_MUX_POLICY"); v != "" {
+		c.RTCPMuxPolicy = v
+	}
+	if v := os.Getenv("STATE_FILE"); v != "" {
+		c.StateFile = v
+	}
+	if v := os.Getenv("WEBHOOK_URL"); v != "" {
+		c.WebhookURL = v
+	}
+	if v := os.Getenv("METRIC_LABELS"); v != "" {
+		c.MetricLabels = strings.Split(v, ",")
+	}
+	if v := os.Getenv("RECORD_DIR"); v != "" {
+		c.RecordDir = v
+	}
+	if v := os.Getenv("ICE_FAMILY"); v != "" {
+		c.ICEFilter.Family = v
+	}
+	if v := os.Getenv("MDNS"); v != "" {
+		c.MDNS = v
+	}
+	if v := os.Getenv("ALLOWED_INGEST_HOSTS"); v != "" {
+		c.AllowedIngestHosts = strings.Split(v, ",")
+	}
+	for name, dst := range map[string]*[]string{
+		"ICE_INTERFACES":         &c.ICEFilter.Interfaces,
+		"ICE_EXCLUDE_INTERFACES": &c.ICEFilter.ExcludeInterfaces,
+		"ICE_NETWORKS":           &c.ICEFilter.Networks,
+		"ICE_EXCLUDE_NETWORKS":   &c.ICEFilter.ExcludeNetworks,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*dst = strings.Split(v, ",")
+		}
+	}
+	if err := envBool("RELAY_ONLY", &c.RelayOnly); err != nil {
+		return nil, err
+	}
+	if err := envBool("STRICT_INTERCEPTORS", &c.StrictInterceptors); err != nil {
+		return nil, err
+	}
+	if err := envBool("REJECT_DUPLICATE_INGEST", &c.RejectDuplicateIngest); err != nil {
+		return nil, err
+	}
+	if err := envBool("DEBUG", &c.Debug); err != nil {
+		return nil, err
+	}
+	if err := envBool("ACCESS_LOG", &c.AccessLog); err != nil {
+		return nil, err
+	}
+	if err := envInt("MAX_SESSIONS", &c.MaxSessions); err != nil {
+		return nil, err
+	}
+	if err := envInt("MAX_ANSWER_BYTES", &c.MaxAnswerBytes); err != nil {
+		return nil, err
+	}
+	if err := envInt("DSCP", &c.DSCP); err != nil {
+		return nil, err
+	}
+	if err := envInt("DELETE_ATTEMPTS", &c.DeleteAttempts); err != nil {
+		return nil, err
+	}
+	if err := envInt("RTP_READ_RETRIES", &c.RTPReadRetries); err != nil {
+		return nil, err
+	}
+	if err := envInt("BREAKER_THRESHOLD", &c.BreakerThreshold); err != nil {
+		return nil, err
+	}
+	if err := envInt("MAX_SESSION_BYTES", &c.MaxSessionBytes); err != nil {
+		return nil, err
+	}
+	if err := envInt("MAX_PACKETS_PER_SECOND", &c.MaxPacketsPerSecond); err != nil {
+		return nil, err
+	}
+	if err := envInt("MIN_FRAME_RATE", &c.MinFrameRate); err != nil {
+		return nil, err
+	}
+	for name, dst := range map[string]*Duration{
+		"DELETE_BACKOFF":             &c.DeleteBackoff,
+		"RTP_READ_BACKOFF":           &c.RTPReadBackoff,
+		"TEARDOWN_TIMEOUT":           &c.TeardownTimeout,
+		"STUN_PRECHECK_TIMEOUT":      &c.STUNPrecheckTimeout,
+		"NEGOTIATION_TIMEOUT":        &c.NegotiationTimeout,
+		"ICE_DISCONNECT_GRACE":       &c.ICEDisconnectGrace,
+		"ICE_DISCONNECTED_TIMEOUT":   &c.ICEDisconnectedTimeout,
+		"ICE_FAILED_TIMEOUT":         &c.ICEFailedTimeout,
+		"ICE_KEEPALIVE_INTERVAL":     &c.ICEKeepaliveInterval,
+		"BREAKER_COOLDOWN":           &c.BreakerCooldown,
+		"MAX_SESSION_DURATION":       &c.MaxSessionDuration,
+		"IDLE_TIMEOUT":               &c.IdleTimeout,
+		"SENDER_REPORT_INTERVAL":     &c.SenderReportInterval,
+		"WRITE_LATENCY_WARNING":      &c.WriteLatencyWarning,
+		"WHIP_DIAL_TIMEOUT":          &c.WHIPClient.DialTimeout,
+		"WHIP_TLS_HANDSHAKE_TIMEOUT": &c.WHIPClient.TLSHandshakeTimeout,
+		"WHIP_IDLE_CONN_TIMEOUT":     &c.WHIPClient.IdleConnTimeout,
+		"WHIP_KEEP_ALIVE":            &c.WHIPClient.KeepAlive,
+	} {
+		if err := envDuration(name, dst); err != nil {
+			return nil, err
+		}
+	}
+	if err := envBool("WHIP_DISABLE_KEEP_ALIVES", &c.WHIPClient.DisableKeepAlives); err != nil {
+		return nil, err
+	}
+	if err := envBool("WHIP_FORCE_HTTP1", &c.WHIPClient.ForceHTTP1); err != nil {
+		return nil, err
+	}
+	for name, dst := range map[string]*string{
+		"WHIP_CLIENT_CERT": &c.WHIPClient.CertFile,
+		"WHIP_CLIENT_KEY":  &c.WHIPClient.KeyFile,
+		"WHIP_CA_BUNDLE":   &c.WHIPClient.CAFile,
+
+		"WHIP_SIGV4_SERVICE": &c.WHIPClient.SigV4.Service,
+		"WHIP_SIGV4_REGION":  &c.WHIPClient.SigV4.Region,
+		"WHIP_SIGV4_PROFILE": &c.WHIPClient.SigV4.Profile,
+
+		"WHIP_USER_AGENT": &c.WHIPClient.UserAgent,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateSDPTransforms(c.SDPTransforms); err != nil {
+		return nil, err
+	}
+	if err := validateProfiles(c.Profiles); err != nil {
+		return nil, err
+	}
+	if _, err := c.ICEFilter.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.SRTP.validate(); err != nil {
+		return nil, err
+	}
+	if !slices.Contains([]string{"", "require", "warn"}, c.AnswerCandidates) {
+		return nil, fmt.Errorf("unknown answerCandidates %q", c.AnswerCandidates)
+	}
+	if !slices.Contains([]string{"", "fetch", "fail"}, c.EmptyAnswer) {
+		return nil, fmt.Errorf("unknown emptyAnswer %q", c.EmptyAnswer)
+	}
+	if err := validateMetricLabels(c.MetricLabels); err != nil {
+		return nil, err
+	}
+	if _, ok := mdnsModes[c.MDNS]; !ok {
+		return nil, fmt.Errorf("unknown mdns %q", c.MDNS)
+	}
+	if err := checkPolicies(StartRequest{}.policies(c)); err != nil {
+		return nil, err
+	}
+	if c.DSCP != 0 && !dscpSupported {
+		return nil, fmt.Errorf("dscp is not supported on %s", runtime.GOOS)
+	}
+
+	var err error
+	if c.whipClient, err = newWHIPClient(c.WHIPClient, c.AllowedIngestHosts); err != nil {
+		return nil, err
+	}
+	if c.api, err = newAPI(defaultCodecs, nil, c.DSCP, c); err != nil {
+		return nil, fmt.Errorf("failed to build webrtc api: %w", err)
+	}
+	logICEFilter(c.ICEFilter)
+	return c, nil
+}
+
+// envInt overwrites *dst with the integer in the environment variable name,
+// if it is set.
+func envInt(name string, dst *int) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envSecret overwrites *dst with the secret in the environment variable
+// name or, for mounted Docker and Kubernetes secrets, with the contents of
+// the file named by name_FILE, minus trailing newlines. Setting both is an
+// error.
+func envSecret(name string, dst *string) error {
+	v, path := os.Getenv(name), os.Getenv(name+"_FILE")
+	switch {
+	case v != "" && path != "":
+		return fmt.Errorf("set only one of %s and %s_FILE", name, name)
+	case path != "":
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		*dst = strings.TrimRight(string(b), "\r\n")
+	case v != "":
+		*dst = v
+	}
+	return nil
+}
+
+func envDuration(name string, dst *Duration) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	*dst = Duration(d)
+	return nil
+}
+
+func envBool(name string, dst *bool) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	*dst = b
+	return nil
+}
+
+func (c *Config) summary() ConfigSummary {
+	refs := make([]string, 0, len(c.ICEServers))
+	for name := range c.ICEServers {
+		refs = append(refs, name)
+	}
+	slices.Sort(refs)
+	return ConfigSummary{
+		MaxSessions:   c.MaxSessions,
+		ICEServerRefs: refs,
+		Profiles:      slices.Sorted(maps.Keys(c.Profiles)),
+	}
+}
+
+// hasTURN reports whether servers include a TURN server.
+func hasTURN(servers []webrtc.ICEServer) bool {
+	for _, server := range servers {
+		for _, u := range server.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// iceServers resolves a named ICE server set. An empty ref means no ICE
+// servers.
+func (c *Config) iceServers(ref string) ([]webrtc.ICEServer, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	servers, ok := c.ICEServers[strings.ToLower(ref)]
+	if !ok {
+		return nil, fmt.Errorf("unknown iceServerRef %q", ref)
+	}
+	return servers, nil
+}
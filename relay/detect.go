@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const defaultDetectWindow = 2 * time.Second
+
+// detectCodecs narrows each kind in codecs to the supported codec whose
+// payload type ffmpeg is actually sending. The offer has to exist before
+// media flows, so each enabled port is bound briefly, sniffed for its first
+// packet and released again; packets in that window are not relayed. A
+// kind with no packets or an unknown payload type keeps its configured
+// codecs.
+func (s *session) detectCodecs(req StartRequest, codecs []codec) []codec {
+	window := req.DetectWindow.or(defaultDetectWindow)
+	sources, _ := parseNetworks("sourceAllowlist", req.SourceAllowlist)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		observed = make(map[webrtc.RTPCodecType]uint8)
+	)
+	for kind, port := range map[webrtc.RTPCodecType]int{
+		webrtc.RTPCodecTypeAudio: req.AudioPort,
+		webrtc.RTPCodecTypeVideo: req.VideoPort,
+	} {
+		if port == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pt, ok := sniffPayloadType(port, window, sources)
+			if !ok {
+				s.event("detect", "no %s RTP on port %d within %s, keeping configured codecs", kind, port, window)
+				return
+			}
+			mu.Lock()
+			observed[kind] = pt
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for kind, pt := range observed {
+		match, ok := detectedCodec(req, codecs, kind, pt)
+		if !ok {
+			s.event("detect", "%s payload type %d matches no supported codec, keeping configured codecs", kind, pt)
+			continue
+		}
+		s.event("detect", "%s payload type %d is %s", kind, pt, match.params.MimeType)
+
+		codecs = slices.DeleteFunc(slices.Clone(codecs), func(c codec) bool { return c.kind == kind })
+		codecs = append(codecs, match)
+	}
+	return codecs
+}
+
+// detectedCodec returns the supported codec of kind on payload type pt.
+// One in codecs is returned as configured, with the session's clock rate
+// and fmtp; any other, such as an opt-in codec the allowlist left out,
+// gets req's options.
+func detectedCodec(req StartRequest, codecs []codec, kind webrtc.RTPCodecType, pt uint8) (codec, bool) {
+	i := slices.IndexFunc(supportedCodecs, func(c codec) bool {
+		return c.kind == kind && uint8(c.params.PayloadType) == pt
+	})
+	if i < 0 {
+		return codec{}, false
+	}
+	match := supportedCodecs[i]
+	if j := slices.IndexFunc(codecs, func(c codec) bool { return c.is(match.params.MimeType) }); j >= 0 {
+		return codecs[j], true
+	}
+	return req.withOptions([]codec{match})[0], true
+}
+
+// sniffPayloadType returns the payload type of the first RTP packet from
+// sources that arrives on port within window. Like listenRTP, it binds
+// every interface if sources is set.
+func sniffPayloadType(port int, window time.Duration, sources sourceFilter) (uint8, bool) {
+	addr := net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	if sources != nil {
+		addr.IP = nil
+	}
+	conn, err := net.ListenUDP("udp", &addr)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(window))
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, false
+		}
+		if !sources.allows(from) {
+			continue
+		}
+		var h rtp.Header
+		if _, err := h.Unmarshal(buf[:n]); err == nil {
+			return h.PayloadType, true
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestDetectedCodec(t *testing.T) {
+	vp8Only, _ := selectCodecs(nil, []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo})
+	slowVP8, _ := withClockRates(vp8Only, map[string]uint32{"vp8": 45000})
+
+	tests := []struct {
+		name      string
+		req       StartRequest
+		codecs    []codec
+		kind      webrtc.RTPCodecType
+		pt        uint8
+		wantMime  string
+		wantClock uint32
+		wantRTX   bool
+	}{
+		{"configured", StartRequest{}, vp8Only, webrtc.RTPCodecTypeVideo, 102, webrtc.MimeTypeVP8, 90000, false},
+		{"configured keeps its clock rate", StartRequest{}, slowVP8, webrtc.RTPCodecTypeVideo, 102, webrtc.MimeTypeVP8, 45000, false},
+		{"opt-in not configured", StartRequest{}, vp8Only, webrtc.RTPCodecTypeVideo, 106, webrtc.MimeTypeH264, 90000, false},
+		{"not configured gets options", StartRequest{VideoRTX: true}, vp8Only, webrtc.RTPCodecTypeVideo, 106, webrtc.MimeTypeH264, 90000, true},
+		{"audio", StartRequest{}, vp8Only, webrtc.RTPCodecTypeAudio, 111, webrtc.MimeTypeOpus, 48000, false},
+		{"unknown payload type", StartRequest{}, vp8Only, webrtc.RTPCodecTypeVideo, 96, "", 0, false},
+		{"other kind's payload type", StartRequest{}, vp8Only, webrtc.RTPCodecTypeAudio, 102, "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, ok := detectedCodec(tt.req, tt.codecs, tt.kind, tt.pt)
+			if ok != (tt.wantMime != "") {
+				t.Fatalf("found = %v, want %v", ok, !ok)
+			}
+			if !ok {
+				return
+			}
+			if c.params.MimeType != tt.wantMime || c.params.ClockRate != tt.wantClock || c.rtx != tt.wantRTX {
+				t.Errorf("got %s/%d rtx=%v, want %s/%d rtx=%v",
+					c.params.MimeType, c.params.ClockRate, c.rtx, tt.wantMime, tt.wantClock, tt.wantRTX)
+			}
+		})
+	}
+}
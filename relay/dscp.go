@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/pion/transport/v3"
+	"github.com/pion/transport/v3/stdnet"
+)
+
+// dscpNet is the network PeerConnections use when a DSCP value is
+// configured. It marks every UDP socket ICE opens, whether for host, server
+// reflexive or TURN candidates, so upstream media can be prioritized.
+type dscpNet struct {
+	*stdnet.Net
+	tos int
+}
+
+func newDSCPNet(dscp int) (*dscpNet, error) {
+	n, err := stdnet.NewNet()
+	if err != nil {
+		return nil, err
+	}
+	// DSCP is the upper six bits of the TOS / traffic class byte.
+	return &dscpNet{Net: n, tos: dscp << 2}, nil
+}
+
+func (n *dscpNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err == nil {
+		n.mark(conn)
+	}
+	return conn, err
+}
+
+func (n *dscpNet) ListenUDP(network string, laddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, laddr)
+	if err == nil {
+		n.mark(conn)
+	}
+	return conn, err
+}
+
+func (n *dscpNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.DialUDP(network, laddr, raddr)
+	if err == nil {
+		n.mark(conn)
+	}
+	return conn, err
+}
+
+// mark sets the socket's TOS. A failure only costs the marking, so it is
+// logged rather than failing ICE.
+func (n *dscpNet) mark(conn interface{ LocalAddr() net.Addr }) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if err := setTOS(sc, n.tos); err != nil {
+		log.Printf("failed to set DSCP on %v: %v", conn.LocalAddr(), err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+const dscpSupported = false
+
+func setTOS(c syscall.Conn, tos int) error {
+	return errors.New("setting DSCP is not supported on this platform")
+}
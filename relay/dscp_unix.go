@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package relay
+
+import "syscall"
+
+const dscpSupported = true
+
+// setTOS sets both the IPv4 TOS and the IPv6 traffic class, since a
+// dual-stack socket can carry either; it fails only if neither applies.
+func setTOS(c syscall.Conn, tos int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err == nil {
+			serr = nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ingestKey normalizes ingestURL for comparing sessions' targets: the
+// scheme and host are case-insensitive, a default port is implied, and a
+// trailing slash or fragment doesn't address another resource.
+func ingestKey(ingestURL string) string {
+	u, err := url.Parse(ingestURL)
+	if err != nil {
+		return ingestURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = host + ":" + port
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.Fragment, u.RawFragment = "", ""
+	u.User = nil
+	return u.String()
+}
+
+// duplicateIngestError reports that a session already targets the ingest
+// URL a /start asked for. sessionID is empty while that session is still
+// starting.
+type duplicateIngestError struct {
+	sessionID string
+}
+
+func (e *duplicateIngestError) Error() string {
+	if e.sessionID == "" {
+		return "a session to this ingestUrl is already starting"
+	}
+	return fmt.Sprintf("session %s already relays to this ingestUrl; set replace to stop it first", e.sessionID)
+}
+
+// sessionTo returns a running session whose current ingest URL has key.
+func sessionTo(key string) *session {
+	mu.Lock()
+	running := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		running = append(running, s)
+	}
+	mu.Unlock()
+	for _, s := range running {
+		if ingestKey(s.ingestURL()) == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// checkDuplicateIngest enforces rejectDuplicateIngest for a /start to key,
+// ending the session already relaying there if replace is set.
+func checkDuplicateIngest(key string, replace bool) error {
+	s := sessionTo(key)
+	switch {
+	case s == nil:
+		return nil
+	case replace:
+		s.event("replaced", "a new session to the same ingest URL replaces this one")
+		s.end(TeardownReplaced, "replaced by a new session")
+		return nil
+	case cfg.Load().RejectDuplicateIngest:
+		return newRelayError(CodeDuplicateIngest, http.StatusConflict, &duplicateIngestError{sessionID: s.id})
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Error codes returned in ErrorResponse.Code. Clients can switch on these;
+// the accompanying messages are for humans and may change.
+const (
+	CodeBadRequest         = "BAD_REQUEST"
+	CodeUnauthorized       = "UNAUTHORIZED"
+	CodeUnsupportedMedia   = "UNSUPPORTED_MEDIA_TYPE"
+	CodeSessionNotFound    = "SESSION_NOT_FOUND"
+	CodeSessionLimit       = "SESSION_LIMIT"
+	CodeDuplicateIngest    = "DUPLICATE_INGEST"
+	CodeIngestForbidden    = "INGEST_FORBIDDEN"
+	CodePortInUse          = "PORT_IN_USE"
+	CodeWHIPUnreachable    = "WHIP_UNREACHABLE"
+	CodeWHIPUpstream4xx    = "WHIP_UPSTREAM_4XX"
+	CodeWHIPAuthFailed     = "WHIP_AUTH_FAILED"
+	CodeWHIPUpstream5xx    = "WHIP_UPSTREAM_5XX"
+	CodeWHIPBadAnswer      = "WHIP_BAD_ANSWER"
+	CodeNegotiationTimeout = "NEGOTIATION_TIMEOUT"
+	CodeMediaRejected      = "MEDIA_REJECTED"
+	CodeCodecMismatch      = "CODEC_MISMATCH"
+	CodeSTUNUnreachable    = "STUN_UNREACHABLE"
+	CodeCircuitOpen        = "CIRCUIT_OPEN"
+	CodeDataChannelNotOpen = "DATA_CHANNEL_NOT_OPEN"
+	CodeNoSource           = "NO_SOURCE"
+	CodeNoVideo            = "NO_VIDEO"
+	CodeConfigInvalid      = "CONFIG_INVALID"
+	CodeInternal           = "INTERNAL"
+)
+
+// RelayError is an error with a stable code and the HTTP status a handler
+// should answer with. It can sit anywhere in a wrapped error chain;
+// writeError finds it with errors.As and falls back to CodeInternal.
+type RelayError struct {
+	Code   string
+	Status int
+	Err    error
+}
+
+func newRelayError(code string, status int, err error) *RelayError {
+	return &RelayError{Code: code, Status: status, Err: err}
+}
+
+func (e *RelayError) Error() string { return e.Err.Error() }
+func (e *RelayError) Unwrap() error { return e.Err }
+
+var (
+	errBadRequest      = newRelayError(CodeBadRequest, http.StatusBadRequest, errors.New("bad request"))
+	errUnauthorized    = newRelayError(CodeUnauthorized, http.StatusUnauthorized, errors.New("unauthorized"))
+	errSessionNotFound = newRelayError(CodeSessionNotFound, http.StatusNotFound, errors.New("session not found"))
+)
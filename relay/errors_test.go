@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// whipStatus starts a WHIP server that answers every request with status.
+func whipStatus(t *testing.T, status int) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(status), status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// startOK starts a session through the API and returns its ID.
+func startOK(t *testing.T, body string) string {
+	t.Helper()
+	w := call(http.MethodPost, "/start", "application/json", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("start failed with %d: %s", w.Code, w.Body)
+	}
+	var resp SessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.ID
+}
+
+func TestErrorCodes(t *testing.T) {
+	janus := fixture(t, "janus-answer.sdp")
+	tests := []struct {
+		name   string
+		config string
+		do     func(t *testing.T) *httptest.ResponseRecorder
+		status int
+		code   string
+	}{
+		{
+			name: "malformed request",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", `{"ingestUrl": `)
+			},
+			status: http.StatusBadRequest, code: CodeBadRequest,
+		},
+		{
+			name: "invalid request",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, "http://example.com/whip", `"bundlePolicy": "sometimes"`))
+			},
+			status: http.StatusBadRequest, code: CodeBadRequest,
+		},
+		{
+			name: "unsupported content type",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "text/plain", "ingestUrl")
+			},
+			status: http.StatusUnsupportedMediaType, code: CodeUnsupportedMedia,
+		},
+		{
+			name:   "missing api key",
+			config: `{"apiKey": "secret"}`,
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodGet, "/sessions", "", "")
+			},
+			status: http.StatusUnauthorized, code: CodeUnauthorized,
+		},
+		{
+			name: "unknown session",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodGet, "/session/nope", "", "")
+			},
+			status: http.StatusNotFound, code: CodeSessionNotFound,
+		},
+		{
+			name:   "internal ingest host",
+			config: `{}`,
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, "http://127.0.0.1:1/whip", ""))
+			},
+			status: http.StatusForbidden, code: CodeIngestForbidden,
+		},
+		{
+			name: "port in use",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				held, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer held.Close()
+				port := held.LocalAddr().(*net.UDPAddr).Port
+				body := fmt.Sprintf(`{"ingestUrl": "http://127.0.0.1:1/whip", "videoPort": %d}`, port)
+				return call(http.MethodPost, "/start", "application/json", body)
+			},
+			status: http.StatusConflict, code: CodePortInUse,
+		},
+		{
+			name: "whip server unreachable",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				ts := httptest.NewServer(http.NotFoundHandler())
+				ts.Close()
+				return call(http.MethodPost, "/start", "application/json", startBody(t, ts.URL+"/whip", ""))
+			},
+			status: http.StatusBadGateway, code: CodeWHIPUnreachable,
+		},
+		{
+			name: "whip server 404",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, whipStatus(t, http.StatusNotFound).URL, ""))
+			},
+			status: http.StatusBadGateway, code: CodeWHIPUpstream4xx,
+		},
+		{
+			name: "whip server 403",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, whipStatus(t, http.StatusForbidden).URL, ""))
+			},
+			status: http.StatusBadGateway, code: CodeWHIPAuthFailed,
+		},
+		{
+			name: "whip server 503",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, whipStatus(t, http.StatusServiceUnavailable).URL, ""))
+			},
+			status: http.StatusBadGateway, code: CodeWHIPUpstream5xx,
+		},
+		{
+			name: "answer isn't sdp",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, newWHIPServer(t, "not sdp").URL, ""))
+			},
+			status: http.StatusBadGateway, code: CodeWHIPBadAnswer,
+		},
+		{
+			name:   "negotiation timeout",
+			config: `{"allowedIngestHosts": ["127.0.0.1"], "negotiationTimeout": "1s"}`,
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				stall := make(chan struct{})
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					select {
+					case <-stall:
+					case <-r.Context().Done():
+					}
+				}))
+				defer ts.Close()
+				defer close(stall)
+				return call(http.MethodPost, "/start", "application/json", startBody(t, ts.URL, ""))
+			},
+			status: http.StatusGatewayTimeout, code: CodeNegotiationTimeout,
+		},
+		{
+			name: "answer rejects all media",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				answer := strings.NewReplacer("m=audio 9", "m=audio 0", "m=video 9", "m=video 0").Replace(janus)
+				return call(http.MethodPost, "/start", "application/json", startBody(t, newWHIPServer(t, answer).URL, ""))
+			},
+			status: http.StatusBadGateway, code: CodeMediaRejected,
+		},
+		{
+			name: "h264 profile mismatch",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				answer := strings.NewReplacer(
+					"m=video 9 UDP/TLS/RTP/SAVPF 102", "m=video 9 UDP/TLS/RTP/SAVPF 106",
+					"a=rtpmap:102 VP8/90000", "a=rtpmap:106 H264/90000\r\na=fmtp:106 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e034",
+					"a=rtcp-fb:102", "a=rtcp-fb:106",
+				).Replace(janus)
+				body := startBody(t, newWHIPServer(t, answer).URL, `"codecAllowlist": ["opus", "h264"], "h264Profile": "42e01f"`)
+				return call(http.MethodPost, "/start", "application/json", body)
+			},
+			status: http.StatusBadGateway, code: CodeCodecMismatch,
+		},
+		{
+			name: "session limit",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				startOK(t, startBody(t, newWHIPServer(t, janus).URL, ""))
+				return call(http.MethodPost, "/start", "application/json", startBody(t, newWHIPServer(t, janus).URL, ""))
+			},
+			status: http.StatusServiceUnavailable, code: CodeSessionLimit,
+		},
+		{
+			name:   "duplicate ingest",
+			config: `{"allowedIngestHosts": ["127.0.0.1"], "maxSessions": 2, "rejectDuplicateIngest": true}`,
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				ws := newWHIPServer(t, janus)
+				startOK(t, startBody(t, ws.URL, ""))
+				return call(http.MethodPost, "/start", "application/json", startBody(t, ws.URL, ""))
+			},
+			status: http.StatusConflict, code: CodeDuplicateIngest,
+		},
+		{
+			name:   "circuit open",
+			config: `{"allowedIngestHosts": ["127.0.0.1"], "breakerThreshold": 1}`,
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				ts := whipStatus(t, http.StatusInternalServerError)
+				call(http.MethodPost, "/start", "application/json", startBody(t, ts.URL, ""))
+				return call(http.MethodPost, "/start", "application/json", startBody(t, ts.URL, ""))
+			},
+			status: http.StatusServiceUnavailable, code: CodeCircuitOpen,
+		},
+		{
+			name: "no keyframe source",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				id := startOK(t, startBody(t, newWHIPServer(t, janus).URL, ""))
+				return call(http.MethodPost, "/session/"+id+"/keyframe", "", "")
+			},
+			status: http.StatusConflict, code: CodeNoSource,
+		},
+		{
+			name: "data channel not open",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				id := startOK(t, startBody(t, newWHIPServer(t, janus).URL, `"dataChannel": "chat"`))
+				return call(http.MethodPost, "/session/"+id+"/data", "text/plain", "hello")
+			},
+			status: http.StatusConflict, code: CodeDataChannelNotOpen,
+		},
+		{
+			name: "no video before waitKeyframe",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				return call(http.MethodPost, "/start", "application/json", startBody(t, newWHIPServer(t, janus).URL, `"waitKeyframe": "100ms"`))
+			},
+			status: http.StatusGatewayTimeout, code: CodeNoVideo,
+		},
+		{
+			name:   "stun server unreachable",
+			config: `{"allowedIngestHosts": ["127.0.0.1"], "stunPrecheckTimeout": "100ms", "iceServers": {"dead": [{"urls": ["stun:127.0.0.1:9"]}]}}`,
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				body := startBody(t, newWHIPServer(t, janus).URL, `"iceServerRef": "dead", "stunPrecheck": true`)
+				return call(http.MethodPost, "/start", "application/json", body)
+			},
+			status: http.StatusBadGateway, code: CodeSTUNUnreachable,
+		},
+		{
+			name: "invalid config on reload",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				path := filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(path, []byte(`{"mdns": "shout"}`), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				defer func(old string) { configPath = old }(configPath)
+				configPath = path
+				return call(http.MethodPost, "/reload", "", "")
+			},
+			status: http.StatusInternalServerError, code: CodeConfigInvalid,
+		},
+		{
+			name: "uncoded error",
+			do: func(t *testing.T) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				writeError(w, fmt.Errorf("wrapped: %w", errors.New("boom")))
+				return w
+			},
+			status: http.StatusInternalServerError, code: CodeInternal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, cmp.Or(tt.config, loopbackConfig))
+			endSessions(t)
+
+			start := time.Now()
+			w := tt.do(t)
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("%d response isn't an ErrorResponse: %s", w.Code, w.Body)
+			}
+			if w.Code != tt.status || resp.Code != tt.code {
+				t.Errorf("got %d %s (%s), want %d %s", w.Code, resp.Code, resp.Error, tt.status, tt.code)
+			}
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("took %s", d)
+			}
+		})
+	}
+}
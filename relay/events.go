@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxSessionEvents is how many events each session keeps; older ones are
+// discarded.
+const maxSessionEvents = 100
+
+// Event is one entry in a session's audit trail.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+type EventsResponse struct {
+	ID     string  `json:"id"`
+	Events []Event `json:"events"`
+}
+
+// eventLog is a bounded, chronological list of events.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.events) == maxSessionEvents {
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+	l.events = append(l.events, e)
+}
+
+func (l *eventLog) list() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
+
+// event records an event for the session and writes it to the log.
+func (s *session) event(typ, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	s.events.add(Event{Time: time.Now(), Type: typ, Message: msg})
+	s.logf("[%s] %s", typ, msg)
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, EventsResponse{ID: s.id, Events: s.events.list()})
+}
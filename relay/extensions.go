@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// extensionMap rewrites header extension IDs on one track. Incoming IDs
+// missing from the map, or mapped to 0 because the WHIP server didn't
+// negotiate their URI, are removed.
+type extensionMap map[uint8]uint8
+
+func (m extensionMap) apply(h *rtp.Header) {
+	if !h.Extension {
+		return
+	}
+
+	type extension struct {
+		id      uint8
+		payload []byte
+	}
+	var keep []extension
+	for _, id := range h.GetExtensionIDs() {
+		if to := m[id]; to != 0 {
+			keep = append(keep, extension{to, h.GetExtension(id)})
+		}
+	}
+
+	// Rebuild in place, keeping the packet's extension profile.
+	h.Extensions = h.Extensions[:0]
+	h.Extension = len(keep) > 0
+	for _, e := range keep {
+		if err := h.SetExtension(e.id, e.payload); err != nil {
+			log.Printf("failed to rewrite header extension %d: %v", e.id, err)
+		}
+	}
+}
+
+func validateHeaderExtensions(exts []HeaderExtension) error {
+	seen := make(map[string]bool)
+	for _, e := range exts {
+		if e.URI == "" {
+			return fmt.Errorf("header extension %d has no uri", e.ID)
+		}
+		if e.ID < 1 || e.ID > 14 {
+			return fmt.Errorf("header extension %s: id %d outside the one-byte range 1-14", e.URI, e.ID)
+		}
+		kinds, err := extensionKinds(e)
+		if err != nil {
+			return err
+		}
+		for _, kind := range kinds {
+			key := fmt.Sprintf("%s/%d", kind, e.ID)
+			if seen[key] {
+				return fmt.Errorf("header extension id %d used twice for %s", e.ID, kind)
+			}
+			seen[key] = true
+		}
+	}
+	return nil
+}
+
+func extensionKinds(e HeaderExtension) ([]webrtc.RTPCodecType, error) {
+	switch e.Kind {
+	case "":
+		return []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}, nil
+	case "audio":
+		return []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}, nil
+	case "video":
+		return []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}, nil
+	}
+	return nil, fmt.Errorf("header extension %s: unknown kind %q", e.URI, e.Kind)
+}
+
+// registerHeaderExtensions offers every declared extension URI for its
+// kinds.
+func registerHeaderExtensions(m *webrtc.MediaEngine, exts []HeaderExtension) error {
+	for _, e := range exts {
+		kinds, _ := extensionKinds(e)
+		for _, kind := range kinds {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: e.URI}, kind); err != nil {
+				return fmt.Errorf("failed to register header extension %s: %w", e.URI, err)
+			}
+		}
+	}
+	return nil
+}
+
+// remapExtensions builds each track's extension map from the IDs negotiated
+// on up. Pion assigns the IDs as the offerer, so every upstream of a session
+// ends up with the same mapping and swapping it in during a migration is
+// safe.
+func (s *session) remapExtensions(up *upstream) {
+	for _, sender := range up.pc.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+		mt := s.mediaTrack(sender.Track().Kind())
+
+		negotiated := make(map[string]uint8)
+		for _, h := range sender.GetParameters().HeaderExtensions {
+			negotiated[h.URI] = uint8(h.ID)
+		}
+
+		m := make(extensionMap)
+		for _, e := range s.extensions {
+			kinds, _ := extensionKinds(e)
+			for _, kind := range kinds {
+				if kind != mt.kind {
+					continue
+				}
+				m[uint8(e.ID)] = negotiated[e.URI]
+				if negotiated[e.URI] == 0 {
+					s.logf("%s header extension %s not negotiated, stripping it", kind, e.URI)
+				}
+			}
+		}
+		mt.extensions.Store(&m)
+	}
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxFormBytes bounds a /start body, JSON or form, like net/http's form
+// parsing does for its own.
+const maxFormBytes = 1 << 20
+
+// decodeStartRequest reads a /start body into req. JSON is the documented
+// format, and what a body without a Content-Type is taken to be. For
+// tooling that can only post forms, application/x-www-form-urlencoded
+// and multipart/form-data are accepted too, see formToJSON. A form body
+// that starts with "{" is JSON after all, since that's what curl -d sends
+// without -H. Other content types get 415, and bodies over maxFormBytes
+// 413.
+func decodeStartRequest(w http.ResponseWriter, r *http.Request, req *StartRequest) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+	ct := r.Header.Get("Content-Type")
+	mediaType := ""
+	if ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("invalid Content-Type %q", ct))
+		}
+	}
+
+	var values url.Values
+	switch {
+	case mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return bodyError(err)
+		}
+		return unmarshalStartRequest(body, req)
+	case mediaType == "application/x-www-form-urlencoded":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return bodyError(err)
+		}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+			return unmarshalStartRequest(trimmed, req)
+		}
+		if values, err = url.ParseQuery(string(body)); err != nil {
+			return newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("invalid form: %w", err))
+		}
+	case mediaType == "multipart/form-data":
+		if err := r.ParseMultipartForm(maxFormBytes); err != nil {
+			if errors.As(err, new(*http.MaxBytesError)) {
+				return bodyError(err)
+			}
+			return newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("invalid form: %w", err))
+		}
+		values = r.MultipartForm.Value
+	default:
+		return newRelayError(CodeUnsupportedMedia, http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported Content-Type %q: send application/json, or a form", mediaType))
+	}
+
+	b, err := formToJSON(values, reflect.TypeFor[StartRequest]())
+	if err != nil {
+		return newRelayError(CodeBadRequest, http.StatusBadRequest, err)
+	}
+	if err := unmarshalStartRequest(b, req); err != nil {
+		if errors.Is(err, errBadRequest) {
+			return newRelayError(CodeBadRequest, http.StatusBadRequest, errors.New("invalid form"))
+		}
+		return err
+	}
+	return nil
+}
+
+// bodyError is the error for a /start body that couldn't be read: 413 if
+// it was over maxFormBytes.
+func bodyError(err error) error {
+	if errors.As(err, new(*http.MaxBytesError)) {
+		return newRelayError(CodeBadRequest, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", maxFormBytes))
+	}
+	return errBadRequest
+}
+
+// formToJSON converts form values to a JSON object of the struct type t,
+// each field named by its JSON key: ingestUrl=...&videoPort=5004. Strings
+// and durations are taken as they are, numbers and booleans are parsed
+// ("on", as a checked box sends, is true), and string lists may repeat the
+// field or separate values with commas. Anything else, such as
+// sdpTransforms, has to be given as its JSON.
+func formToJSON(values url.Values, t reflect.Type) ([]byte, error) {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = f.Type
+		}
+	}
+
+	obj := make(map[string]json.RawMessage, len(values))
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		typ, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown form field %q", key)
+		}
+		vs := values[key]
+		if typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String {
+			var list []string
+			for _, v := range vs {
+				list = append(list, strings.Split(v, ",")...)
+			}
+			obj[key], _ = json.Marshal(list)
+			continue
+		}
+		if len(vs) != 1 {
+			return nil, fmt.Errorf("form field %q is given %d times", key, len(vs))
+		}
+		v := vs[0]
+		switch {
+		case typ == reflect.TypeFor[Duration]() || typ.Kind() == reflect.String:
+			obj[key], _ = json.Marshal(v)
+		case typ.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(v)
+			if v == "on" {
+				b, err = true, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("form field %q must be true or false, got %q", key, v)
+			}
+			obj[key], _ = json.Marshal(b)
+		case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Float64:
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("form field %q must be a number, got %q", key, v)
+			}
+			obj[key] = json.RawMessage(v)
+		default:
+			if !json.Valid([]byte(v)) {
+				return nil, fmt.Errorf("form field %q must be JSON", key)
+			}
+			obj[key] = json.RawMessage(v)
+		}
+	}
+	return json.Marshal(obj)
+}
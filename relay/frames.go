@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// frameCounter counts a video track's frames per wall-clock second. A
+// frame is a packet with the RTP marker bit set, which the video payload
+// formats set on the last packet of each frame:
+//
+//   - VP8 (RFC 7741): the last packet of a frame.
+//   - H.264 (RFC 6184) and AV1: the last packet of an access unit or
+//     temporal unit, one per frame without layering.
+//   - VP9: the last packet of a picture; with spatial layers, of the
+//     superframe.
+//
+// VP8 and H.264 are offered today. A source that never sets the marker
+// reads as 0 fps. Relay loops sharing a track count into the same second,
+// so a frame can land in a neighbouring one; the rate is a health signal,
+// not a measurement.
+type frameCounter struct {
+	frames  atomic.Uint64
+	second  atomic.Int64 // unix second current counts, 0 before any packet
+	current atomic.Uint64
+	last    atomic.Uint64 // frames in the second before current's
+
+	// low is whether the rate was below minFrameRate when last checked.
+	low atomic.Bool
+}
+
+// count accounts one relayed packet. When the packet starts a new second
+// it reports the rate of the one that just ended, with ok set.
+func (f *frameCounter) count(marker bool, now time.Time) (fps uint64, ok bool) {
+	sec := now.Unix()
+	if cur := f.second.Load(); cur != sec && f.second.CompareAndSwap(cur, sec) {
+		prev := f.current.Swap(0)
+		if sec != cur+1 {
+			prev = 0 // the source went quiet for a whole second or more
+		}
+		f.last.Store(prev)
+		fps, ok = prev, cur != 0
+	}
+	if marker {
+		f.frames.Add(1)
+		f.current.Add(1)
+	}
+	return fps, ok
+}
+
+// rate is the frame rate over the last complete second.
+func (f *frameCounter) rate(now time.Time) uint64 {
+	switch now.Unix() - f.second.Load() {
+	case 0:
+		return f.last.Load()
+	case 1:
+		return f.current.Load()
+	}
+	return 0
+}
+
+// checkFrameRate compares a second's frame rate on mt with the
+// minFrameRate config, reporting when it falls below and when it recovers.
+func (s *session) checkFrameRate(mt *mediaTrack, fps uint64) {
+	minRate := uint64(cfg.Load().MinFrameRate)
+	if minRate == 0 {
+		return
+	}
+	low := fps < minRate
+	if mt.frames.low.Swap(low) == low {
+		return
+	}
+	if low {
+		s.event("warning", "%s frame rate dropped to %d fps, below minFrameRate %d", mt.kind, fps, minRate)
+	} else {
+		s.event("recovered", "%s frame rate back to %d fps", mt.kind, fps)
+	}
+}
@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// GenerateRequest starts synthetic RTP into a session's port, in place of
+// ffmpeg, to exercise the relay and WHIP negotiation end to end. It is
+// only served with -test-mode.
+type GenerateRequest struct {
+	SessionID string `json:"sessionId"`
+
+	// Codec is "vp8" or "opus", and must be the codec negotiated for its
+	// kind.
+	Codec string `json:"codec"`
+
+	// BitrateKbps defaults to 1000 for VP8 and 64 for Opus.
+	BitrateKbps int `json:"bitrateKbps,omitempty"`
+
+	// Duration defaults to 10s.
+	Duration Duration `json:"duration,omitempty"`
+}
+
+type GenerateResponse struct {
+	SessionID   string   `json:"sessionId"`
+	Port        int      `json:"port"`
+	Codec       string   `json:"codec"`
+	BitrateKbps int      `json:"bitrateKbps"`
+	Duration    Duration `json:"duration"`
+}
+
+// generator describes how to produce synthetic frames for one codec.
+type generator struct {
+	kind        webrtc.RTPCodecType
+	mimeType    string
+	interval    time.Duration
+	bitrateKbps int
+	payloader   func() rtp.Payloader
+	frame       func(i, size int) []byte
+}
+
+var generators = map[string]generator{
+	"vp8": {
+		kind:        webrtc.RTPCodecTypeVideo,
+		mimeType:    webrtc.MimeTypeVP8,
+		interval:    time.Second / 30,
+		bitrateKbps: 1000,
+		payloader:   func() rtp.Payloader { return &codecs.VP8Payloader{EnablePictureID: true} },
+		frame:       vp8Frame,
+	},
+	"opus": {
+		kind:        webrtc.RTPCodecTypeAudio,
+		mimeType:    webrtc.MimeTypeOpus,
+		interval:    20 * time.Millisecond,
+		bitrateKbps: 64,
+		payloader:   func() rtp.Payloader { return &codecs.OpusPayloader{} },
+		frame:       opusFrame,
+	},
+}
+
+// vp8Frame returns a size-byte frame with a valid VP8 frame header, a 2s
+// keyframe interval and random data after the header. Decoders will show
+// garbage, but the packetization and keyframe flags are real.
+func vp8Frame(i, size int) []byte {
+	b := randomBytes(max(size, 10))
+	key := i%60 == 0
+	// Frame tag: keyframe bit clear for keyframes, version 0, shown, and
+	// the first partition size, which is never checked by the relay.
+	b[0] = 0x10
+	if !key {
+		b[0] |= 0x01
+	}
+	b[1], b[2] = 0, 0
+	if key {
+		// Start code, then 320x240 with no scaling.
+		copy(b[3:], []byte{0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00})
+	}
+	return b
+}
+
+// opusFrame returns a size-byte Opus packet: a TOC byte for one 20ms
+// fullband CELT frame, followed by random data.
+func opusFrame(_, size int) []byte {
+	b := randomBytes(max(size, 3))
+	b[0] = 0xfc
+	return b
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+	return b
+}
+
+// generate sends g's frames, packetized for payloadType and clockRate, to
+// the relay's RTP port until d elapses (if non-zero), ctx is done or done
+// is closed.
+func generate(ctx context.Context, done <-chan struct{}, port int, g generator, payloadType uint8, clockRate uint32, bitrateKbps int, d time.Duration) error {
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	packetizer := rtp.NewPacketizer(1200, payloadType, rand.Uint32(), g.payloader(), rtp.NewRandomSequencer(), clockRate)
+	size := bitrateKbps * 1000 / 8 * int(g.interval) / int(time.Second)
+	samples := uint32(g.interval.Seconds() * float64(clockRate))
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		for _, pkt := range packetizer.Packetize(g.frame(i, size), samples) {
+			b, err := pkt.Marshal()
+			if err != nil {
+				return err
+			}
+			if _, err := conn.Write(b); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// startGenerator validates codec against the track s negotiated for its
+// kind and starts generating into that track's port in the background,
+// until ctx is done or s ends.
+func (s *session) startGenerator(ctx context.Context, codec string, bitrateKbps int, d time.Duration) (int, error) {
+	g, ok := generators[strings.ToLower(codec)]
+	if !ok {
+		return 0, fmt.Errorf("codec must be vp8 or opus, got %q", codec)
+	}
+	mt := s.mediaTrack(g.kind)
+	if mt == nil {
+		return 0, fmt.Errorf("session has no %s track", g.kind)
+	}
+	i := mt.local.find(g.mimeType)
+	if i < 0 {
+		return 0, fmt.Errorf("session's %s track is %s, not %s", g.kind, mt.local.Codec().MimeType, g.mimeType)
+	}
+	pt := uint8(mt.local.codecs[i].params.PayloadType)
+	if bitrateKbps == 0 {
+		bitrateKbps = g.bitrateKbps
+	}
+
+	go func() {
+		s.logf("generating %s at %d kbps into port %d", g.mimeType, bitrateKbps, mt.port)
+		if err := generate(ctx, s.done, mt.port, g, pt, mt.clockRate, bitrateKbps, d); err != nil {
+			s.logf("%s generator stopped: %v", g.mimeType, err)
+			return
+		}
+		s.logf("%s generator done", g.mimeType)
+	}()
+	return mt.port, nil
+}
+
+// generateAll generates into every track of s with its negotiated codec,
+// for -test-mode with -ingest.
+func (s *session) generateAll(ctx context.Context) error {
+	for _, mt := range s.media() {
+		_, name, _ := strings.Cut(strings.ToLower(mt.local.Codec().MimeType), "/")
+		if _, err := s.startGenerator(ctx, name, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateHandler(w http.ResponseWriter, r *http.Request) {
+	var req GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errBadRequest)
+		return
+	}
+	s := lookupSession(req.SessionID)
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	err := generateBitrateLimit.apply(&req.BitrateKbps)
+	if err == nil {
+		err = generateDurationLimit.apply(&req.Duration)
+	}
+	if err != nil {
+		writeError(w, newRelayError(CodeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	req.Codec = strings.ToLower(req.Codec)
+	if req.BitrateKbps == 0 {
+		req.BitrateKbps = generators[req.Codec].bitrateKbps
+	}
+
+	port, err := s.startGenerator(context.Background(), req.Codec, req.BitrateKbps, time.Duration(req.Duration))
+	if err != nil {
+		writeError(w, newRelayError(CodeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, GenerateResponse{
+		SessionID:   s.id,
+		Port:        port,
+		Codec:       req.Codec,
+		BitrateKbps: req.BitrateKbps,
+		Duration:    req.Duration,
+	})
+}
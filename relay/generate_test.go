@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestGenerateStopsOnDone checks that a generator without a deadline, as
+// /test/generate starts them, stops once its session is done.
+func TestGenerateStopsOnDone(t *testing.T) {
+	// Something has to keep listening on the port, or writes would fail
+	// and stop the generator anyway.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	done := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- generate(context.Background(), done, port, generators["vp8"], 102, 90000, 100, 0)
+	}()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("generator sent nothing: %v", err)
+	}
+
+	close(done)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("generator stopped with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("generator still running after done was closed")
+	}
+}
@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEFilter limits the local interfaces and addresses pion gathers ICE
+// candidates on, for multi-homed hosts whose VPN or link-local addresses
+// slow down or misroute connectivity checks. Interface entries are names
+// or path.Match patterns such as "tun*"; network entries are CIDRs or
+// single addresses. Empty Interfaces or Networks allow everything not
+// excluded.
+type ICEFilter struct {
+	Interfaces        []string `json:"interfaces"`
+	ExcludeInterfaces []string `json:"excludeInterfaces"`
+	Networks          []string `json:"networks"`
+	ExcludeNetworks   []string `json:"excludeNetworks"`
+
+	// Family, "ipv4" or "ipv6", gathers candidates of that address family
+	// only, e.g. to keep ICE off a broken IPv6 path in a dual-stack
+	// network. Empty gathers both.
+	Family string `json:"family"`
+}
+
+// ipFilter is ICEFilter's networks, parsed.
+type ipFilter struct {
+	allow, exclude []netip.Prefix
+
+	// only4 and only6 are set by the family.
+	only4, only6 bool
+}
+
+func (f ICEFilter) isZero() bool {
+	return len(f.Interfaces)+len(f.ExcludeInterfaces)+len(f.Networks)+len(f.ExcludeNetworks) == 0 && f.Family == ""
+}
+
+// families returns the address families candidates are gathered for.
+func (f ICEFilter) families() string {
+	if f.Family == "" {
+		return "ipv4, ipv6"
+	}
+	return f.Family
+}
+
+// validate checks the patterns and parses the networks.
+func (f ICEFilter) validate() (ipFilter, error) {
+	for _, p := range slices.Concat(f.Interfaces, f.ExcludeInterfaces) {
+		if _, err := path.Match(p, ""); err != nil {
+			return ipFilter{}, fmt.Errorf("invalid iceFilter interface pattern %q", p)
+		}
+	}
+	var ips ipFilter
+	switch f.Family {
+	case "":
+	case "ipv4":
+		ips.only4 = true
+	case "ipv6":
+		ips.only6 = true
+	default:
+		return ipFilter{}, fmt.Errorf("iceFilter family must be ipv4 or ipv6, got %q", f.Family)
+	}
+	var err error
+	if ips.allow, err = parseNetworks("iceFilter", f.Networks); err != nil {
+		return ipFilter{}, err
+	}
+	if ips.exclude, err = parseNetworks("iceFilter", f.ExcludeNetworks); err != nil {
+		return ipFilter{}, err
+	}
+	return ips, nil
+}
+
+// parseNetworks parses entries, each a CIDR prefix or a single address,
+// for the setting named field.
+func parseNetworks(field string, entries []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, e := range entries {
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(e)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid %s network %q", field, e)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// allowsInterface reports whether candidates may be gathered on name.
+func (f ICEFilter) allowsInterface(name string) bool {
+	match := func(patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(p string) bool {
+			ok, _ := path.Match(p, name)
+			return ok
+		})
+	}
+	return !match(f.ExcludeInterfaces) && (len(f.Interfaces) == 0 || match(f.Interfaces))
+}
+
+// allows reports whether candidates may be gathered on ip.
+func (f ipFilter) allows(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if (f.only4 && !addr.Is4()) || (f.only6 && !addr.Is6()) {
+		return false
+	}
+	contains := func(prefixes []netip.Prefix) bool {
+		return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+	}
+	return !contains(f.exclude) && (len(f.allow) == 0 || contains(f.allow))
+}
+
+// apply installs f in se. It was validated with the config.
+func (f ICEFilter) apply(se *webrtc.SettingEngine) {
+	if f.isZero() {
+		return
+	}
+	ips, _ := f.validate()
+	se.SetInterfaceFilter(f.allowsInterface)
+	se.SetIPFilter(ips.allows)
+	switch {
+	case ips.only4:
+		se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	case ips.only6:
+		se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP6})
+	}
+}
+
+// logICEFilter logs the address families and which of the host's
+// interfaces and addresses f lets pion gather candidates on.
+func logICEFilter(f ICEFilter) {
+	log.Printf("ICE address families: %s", f.families())
+	if f.isZero() {
+		return
+	}
+	ips, _ := f.validate()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("iceFilter: failed to list interfaces: %v", err)
+		return
+	}
+	var used, filtered []string
+	for _, iface := range ifaces {
+		// pion skips these regardless of the filter.
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if !f.allowsInterface(iface.Name) {
+			filtered = append(filtered, iface.Name)
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			entry := iface.Name + " " + ipNet.IP.String()
+			if ips.allows(ipNet.IP) {
+				used = append(used, entry)
+			} else {
+				filtered = append(filtered, entry)
+			}
+		}
+	}
+	log.Printf("ICE candidates from: %s; filtered out: %s", listOrNone(used), listOrNone(filtered))
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
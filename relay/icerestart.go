@@ -0,0 +1,283 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// iceRestartTimeout is how long restartICE waits for ICE to connect again
+// before reporting the state it is in.
+const iceRestartTimeout = 10 * time.Second
+
+// iceRestartSettle is how long waitICE gives a restart to show.
+const iceRestartSettle = time.Second
+
+// RestartICEResponse is the result of POST /session/{id}/restart-ice.
+// Method is "patch" when the WHIP resource was restarted in place, and
+// "post" when a new one had to be negotiated. SelectedPair is only set once
+// ICE has connected.
+type RestartICEResponse struct {
+	ID           string         `json:"id"`
+	Method       string         `json:"method"`
+	ICEState     string         `json:"iceState"`
+	SelectedPair *CandidatePair `json:"selectedPair,omitempty"`
+}
+
+// CandidatePair is an ICE candidate pair, each side as "udp 192.0.2.1:5000
+// host".
+type CandidatePair struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// errPatchUnsupported is a WHIP resource that can't be restarted in place.
+var errPatchUnsupported = errors.New("whip server doesn't support ICE restarts by PATCH")
+
+// restartICE restarts ICE on the current upstream, e.g. after the network
+// path has changed. It sends the new ICE credentials to the WHIP resource
+// in a PATCH (RFC 9725), bounded by ctx and the negotiation timeout. pion
+// restarts its ICE agent as soon as the offer is created, so when the
+// server can't take the PATCH, the resource is gone or the server can't be
+// reached, a new resource is POSTed instead, as in migrate; any other
+// failure, such as a rejected token, is returned as is. Either way the
+// tracks keep being written to, so RTP from ffmpeg is relayed throughout.
+func (s *session) restartICE(ctx context.Context) (*RestartICEResponse, error) {
+	s.switching.Lock()
+	defer s.switching.Unlock()
+	s.mu.Lock()
+	up := s.up
+	s.mu.Unlock()
+
+	resp := &RestartICEResponse{ID: s.id, Method: "patch"}
+	pctx, cancel := context.WithTimeout(ctx, s.negotiationTimeout)
+	err := up.restartICE(pctx, s.bearerToken())
+	cancel()
+	if repostable(err) {
+		s.event("ice", "%s: restart by PATCH failed: %v, negotiating a new resource", redactURL(up.ingestURL), err)
+		resp.Method = "post"
+		err = s.swapUpstream(ctx, up.ingestURL)
+	}
+	if err != nil {
+		s.event("ice", "restart failed: %v", err)
+		return nil, err
+	}
+	if resp.Method == "patch" {
+		s.event("ice", "%s: restarted", redactURL(up.ingestURL))
+	}
+
+	s.mu.Lock()
+	pc := s.up.pc
+	s.mu.Unlock()
+	state := waitICE(pc, iceRestartTimeout)
+	resp.ICEState = state.String()
+	resp.SelectedPair = selectedPair(pc)
+	return resp, nil
+}
+
+// repostable reports whether a failed ICE restart by PATCH is worth a new
+// POST: the server can't restart in place, the resource is gone, or the
+// server couldn't be reached. A POST would fail the other ways too.
+func repostable(err error) bool {
+	var we *whipError
+	var re *RelayError
+	switch {
+	case errors.Is(err, errPatchUnsupported):
+		return true
+	case errors.As(err, &we):
+		return we.Status == http.StatusNotFound
+	case errors.As(err, &re):
+		return re.Code == CodeWHIPUnreachable
+	}
+	return false
+}
+
+// restartICE creates an offer with new ICE credentials and exchanges them
+// with the WHIP server as trickle-ice-sdpfrags, applying the server's new
+// credentials and candidates to the answer it gave before. ctx bounds the
+// PATCH.
+func (up *upstream) restartICE(ctx context.Context, token string) error {
+	if up.resourceURL == "" {
+		return errPatchUnsupported
+	}
+	offer, err := up.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return fmt.Errorf("failed to create ice restart offer: %w", err)
+	}
+	if err := up.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local desc: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "PATCH", up.resourceURL, strings.NewReader(iceFragment(offer.SDP)))
+	if err != nil {
+		return fmt.Errorf("failed to build whip patch: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/trickle-ice-sdpfrag")
+	httpReq.Header.Set("If-Match", "*")
+	setBearer(httpReq, token)
+
+	resp, err := whipDo(httpReq)
+	if err != nil {
+		return newRelayError(CodeWHIPUnreachable, http.StatusBadGateway, fmt.Errorf("whip patch failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed, resp.StatusCode == http.StatusNotImplemented,
+		resp.StatusCode == http.StatusUnsupportedMediaType:
+		return fmt.Errorf("%w (%d)", errPatchUnsupported, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return newWHIPError(resp).relayError()
+	}
+
+	frag, err := readBody(resp.Body, cfg.Load().MaxAnswerBytes)
+	if err != nil {
+		return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, fmt.Errorf("failed to read whip patch answer: %w", err))
+	}
+	answer, err := restartedAnswer(up.pc.CurrentRemoteDescription().SDP, string(frag))
+	if err != nil {
+		return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, err)
+	}
+	if err := up.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway,
+			fmt.Errorf("failed to set remote desc: %w", newAnswerError(err, answer)))
+	}
+	return nil
+}
+
+// iceFragment is the trickle-ice-sdpfrag (RFC 8840) of offer carrying its
+// ICE credentials, and the m-lines and mids they apply to.
+func iceFragment(offer string) string {
+	var b strings.Builder
+	var ufrag, pwd string
+	var media []string
+	for line := range strings.Lines(offer) {
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:") && ufrag == "":
+			ufrag = line
+		case strings.HasPrefix(line, "a=ice-pwd:") && pwd == "":
+			pwd = line
+		case strings.HasPrefix(line, "m="), strings.HasPrefix(line, "a=mid:"):
+			media = append(media, line)
+		}
+	}
+	for _, line := range append([]string{ufrag, pwd}, media...) {
+		b.WriteString(line + "\r\n")
+	}
+	return b.String()
+}
+
+// restartedAnswer replaces the ICE credentials and candidates of answer
+// with those of the sdpfrag the WHIP server answered an ICE restart with.
+// The candidates all go into the first m-section, the one the bundle
+// transport uses.
+func restartedAnswer(answer, frag string) (string, error) {
+	var ufrag, pwd string
+	var candidates []string
+	for line := range strings.Lines(frag) {
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:") && ufrag == "":
+			ufrag = line
+		case strings.HasPrefix(line, "a=ice-pwd:") && pwd == "":
+			pwd = line
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, line)
+		}
+	}
+	if ufrag == "" || pwd == "" {
+		return "", errors.New("whip patch answer has no ice-ufrag/ice-pwd")
+	}
+
+	var b strings.Builder
+	sections := 0
+	for line := range strings.Lines(answer) {
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if sections == 1 {
+				writeCandidates(&b, candidates)
+			}
+			sections++
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		if line != "" {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	if sections == 1 {
+		writeCandidates(&b, candidates)
+	}
+	return b.String(), nil
+}
+
+func writeCandidates(b *strings.Builder, candidates []string) {
+	for _, c := range candidates {
+		b.WriteString(c + "\r\n")
+	}
+	b.WriteString("a=end-of-candidates\r\n")
+}
+
+// waitICE waits up to timeout for pc's ICE connection to connect or fail
+// after a restart, and returns the state it is in then. pion only leaves
+// the connected state once the restarted agent starts checking, so a
+// connection that hasn't after iceRestartSettle is taken as restarted.
+func waitICE(pc *webrtc.PeerConnection, timeout time.Duration) webrtc.ICEConnectionState {
+	start := time.Now()
+	restarted := false
+	for {
+		state := pc.ICEConnectionState()
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			if restarted || time.Since(start) >= iceRestartSettle {
+				return state
+			}
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			return state
+		default:
+			restarted = true
+		}
+		if time.Since(start) >= timeout {
+			return state
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// selectedPair returns the candidate pair pc's ICE transport is using, or
+// nil if there is none yet.
+func selectedPair(pc *webrtc.PeerConnection) *CandidatePair {
+	for _, t := range pc.GetTransceivers() {
+		sender := t.Sender()
+		if sender == nil || sender.Transport() == nil {
+			continue
+		}
+		pair, err := sender.Transport().ICETransport().GetSelectedCandidatePair()
+		if err != nil || pair == nil {
+			return nil
+		}
+		return &CandidatePair{Local: candidateString(pair.Local), Remote: candidateString(pair.Remote)}
+	}
+	return nil
+}
+
+func candidateString(c *webrtc.ICECandidate) string {
+	return fmt.Sprintf("%s %s %s", c.Protocol, candidateAddr(c.Address, c.Port), c.Typ)
+}
+
+func candidateAddr(address string, port uint16) string {
+	return net.JoinHostPort(address, strconv.Itoa(int(port)))
+}
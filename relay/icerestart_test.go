@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// patchServer starts a session on a WHIP server that answers an ICE
+// restart by PATCH with patch, and returns both.
+func patchServer(t *testing.T, patch http.HandlerFunc) (*session, *whipServer) {
+	t.Helper()
+	ws := newWHIPServer(t, fixture(t, "janus-answer.sdp"))
+	post := ws.Config.Handler
+	ws.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			patch(w, r)
+			return
+		}
+		post.ServeHTTP(w, r)
+	})
+	ports := freePorts(t, 2)
+	s, err := start(context.Background(), StartRequest{IngestURL: ws.URL, VideoPort: ports[0], AudioPort: ports[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.end(TeardownStopped, "") })
+	return s, ws
+}
+
+// TestRepostable checks which failed PATCHes an ICE restart falls back to
+// a new POST for.
+func TestRepostable(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	tests := []struct {
+		name   string
+		status int
+		want   bool
+	}{
+		{"not allowed", http.StatusMethodNotAllowed, true},
+		{"resource gone", http.StatusNotFound, true},
+		{"unauthorized", http.StatusUnauthorized, false},
+		{"forbidden", http.StatusForbidden, false},
+		{"conflict", http.StatusConflict, false},
+		{"server error", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := patchServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+			err := s.up.restartICE(context.Background(), "")
+			if err == nil {
+				t.Fatal("PATCH succeeded")
+			}
+			if got := repostable(err); got != tt.want {
+				t.Errorf("repostable(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRestartICEStalled checks that a PATCH the WHIP server never answers
+// gives up with ctx, and is taken as the server being unreachable.
+func TestRestartICEStalled(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	unstall := make(chan struct{})
+	defer close(unstall)
+	s, _ := patchServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unstall:
+		case <-r.Context().Done():
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.up.restartICE(ctx, "")
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stalled PATCH took %s", d)
+	}
+	if !repostable(err) {
+		t.Errorf("stalled PATCH failed with %v, want a transport error", err)
+	}
+}
+
+// TestRestartICEAuthFailed checks that a restart whose PATCH is refused
+// for its token reports that, instead of POSTing a new resource.
+func TestRestartICEAuthFailed(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	s, ws := patchServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+	})
+
+	_, err := s.restartICE(context.Background())
+	var re *RelayError
+	if !errors.As(err, &re) || re.Code != CodeWHIPAuthFailed {
+		t.Errorf("restart failed with %v, want %s", err, CodeWHIPAuthFailed)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.offers) != 1 {
+		t.Errorf("WHIP server got %d POSTs, want 1", len(ws.offers))
+	}
+}
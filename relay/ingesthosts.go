@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// hostList is the allowedIngestHosts config. An entry matches that host
+// exactly; an entry starting with "." also matches its subdomains, e.g.
+// ".example.com" matches "live.example.com" and "example.com".
+type hostList []string
+
+// allows reports whether host is permitted. An empty list permits any host.
+func (l hostList) allows(host string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, entry := range l {
+		if suffix, ok := strings.CutPrefix(entry, "."); ok {
+			if strings.EqualFold(host, suffix) || hasSuffixFold(host, entry) {
+				return true
+			}
+		} else if strings.EqualFold(host, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// explicit reports whether host is listed by name, which is what lets an
+// internal host through.
+func (l hostList) explicit(host string) bool {
+	for _, entry := range l {
+		if strings.EqualFold(host, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// internalAddr reports whether addr is loopback, link-local (which covers
+// the 169.254.169.254 cloud metadata service), unspecified, or the IPv6
+// metadata address some clouds use.
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsUnspecified() || addr == netip.MustParseAddr("fd00:ec2::254")
+}
+
+// internalHost reports whether host is a literal internal address or a
+// localhost name, without resolving it.
+func internalHost(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return internalAddr(addr)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// checkIngestURL keeps semi-trusted callers from pointing the relay at
+// internal services: the host must pass allowedIngestHosts, and internal
+// hosts are refused unless listed there by name. Names that resolve to
+// internal addresses are caught later, when the WHIP client dials.
+func (c *Config) checkIngestURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("ingestUrl must be an http or https URL, got %q", raw))
+	}
+	host := u.Hostname()
+	hosts := hostList(c.AllowedIngestHosts)
+	if !hosts.allows(host) {
+		return newRelayError(CodeIngestForbidden, http.StatusForbidden, fmt.Errorf("ingest host %q is not in allowedIngestHosts", host))
+	}
+	if internalHost(host) && !hosts.explicit(host) {
+		return newRelayError(CodeIngestForbidden, http.StatusForbidden, fmt.Errorf("ingest host %q is internal; list it in allowedIngestHosts to allow it", host))
+	}
+	return nil
+}
+
+// guardDial wraps dialer so it refuses to connect to internal addresses
+// unless the host being dialed is listed by name in hosts. This also
+// covers redirects and WHIP resource URLs on other hosts.
+func guardDial(dialer *net.Dialer, hosts hostList) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.Control = func(_, address string, _ syscall.RawConn) error {
+		if ap, err := netip.ParseAddrPort(address); err == nil && internalAddr(ap.Addr()) {
+			return errors.New("refusing to dial internal address " + address)
+		}
+		return nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && hosts.explicit(host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+}
+
+// guardProxy wraps proxy so that requests sent through a proxy get the
+// check guardDial makes on direct connections. The proxy resolves and
+// dials the target itself, so guardDial only ever sees the proxy's
+// address; instead the target is resolved here and refused if any of its
+// addresses is internal, unless it is listed by name in hosts.
+func guardProxy(proxy func(*http.Request) (*url.URL, error), hosts hostList) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		u, err := proxy(r)
+		if u == nil || err != nil {
+			return u, err
+		}
+		host := r.URL.Hostname()
+		if hosts.explicit(host) {
+			return u, nil
+		}
+		if internalHost(host) {
+			return nil, fmt.Errorf("refusing to proxy to internal host %s", host)
+		}
+		addrs, err := net.DefaultResolver.LookupNetIP(r.Context(), "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("refusing to proxy to %s: %w", host, err)
+		}
+		for _, addr := range addrs {
+			if internalAddr(addr) {
+				return nil, fmt.Errorf("refusing to proxy to %s, which resolves to internal address %s", host, addr)
+			}
+		}
+		return u, nil
+	}
+}
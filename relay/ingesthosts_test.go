@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// TestGuardProxy checks that requests for internal hosts aren't handed to
+// a proxy, which would dial them on the relay's behalf.
+func TestGuardProxy(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.example:3128")
+	viaProxy := func(*http.Request) (*url.URL, error) { return proxyURL, nil }
+	direct := func(*http.Request) (*url.URL, error) { return nil, nil }
+
+	tests := []struct {
+		name      string
+		proxy     func(*http.Request) (*url.URL, error)
+		target    string
+		hosts     hostList
+		wantProxy bool
+	}{
+		{"public address", viaProxy, "http://203.0.113.7/whip", nil, true},
+		{"loopback", viaProxy, "http://127.0.0.1:8080/whip", nil, false},
+		{"metadata service", viaProxy, "http://169.254.169.254/latest", nil, false},
+		{"ipv6 loopback", viaProxy, "http://[::1]/whip", nil, false},
+		{"localhost", viaProxy, "http://localhost/whip", nil, false},
+		{"listed loopback", viaProxy, "http://127.0.0.1:8080/whip", hostList{"127.0.0.1"}, true},
+		{"localhost fqdn", viaProxy, "http://localhost./whip", nil, false},
+		{"not proxied", direct, "http://127.0.0.1/whip", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := guardProxy(tt.proxy, tt.hosts)(r)
+			if (u != nil) != tt.wantProxy {
+				t.Errorf("got proxy %v (%v), want proxied = %v", u, err, tt.wantProxy)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// isKeyframe reports whether payload, an RTP payload of c, starts a
+// keyframe. Other codecs than VP8 and H.264 never do.
+func isKeyframe(c codec, payload []byte) bool {
+	switch {
+	case c.is("vp8"):
+		return isVP8Keyframe(payload)
+	case c.is("h264"):
+		return isH264Keyframe(payload)
+	}
+	return false
+}
+
+// isVP8Keyframe parses the payload descriptor (RFC 7741 section 4.2) of
+// the first packet of a partition 0 and checks the inverse key frame flag
+// of the VP8 frame tag after it.
+func isVP8Keyframe(p []byte) bool {
+	if len(p) < 1 || p[0]&0x10 == 0 || p[0]&0x07 != 0 {
+		return false // not the start of partition 0
+	}
+	i := 1
+	if p[0]&0x80 != 0 {
+		if len(p) < 2 {
+			return false
+		}
+		ext := p[1]
+		i++
+		if ext&0x80 != 0 { // I: picture ID, with M for its 15-bit form
+			if len(p) <= i {
+				return false
+			}
+			if p[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // L: TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // T or K: TID/Y/KEYIDX
+			i++
+		}
+	}
+	return len(p) > i && p[i]&0x01 == 0
+}
+
+// isH264Keyframe reports an IDR slice or SPS (RFC 6184), as a single NAL
+// unit, in a STAP-A, or at the start of an FU-A.
+func isH264Keyframe(p []byte) bool {
+	if len(p) < 1 {
+		return false
+	}
+	switch nal := p[0] & 0x1f; nal {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(p); {
+			size := int(p[i])<<8 | int(p[i+1])
+			if t := p[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28: // FU-A
+		return len(p) > 1 && p[1]&0x80 != 0 && p[1]&0x1f == 5
+	}
+	return false
+}
+
+// noteKeyframe closes mt.keyframe on the first keyframe written while
+// awaitKeyframe is set.
+func (mt *mediaTrack) noteKeyframe(pt uint8, payload []byte) {
+	if !mt.awaitKeyframe.Load() {
+		return
+	}
+	c, ok := mt.local.codecFor(pt)
+	if ok && isKeyframe(c, payload) && mt.awaitKeyframe.CompareAndSwap(true, false) {
+		close(mt.keyframe)
+	}
+}
+
+// waitKeyframe waits up to timeout for the video track to relay a
+// keyframe, so that a /start with waitKeyframe only succeeds once video is
+// actually flowing. It gives up early, with ctx's error, if ctx is done.
+func (s *session) waitKeyframe(ctx context.Context, timeout time.Duration) error {
+	mt := s.video
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-mt.keyframe:
+		s.event("keyframe", "first keyframe relayed after %s", time.Since(s.startedAt).Round(time.Millisecond))
+		return nil
+	case <-s.done:
+		return errors.New("session ended while waiting for a keyframe")
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	mt.awaitKeyframe.Store(false)
+	err := fmt.Errorf("no video keyframe relayed within %s, but %d video packets were: is the source producing keyframes?",
+		timeout, mt.stats.packets.Load())
+	if mt.stats.packets.Load() == 0 {
+		err = fmt.Errorf("no video RTP received within %s: is the source producing video?", timeout)
+	}
+	return newRelayError(CodeNoVideo, http.StatusGatewayTimeout, err)
+}
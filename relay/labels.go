@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Limits on a StartRequest's labels, which are kept with the session and
+// copied into every log line and webhook about it.
+const (
+	maxLabels          = 16
+	maxLabelValueBytes = 128
+)
+
+// labelNamePattern is what label names have to look like. They are valid
+// Prometheus label names, so any of them can be named in metricLabels.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,62}$`)
+
+// reservedMetricLabels are the labels /metrics sets itself.
+var reservedMetricLabels = []string{"session", "kind", "le"}
+
+// validateLabels checks a StartRequest's labels.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed, got %d", maxLabels, len(labels))
+	}
+	for name, value := range labels {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("label name %q must be letters, digits and underscores, not starting with a digit, and at most 63 long", name)
+		}
+		if len(value) > maxLabelValueBytes {
+			return fmt.Errorf("label %s is longer than %d bytes", name, maxLabelValueBytes)
+		}
+		if strings.ContainsFunc(value, unicode.IsControl) {
+			return fmt.Errorf("label %s has control characters", name)
+		}
+	}
+	return nil
+}
+
+// validateMetricLabels checks the metricLabels config.
+func validateMetricLabels(names []string) error {
+	if len(names) > maxLabels {
+		return fmt.Errorf("metricLabels can name at most %d labels, got %d", maxLabels, len(names))
+	}
+	for _, name := range names {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("metricLabels: %q is not a valid label name", name)
+		}
+		if slices.Contains(reservedMetricLabels, name) {
+			return fmt.Errorf("metricLabels: %q is set by /metrics itself", name)
+		}
+	}
+	return nil
+}
+
+// formatLabels renders labels for log lines, sorted by name, e.g.
+// " [game=chess region=us-east]", or "" without labels.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i, name := range slices.Sorted(maps.Keys(labels)) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%s", name, labels[name])
+	}
+	return " [" + b.String() + "]"
+}
+
+// promLabels returns s's Prometheus labels: its ID and the labels named in
+// the metricLabels config, empty where s doesn't have them so that every
+// session's series have the same label names.
+func (s *session) promLabels() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "session=%q", s.id)
+	for _, name := range cfg.Load().MetricLabels {
+		fmt.Fprintf(&b, ",%s=%q", name, s.labels[name])
+	}
+	return b.String()
+}
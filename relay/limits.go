@@ -0,0 +1,182 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// intLimit is the accepted range of an integer setting. Zero selects def.
+// Values below min are rejected. Values above max are rejected too, unless
+// clamp is set: then they are valid but unreasonable, and are lowered to
+// max with a warning.
+type intLimit struct {
+	name     string
+	def      int
+	min, max int
+	clamp    bool
+}
+
+func (l intLimit) apply(v *int) error {
+	switch {
+	case *v == 0:
+		*v = l.def
+	case *v < l.min:
+		return fmt.Errorf("%s must be at least %d, got %d", l.name, l.min, *v)
+	case *v > l.max && l.clamp:
+		log.Printf("%s %d is above the maximum, using %d", l.name, *v, l.max)
+		*v = l.max
+	case *v > l.max:
+		return fmt.Errorf("%s must be at most %d, got %d", l.name, l.max, *v)
+	}
+	return nil
+}
+
+// durationLimit is intLimit for durations. A zero max means no upper bound.
+type durationLimit struct {
+	name     string
+	def      time.Duration
+	min, max time.Duration
+	clamp    bool
+}
+
+func (l durationLimit) apply(v *Duration) error {
+	d := time.Duration(*v)
+	switch {
+	case d == 0:
+		*v = Duration(l.def)
+	case d < l.min:
+		return fmt.Errorf("%s must be at least %s, got %s", l.name, l.min, d)
+	case l.max == 0 || d <= l.max:
+	case l.clamp:
+		log.Printf("%s %s is above the maximum, using %s", l.name, d, l.max)
+		*v = Duration(l.max)
+	default:
+		return fmt.Errorf("%s must be at most %s, got %s", l.name, l.max, d)
+	}
+	return nil
+}
+
+// Server config limits. Sizes, counts and timeouts are clamped, since a
+// large value there is only wasteful; enumerated values are not.
+var (
+	maxSessionsLimit      = intLimit{"maxSessions", 1, 1, 1024, true}
+	maxAnswerBytesLimit   = intLimit{"maxAnswerBytes", defaultMaxAnswerBytes, 4 << 10, 16 << 20, true}
+	deleteAttemptsLimit   = intLimit{"deleteAttempts", defaultDeleteAttempts, 1, 10, true}
+	rtpReadRetriesLimit   = intLimit{"rtpReadRetries", defaultRTPReadRetries, 1, 10, true}
+	dscpLimit             = intLimit{"dscp", 0, 0, 63, false}
+	breakerThresholdLimit = intLimit{"breakerThreshold", defaultBreakerThreshold, 1, 1000, true}
+	sessionBytesLimit     = intLimit{"maxSessionBytes", 0, 1, math.MaxInt, false}
+	sessionRateLimit      = intLimit{"maxPacketsPerSecond", 0, 1, 1 << 20, false}
+	minFrameRateLimit     = intLimit{"minFrameRate", 0, 1, 240, false}
+
+	deleteBackoffLimit       = durationLimit{"deleteBackoff", defaultDeleteBackoff, 10 * time.Millisecond, 30 * time.Second, true}
+	rtpReadBackoffLimit      = durationLimit{"rtpReadBackoff", defaultRTPReadBackoff, time.Millisecond, time.Second, true}
+	breakerCooldownLimit     = durationLimit{"breakerCooldown", defaultBreakerCooldown, time.Second, time.Hour, true}
+	teardownTimeoutLimit     = durationLimit{"teardownTimeout", defaultTeardownTimeout, 100 * time.Millisecond, 5 * time.Minute, true}
+	stunPrecheckTimeoutLimit = durationLimit{"stunPrecheckTimeout", defaultSTUNPrecheckTimeout, 100 * time.Millisecond, time.Minute, true}
+	negotiationTimeoutLimit  = durationLimit{"negotiationTimeout", defaultNegotiationTimeout, time.Second, 5 * time.Minute, true}
+	idleTimeoutLimit         = durationLimit{"idleTimeout", 0, time.Second, 0, false}
+	sessionDurationLimit     = durationLimit{"maxSessionDuration", 0, time.Second, 0, false}
+	iceDisconnectGraceLimit  = durationLimit{"iceDisconnectGrace", 0, 100 * time.Millisecond, 5 * time.Minute, true}
+	dialTimeoutLimit         = durationLimit{"whipClient.dialTimeout", defaultDialTimeout, 100 * time.Millisecond, 5 * time.Minute, true}
+	tlsHandshakeTimeoutLimit = durationLimit{"whipClient.tlsHandshakeTimeout", defaultTLSHandshakeTimeout, 100 * time.Millisecond, 5 * time.Minute, true}
+	idleConnTimeoutLimit     = durationLimit{"whipClient.idleConnTimeout", defaultIdleConnTimeout, time.Second, time.Hour, true}
+	keepAliveLimit           = durationLimit{"whipClient.keepAlive", defaultKeepAlive, time.Second, time.Hour, true}
+	writeLatencyWarningLimit = durationLimit{"writeLatencyWarning", 0, 100 * time.Microsecond, 10 * time.Second, true}
+	senderReportLimit        = durationLimit{"senderReportInterval", defaultSenderReportInterval, 100 * time.Millisecond, time.Minute, true}
+	iceDisconnectedLimit     = durationLimit{"iceDisconnectedTimeout", defaultICEDisconnected, time.Second, time.Minute, true}
+	iceFailedLimit           = durationLimit{"iceFailedTimeout", defaultICEFailed, time.Second, 5 * time.Minute, true}
+	iceKeepaliveLimit        = durationLimit{"iceKeepaliveInterval", defaultICEKeepalive, 100 * time.Millisecond, 30 * time.Second, true}
+)
+
+// StartRequest limits. Requests are rejected rather than clamped, so the
+// caller learns about the mistake.
+var (
+	portLimit         = intLimit{"port", 0, 1, 65535, false}
+	portRetryLimit    = intLimit{"portRetryCount", 0, 1, 100, false}
+	readersLimit      = intLimit{"readers", 1, 1, maxReaders, false}
+	maxMalformedLimit = intLimit{"maxMalformedPackets", 0, 1, 1 << 20, false}
+	writeQueueLimit   = intLimit{"writeQueue", 0, 1, 1 << 14, false}
+	paceBitrateLimit  = intLimit{"paceVideoBitrate", 0, 100_000, 100_000_000, false}
+	maxBitrateLimit   = intLimit{"maxBitrateKbps", 0, 100, 100_000, false}
+	minVideoKbpsLimit = intLimit{"minVideoKbps", 0, 1, 100_000, false}
+	minAudioKbpsLimit = intLimit{"minAudioKbps", 0, 1, 10_000, false}
+	quotaBytesLimit   = intLimit{"maxBytes", 0, 1, math.MaxInt, false}
+	quotaRateLimit    = intLimit{"maxPacketsPerSecond", 0, 1, 1 << 20, false}
+
+	// The clock rate limits are applied per codec, with its standard rate
+	// as the default.
+	audioClockRateLimit = intLimit{"clockRates", 0, 8000, 192_000, false}
+	videoClockRateLimit = intLimit{"clockRates", 0, 1000, 1_000_000, false}
+
+	detectWindowLimit  = durationLimit{"detectWindow", defaultDetectWindow, 100 * time.Millisecond, 30 * time.Second, false}
+	quotaDurationLimit = durationLimit{"maxDuration", 0, time.Second, 0, false}
+	sourceGapLimit     = durationLimit{"maxSourceGap", 0, 2 * time.Second, time.Hour, false}
+	bitrateWindowLimit = durationLimit{"bitrateWindow", defaultBitrateWindow, time.Second, 5 * time.Minute, false}
+	waitKeyframeLimit  = durationLimit{"waitKeyframe", 0, 100 * time.Millisecond, time.Minute, false}
+	resourceCheckLimit = durationLimit{"resourceCheckInterval", 0, 5 * time.Second, time.Hour, false}
+	negotiationLimit   = durationLimit{"negotiationTimeout", 0, time.Second, 5 * time.Minute, false}
+)
+
+// GenerateRequest limits, rejected like StartRequest's.
+var (
+	generateBitrateLimit  = intLimit{"bitrateKbps", 0, 8, 20_000, false}
+	generateDurationLimit = durationLimit{"duration", 10 * time.Second, 100 * time.Millisecond, 10 * time.Minute, false}
+)
+
+// validate checks c against the limits above, filling in defaults and
+// clamping where they say so.
+func (c *Config) validate() error {
+	for _, f := range []struct {
+		limit intLimit
+		v     *int
+	}{
+		{maxSessionsLimit, &c.MaxSessions},
+		{maxAnswerBytesLimit, &c.MaxAnswerBytes},
+		{deleteAttemptsLimit, &c.DeleteAttempts},
+		{rtpReadRetriesLimit, &c.RTPReadRetries},
+		{breakerThresholdLimit, &c.BreakerThreshold},
+		{dscpLimit, &c.DSCP},
+		{sessionBytesLimit, &c.MaxSessionBytes},
+		{sessionRateLimit, &c.MaxPacketsPerSecond},
+		{minFrameRateLimit, &c.MinFrameRate},
+	} {
+		if err := f.limit.apply(f.v); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		limit durationLimit
+		v     *Duration
+	}{
+		{deleteBackoffLimit, &c.DeleteBackoff},
+		{rtpReadBackoffLimit, &c.RTPReadBackoff},
+		{teardownTimeoutLimit, &c.TeardownTimeout},
+		{stunPrecheckTimeoutLimit, &c.STUNPrecheckTimeout},
+		{negotiationTimeoutLimit, &c.NegotiationTimeout},
+		{breakerCooldownLimit, &c.BreakerCooldown},
+		{idleTimeoutLimit, &c.IdleTimeout},
+		{sessionDurationLimit, &c.MaxSessionDuration},
+		{iceDisconnectGraceLimit, &c.ICEDisconnectGrace},
+		{dialTimeoutLimit, &c.WHIPClient.DialTimeout},
+		{tlsHandshakeTimeoutLimit, &c.WHIPClient.TLSHandshakeTimeout},
+		{idleConnTimeoutLimit, &c.WHIPClient.IdleConnTimeout},
+		{keepAliveLimit, &c.WHIPClient.KeepAlive},
+		{senderReportLimit, &c.SenderReportInterval},
+		{writeLatencyWarningLimit, &c.WriteLatencyWarning},
+		{iceDisconnectedLimit, &c.ICEDisconnectedTimeout},
+		{iceFailedLimit, &c.ICEFailedTimeout},
+		{iceKeepaliveLimit, &c.ICEKeepaliveInterval},
+	} {
+		if err := f.limit.apply(f.v); err != nil {
+			return err
+		}
+	}
+	if c.ICEKeepaliveInterval >= c.ICEDisconnectedTimeout {
+		return fmt.Errorf("iceKeepaliveInterval %s must be shorter than iceDisconnectedTimeout %s",
+			time.Duration(c.ICEKeepaliveInterval), time.Duration(c.ICEDisconnectedTimeout))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestIntLimit(t *testing.T) {
+	rejecting := intLimit{"n", 5, 1, 10, false}
+	clamping := intLimit{"n", 5, 1, 10, true}
+	tests := []struct {
+		name    string
+		limit   intLimit
+		v, want int
+		wantErr string
+	}{
+		{"zero takes default", rejecting, 0, 5, ""},
+		{"min", rejecting, 1, 1, ""},
+		{"max", rejecting, 10, 10, ""},
+		{"below min", rejecting, -1, -1, "n must be at least 1, got -1"},
+		{"below min when clamping", clamping, -1, -1, "n must be at least 1, got -1"},
+		{"above max", rejecting, 11, 11, "n must be at most 10, got 11"},
+		{"above max clamped", clamping, 11, 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := tt.v
+			err := tt.limit.apply(&v)
+			if got := errString(err); got != tt.wantErr {
+				t.Errorf("error %q, want %q", got, tt.wantErr)
+			}
+			if v != tt.want {
+				t.Errorf("value %d, want %d", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationLimit(t *testing.T) {
+	rejecting := durationLimit{"d", time.Second, 100 * time.Millisecond, time.Minute, false}
+	clamping := durationLimit{"d", time.Second, 100 * time.Millisecond, time.Minute, true}
+	unbounded := durationLimit{"d", 0, time.Second, 0, false}
+	tests := []struct {
+		name    string
+		limit   durationLimit
+		v, want time.Duration
+		wantErr string
+	}{
+		{"zero takes default", rejecting, 0, time.Second, ""},
+		{"zero default", unbounded, 0, 0, ""},
+		{"min", rejecting, 100 * time.Millisecond, 100 * time.Millisecond, ""},
+		{"max", rejecting, time.Minute, time.Minute, ""},
+		{"below min", rejecting, time.Millisecond, time.Millisecond, "d must be at least 100ms, got 1ms"},
+		{"negative", clamping, -time.Second, -time.Second, "d must be at least 100ms, got -1s"},
+		{"above max", rejecting, time.Hour, time.Hour, "d must be at most 1m0s, got 1h0m0s"},
+		{"above max clamped", clamping, time.Hour, time.Minute, ""},
+		{"no max", unbounded, 1000 * time.Hour, 1000 * time.Hour, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := Duration(tt.v)
+			err := tt.limit.apply(&v)
+			if got := errString(err); got != tt.wantErr {
+				t.Errorf("error %q, want %q", got, tt.wantErr)
+			}
+			if time.Duration(v) != tt.want {
+				t.Errorf("value %s, want %s", time.Duration(v), tt.want)
+			}
+		})
+	}
+}
+
+// TestConfigLimits checks that the server config clamps sizes, counts and
+// timeouts and rejects the rest.
+func TestConfigLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		got     func(c *Config) any
+		want    any
+		wantErr string
+	}{
+		{"defaults", `{}`, func(c *Config) any { return c.MaxSessions }, 1, ""},
+		{"default timeout", `{}`, func(c *Config) any { return time.Duration(c.NegotiationTimeout) }, defaultNegotiationTimeout, ""},
+		{"sessions clamped", `{"maxSessions": 5000}`, func(c *Config) any { return c.MaxSessions }, 1024, ""},
+		{"attempts clamped", `{"deleteAttempts": 50}`, func(c *Config) any { return c.DeleteAttempts }, 10, ""},
+		{"timeout clamped", `{"negotiationTimeout": "1h"}`, func(c *Config) any { return time.Duration(c.NegotiationTimeout) }, 5 * time.Minute, ""},
+		{"cooldown clamped", `{"breakerCooldown": "2h"}`, func(c *Config) any { return time.Duration(c.BreakerCooldown) }, time.Hour, ""},
+		{"nested timeout clamped", `{"whipClient": {"dialTimeout": "1h"}}`, func(c *Config) any { return time.Duration(c.WHIPClient.DialTimeout) }, 5 * time.Minute, ""},
+		{"unbounded timeout kept", `{"idleTimeout": "100h"}`, func(c *Config) any { return time.Duration(c.IdleTimeout) }, 100 * time.Hour, ""},
+		{"sessions below min", `{"maxSessions": -1}`, nil, nil, "maxSessions must be at least 1, got -1"},
+		{"timeout below min", `{"negotiationTimeout": "10ms"}`, nil, nil, "negotiationTimeout must be at least 1s, got 10ms"},
+		{"dscp not clamped", `{"dscp": 64}`, nil, nil, "dscp must be at most 63, got 64"},
+		{
+			"keepalive not below disconnect", `{"iceKeepaliveInterval": "5s", "iceDisconnectedTimeout": "5s"}`, nil, nil,
+			"iceKeepaliveInterval 5s must be shorter than iceDisconnectedTimeout 5s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			if err := json.Unmarshal([]byte(tt.conf), &c); err != nil {
+				t.Fatal(err)
+			}
+			err := c.validate()
+			if got := errString(err); got != tt.wantErr {
+				t.Fatalf("error %q, want %q", got, tt.wantErr)
+			}
+			if tt.got != nil {
+				if got := tt.got(&c); got != tt.want {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestStartRequestLimits checks that a StartRequest is rejected, never
+// clamped, outside its limits.
+func TestStartRequestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		wantErr string
+	}{
+		{"ok", `{"videoPort": 5004, "readers": 4, "waitKeyframe": "2s"}`, ""},
+		{"port too high", `{"videoPort": 70000}`, "videoPort must be at most 65535, got 70000"},
+		{"negative port", `{"audioPort": -1}`, "audioPort must be at least 1, got -1"},
+		{"too many readers", `{"videoPort": 5004, "readers": 1000}`, "readers must be at most 16, got 1000"},
+		{"bitrate too low", `{"videoPort": 5004, "maxBitrateKbps": 10}`, "maxBitrateKbps must be at least 100, got 10"},
+		{"write queue too long", `{"videoPort": 5004, "writeQueue": 20000}`, "writeQueue must be at most 16384, got 20000"},
+		{"source gap too short", `{"videoPort": 5004, "maxSourceGap": "1s"}`, "maxSourceGap must be at least 2s, got 1s"},
+		{"keyframe wait too long", `{"videoPort": 5004, "waitKeyframe": "2m"}`, "waitKeyframe must be at most 1m0s, got 2m0s"},
+		{"negotiation too long", `{"videoPort": 5004, "negotiationTimeout": "1h"}`, "negotiationTimeout must be at most 5m0s, got 1h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req StartRequest
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			if got := errString(req.checkLimits()); got != tt.wantErr {
+				t.Errorf("error %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
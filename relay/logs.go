@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxSessionLogs is how many log lines each session keeps for
+// /session/{id}/logs; older ones are overwritten.
+const maxSessionLogs = 500
+
+// LogEntry is a log line written for a session: one of its events, or
+// anything else the relay logged about it.
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type LogsResponse struct {
+	ID   string     `json:"id"`
+	Logs []LogEntry `json:"logs"`
+}
+
+// logRing holds a session's latest maxSessionLogs log lines.
+type logRing struct {
+	mu      sync.Mutex
+	entries [maxSessionLogs]LogEntry
+	next    int // where the next entry goes
+	full    bool
+}
+
+func (r *logRing) add(e LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % maxSessionLogs
+	r.full = r.full || r.next == 0
+}
+
+// tail returns the last n entries, oldest first.
+func (r *logRing) tail(n int) []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := r.next
+	if r.full {
+		size = maxSessionLogs
+	}
+	n = min(n, size)
+	out := make([]LogEntry, n)
+	for i := range out {
+		out[i] = r.entries[(r.next-n+i+maxSessionLogs)%maxSessionLogs]
+	}
+	return out
+}
+
+// logf writes a line about the session to the log and keeps it for
+// /session/{id}/logs.
+func (s *session) logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	s.logs.add(LogEntry{Time: time.Now(), Message: msg})
+	log.Printf("Relay %s%s: %s", s.id, s.logLabels, msg)
+}
+
+// logsHandler returns the session's last log lines, all that are kept or
+// the last n with ?n=.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	n := maxSessionLogs
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			writeError(w, newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("n must be a positive number, got %q", v)))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, LogsResponse{ID: s.id, Logs: s.logs.tail(n)})
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// observabilityRoutes registers the unauthenticated endpoints meant for
+// monitoring. They go on the main mux, the -metrics-addr listener, or both.
+func observabilityRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("GET /metrics", metricsHandler)
+}
+
+// metricsHandler serves session and relay counters in the Prometheus text
+// format. Ingest URLs are left out since they often carry stream keys.
+// Unlike the JSON stats, the counters are never reset; see /stats/reset.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	list := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	mu.Unlock()
+	slices.SortFunc(list, func(a, b *session) int { return strings.Compare(a.id, b.id) })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "whip_relay_sessions", "gauge", "Running relay sessions.")
+	fmt.Fprintf(w, "whip_relay_sessions %d\n", len(list))
+	writeMetric(w, "whip_relay_max_sessions", "gauge", "Configured session limit.")
+	fmt.Fprintf(w, "whip_relay_max_sessions %d\n", cfg.Load().MaxSessions)
+
+	writeMetric(w, "whip_relay_session_paused", "gauge", "1 if the session is paused.")
+	for _, s := range list {
+		paused := 0
+		if s.paused.Load() {
+			paused = 1
+		}
+		fmt.Fprintf(w, "whip_relay_session_paused{%s} %d\n", s.promLabels(), paused)
+	}
+
+	for _, m := range []struct {
+		name, help string
+		value      func(*TrackStats) uint64
+	}{
+		{"whip_relay_rtp_packets_total", "RTP packets relayed upstream.", func(t *TrackStats) uint64 { return t.Packets }},
+		{"whip_relay_rtp_bytes_total", "RTP bytes relayed upstream.", func(t *TrackStats) uint64 { return t.Bytes }},
+		{"whip_relay_rtp_malformed_total", "Packets dropped because they weren't valid RTP.", func(t *TrackStats) uint64 { return t.Malformed }},
+	} {
+		writeMetric(w, m.name, "counter", m.help)
+		for _, s := range list {
+			for _, mt := range s.media() {
+				fmt.Fprintf(w, "%s{%s,kind=%q} %d\n", m.name, s.promLabels(), mt.kind, m.value(mt.trackStats()))
+			}
+		}
+	}
+
+	writeMetric(w, "whip_relay_rtp_write_seconds", "histogram", "Time writing an RTP packet to the PeerConnection took.")
+	for _, s := range list {
+		for _, mt := range s.media() {
+			mt.writeLatency.writeProm(w, "whip_relay_rtp_write_seconds", fmt.Sprintf("%s,kind=%q", s.promLabels(), mt.kind))
+		}
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
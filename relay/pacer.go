@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// paceBurst is how much traffic at the target rate may go out back to
+	// back, e.g. the first packets of a keyframe.
+	paceBurst = 20 * time.Millisecond
+
+	// maxPaceDelay bounds how far the pacer lets output fall behind. Once a
+	// stream above the target rate is this late, packets go out unpaced
+	// rather than queueing without bound.
+	maxPaceDelay = 200 * time.Millisecond
+)
+
+// pacer is a token bucket that smooths a track's output to a target
+// bitrate, so ffmpeg's per-frame bursts don't hit the network at once. It
+// is safe for concurrent use by several readers.
+type pacer struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(bitrate int) *pacer {
+	rate := float64(bitrate) / 8
+	burst := max(rate*paceBurst.Seconds(), 1500)
+	return &pacer{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n more bytes fit the target rate.
+func (p *pacer) wait(n int) {
+	p.mu.Lock()
+	now := time.Now()
+	p.tokens = min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	p.last = now
+	p.tokens -= float64(n)
+
+	var d time.Duration
+	if p.tokens < 0 {
+		d = time.Duration(-p.tokens / p.rate * float64(time.Second))
+		if d > maxPaceDelay {
+			d = 0
+			p.tokens = -maxPaceDelay.Seconds() * p.rate
+		}
+	}
+	p.mu.Unlock()
+
+	time.Sleep(d)
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// stunPrecheck gathers ICE candidates against the session's ICE servers
+// and fails unless one of them answers within the stunPrecheckTimeout
+// config: a server-reflexive candidate from STUN, or a relay candidate
+// from TURN. It turns a network that can't reach the servers into a fast
+// error instead of an ICE failure after negotiating. It gives up early,
+// with ctx's error, if ctx is done.
+func (s *session) stunPrecheck(ctx context.Context) error {
+	api, err := s.api()
+	if err != nil {
+		return err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers:         s.iceServers,
+		ICETransportPolicy: s.icePolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create precheck pc: %w", err)
+	}
+	defer pc.Close()
+
+	found := make(chan webrtc.ICECandidateType, 1)
+	gathered := make(chan struct{})
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		switch {
+		case c == nil:
+			close(gathered)
+		case c.Typ == webrtc.ICECandidateTypeSrflx || c.Typ == webrtc.ICECandidateTypeRelay:
+			select {
+			case found <- c.Typ:
+			default:
+			}
+		}
+	})
+
+	// Gathering needs something to negotiate.
+	if _, err := pc.CreateDataChannel("precheck", nil); err != nil {
+		return fmt.Errorf("failed to create precheck data channel: %w", err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create precheck offer: %w", err)
+	}
+	start := time.Now()
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to start precheck gathering: %w", err)
+	}
+
+	timeout := time.Duration(cfg.Load().STUNPrecheckTimeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var why string
+	select {
+	case typ := <-found:
+		s.event("ice", "precheck: %s candidate after %s", typ, time.Since(start).Round(time.Millisecond))
+		return nil
+	case <-gathered:
+		why = "gathering finished"
+	case <-timer.C:
+		why = "timed out after " + timeout.String()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return newRelayError(CodeSTUNUnreachable, http.StatusBadGateway,
+		fmt.Errorf("no STUN reachability: %s without a server-reflexive or relay candidate from %s", why, iceServerURLs(s.iceServers)))
+}
+
+// iceServerURLs lists the URLs of servers, for messages. Credentials are
+// kept separately, so the URLs are safe to show.
+func iceServerURLs(servers []webrtc.ICEServer) []string {
+	var urls []string
+	for _, server := range servers {
+		urls = append(urls, server.URLs...)
+	}
+	return urls
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// ProbeRequest asks /probe what a WHIP server supports before starting a
+// session against it.
+type ProbeRequest struct {
+	IngestURL   string `json:"ingestUrl"`
+	BearerToken string `json:"bearerToken,omitempty"`
+
+	// CodecAllowlist, as in StartRequest, is checked against the codecs the
+	// server lists.
+	CodecAllowlist []string `json:"codecAllowlist,omitempty"`
+}
+
+// ProbeResponse is what the WHIP server said about itself in reply to an
+// OPTIONS request. WHIP doesn't require servers to answer OPTIONS, or to
+// list capabilities when they do, so every field past OptionsSupported may
+// be empty.
+type ProbeResponse struct {
+	IngestURL        string `json:"ingestUrl"`
+	OptionsSupported bool   `json:"optionsSupported"`
+	Status           int    `json:"status"`
+
+	Allow      []string `json:"allow,omitempty"`
+	AcceptPost []string `json:"acceptPost,omitempty"`
+	ICEServers []string `json:"iceServers,omitempty"`
+
+	// Codecs and Extensions come from an SDP body, as MIME types and
+	// header extension URIs.
+	Codecs     []string `json:"codecs,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+
+	// Unsupported lists the codecs the relay would offer for the request's
+	// allowlist that the server didn't list. It is only set when the
+	// server listed codecs at all.
+	Unsupported []string `json:"unsupportedCodecs,omitempty"`
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	var req ProbeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IngestURL == "" {
+		writeError(w, errBadRequest)
+		return
+	}
+	codecs, err := selectCodecs(req.CodecAllowlist, nil)
+	if err != nil {
+		writeError(w, newRelayError(CodeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	if err := cfg.Load().checkIngestURL(req.IngestURL); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp, err := probe(r, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(resp.Codecs) > 0 {
+		for _, c := range codecs {
+			if !slices.ContainsFunc(resp.Codecs, func(m string) bool { return strings.EqualFold(m, c.params.MimeType) }) {
+				resp.Unsupported = append(resp.Unsupported, c.params.MimeType)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// probe sends the OPTIONS request. A server that rejects it is reported
+// with OptionsSupported false rather than as an error; only failing to
+// reach the server is one.
+func probe(r *http.Request, req ProbeRequest) (*ProbeResponse, error) {
+	httpReq, err := http.NewRequestWithContext(r.Context(), http.MethodOptions, req.IngestURL, nil)
+	if err != nil {
+		return nil, newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("failed to build whip options: %w", err))
+	}
+	setBearer(httpReq, cmp.Or(req.BearerToken, cfg.Load().WHIPToken))
+	resp, err := whipDo(httpReq)
+	if err != nil {
+		return nil, newRelayError(CodeWHIPUnreachable, http.StatusBadGateway, fmt.Errorf("whip options failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	pr := &ProbeResponse{
+		IngestURL: redactURL(req.IngestURL),
+		Status:    resp.StatusCode,
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return pr, nil
+	}
+	pr.OptionsSupported = true
+	pr.Allow = headerList(resp.Header, "Allow")
+	pr.AcceptPost = headerList(resp.Header, "Accept-Post")
+	pr.ICEServers = iceServerLinks(resp.Header)
+
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != "application/sdp" {
+		return pr, nil
+	}
+	body, err := readBody(resp.Body, cfg.Load().MaxAnswerBytes)
+	if err != nil {
+		return nil, newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, fmt.Errorf("failed to read whip options: %w", err))
+	}
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(string(body)); err != nil {
+		return nil, newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, fmt.Errorf("failed to parse whip options sdp: %w", err))
+	}
+	for _, md := range desc.MediaDescriptions {
+		for _, a := range md.Attributes {
+			switch a.Key {
+			case "rtpmap":
+				// "96 H264/90000"
+				_, enc, _ := strings.Cut(a.Value, " ")
+				name, _, _ := strings.Cut(enc, "/")
+				if m := md.MediaName.Media + "/" + name; name != "" && !slices.Contains(pr.Codecs, m) {
+					pr.Codecs = append(pr.Codecs, m)
+				}
+			case "extmap":
+				// "1 urn:ietf:params:rtp-hdrext:sdes:mid"
+				if f := strings.Fields(a.Value); len(f) >= 2 && !slices.Contains(pr.Extensions, f[1]) {
+					pr.Extensions = append(pr.Extensions, f[1])
+				}
+			}
+		}
+	}
+	return pr, nil
+}
+
+// headerList splits the comma-separated values of header key.
+func headerList(h http.Header, key string) []string {
+	var out []string
+	for _, v := range h.Values(key) {
+		for item := range strings.SplitSeq(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+// iceServerLinks returns the URLs of the Link headers with rel="ice-server",
+// which is how WHIP servers advertise STUN and TURN servers.
+func iceServerLinks(h http.Header) []string {
+	var out []string
+	for _, link := range headerList(h, "Link") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(strings.ReplaceAll(params, `"`, ""), "rel=ice-server") {
+			continue
+		}
+		out = append(out, strings.Trim(strings.TrimSpace(target), "<>"))
+	}
+	return out
+}
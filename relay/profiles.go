@@ -0,0 +1,54 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// validateProfiles checks that every profile in the config is a valid
+// StartRequest object, short of what only a complete request can be checked
+// for, such as its ports.
+func validateProfiles(profiles map[string]json.RawMessage) error {
+	for name, p := range profiles {
+		var req StartRequest
+		if err := json.Unmarshal(p, &req); err != nil {
+			return fmt.Errorf("invalid profile %q: %w", name, err)
+		}
+		if req.Profile != "" {
+			return fmt.Errorf("profile %q can't name another profile", name)
+		}
+		if err := req.checkLimits(); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := validateSDPTransforms(req.SDPTransforms); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// unmarshalStartRequest decodes the JSON of a /start body into req on top
+// of the profile it names, if any, so that the fields it sets override the
+// profile's. Lists replace the profile's, clockRates are merged into it.
+func unmarshalStartRequest(b []byte, req *StartRequest) error {
+	var ref struct {
+		Profile string `json:"profile"`
+	}
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return errBadRequest
+	}
+	if ref.Profile != "" {
+		p, ok := cfg.Load().Profiles[ref.Profile]
+		if !ok {
+			return newRelayError(CodeBadRequest, http.StatusBadRequest, fmt.Errorf("unknown profile %q", ref.Profile))
+		}
+		if err := json.Unmarshal(p, req); err != nil {
+			return fmt.Errorf("profile %q: %w", ref.Profile, err)
+		}
+	}
+	if err := json.Unmarshal(b, req); err != nil {
+		return errBadRequest
+	}
+	return nil
+}
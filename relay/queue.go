@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+// writeQueue decouples a track's relay loops from writing to it, for when
+// the PeerConnection can't keep up: rather than the socket buffer and
+// pion's queues backing up, the oldest packets are dropped once depth of
+// them are waiting. Dropped packets read to the receiver as loss.
+type writeQueue struct {
+	ch    chan queuedPacket
+	drops atomic.Uint64
+}
+
+type queuedPacket struct {
+	pkt  *rtp.Packet
+	size int // on the wire, for stats and quotas
+}
+
+func newWriteQueue(depth int) *writeQueue {
+	return &writeQueue{ch: make(chan queuedPacket, depth)}
+}
+
+// push queues p, dropping the oldest packets to make room. It never
+// blocks, and is safe for the relay loops sharing a track to call
+// concurrently.
+func (q *writeQueue) push(p queuedPacket) {
+	for {
+		select {
+		case q.ch <- p:
+			return
+		default:
+		}
+		select {
+		case <-q.ch:
+			q.drops.Add(1)
+		default:
+		}
+	}
+}
+
+// drainQueue writes what mt's relay loops queue until the session closes,
+// or writing fails; then it closes conns to stop the relay loops too.
+func (s *session) drainQueue(conns []*net.UDPConn, mt *mediaTrack) {
+	for {
+		select {
+		case p := <-mt.queue.ch:
+			if !s.writeRTP(mt, p.pkt, p.size) {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
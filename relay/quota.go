@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"cmp"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// quota caps what one session may consume. Zero fields are unlimited. Its
+// counters are shared by every relay loop of the session.
+type quota struct {
+	maxBytes    uint64
+	maxDuration time.Duration
+	maxRate     int64 // packets per second, across tracks
+
+	bytes       atomic.Uint64
+	windowStart atomic.Int64 // unix second the rate window counts
+	windowCount atomic.Int64
+}
+
+// QuotaStats is a session's quota in /stats. Only the limits that are set
+// are reported.
+type QuotaStats struct {
+	MaxBytes            uint64   `json:"maxBytes,omitempty"`
+	RemainingBytes      *uint64  `json:"remainingBytes,omitempty"`
+	MaxDurationSeconds  float64  `json:"maxDurationSeconds,omitempty"`
+	RemainingSeconds    *float64 `json:"remainingSeconds,omitempty"`
+	MaxPacketsPerSecond int64    `json:"maxPacketsPerSecond,omitempty"`
+}
+
+// checkQuota rejects the quotas in req that are above the server's. It
+// complements checkLimits, which checks their range.
+func (c *Config) checkQuota(req StartRequest) error {
+	if c.MaxSessionBytes > 0 && req.MaxBytes > c.MaxSessionBytes {
+		return fmt.Errorf("maxBytes must be at most %d, got %d", c.MaxSessionBytes, req.MaxBytes)
+	}
+	if c.MaxSessionDuration > 0 && req.MaxDuration > c.MaxSessionDuration {
+		return fmt.Errorf("maxDuration must be at most %s, got %s", time.Duration(c.MaxSessionDuration), time.Duration(req.MaxDuration))
+	}
+	if c.MaxPacketsPerSecond > 0 && req.MaxPacketsPerSecond > c.MaxPacketsPerSecond {
+		return fmt.Errorf("maxPacketsPerSecond must be at most %d, got %d", c.MaxPacketsPerSecond, req.MaxPacketsPerSecond)
+	}
+	return nil
+}
+
+// newQuota returns req's quota, with the server's in place of the limits
+// req leaves unset.
+func newQuota(req StartRequest, c *Config) *quota {
+	return &quota{
+		maxBytes:    uint64(cmp.Or(req.MaxBytes, c.MaxSessionBytes)),
+		maxDuration: time.Duration(cmp.Or(req.MaxDuration, c.MaxSessionDuration)),
+		maxRate:     int64(cmp.Or(req.MaxPacketsPerSecond, c.MaxPacketsPerSecond)),
+	}
+}
+
+// count accounts one relayed packet of n bytes and returns why the session
+// must end, or "" while it is within quota.
+func (q *quota) count(n int) string {
+	if total := q.bytes.Add(uint64(n)); q.maxBytes > 0 && total > q.maxBytes {
+		return fmt.Sprintf("quota exceeded: relayed more than %d bytes", q.maxBytes)
+	}
+	if q.maxRate == 0 {
+		return ""
+	}
+	now := time.Now().Unix()
+	if start := q.windowStart.Load(); start != now && q.windowStart.CompareAndSwap(start, now) {
+		q.windowCount.Store(0)
+	}
+	if q.windowCount.Add(1) > q.maxRate {
+		return fmt.Sprintf("quota exceeded: more than %d packets per second", q.maxRate)
+	}
+	return ""
+}
+
+func (q *quota) stats(uptime time.Duration) *QuotaStats {
+	if q.maxBytes == 0 && q.maxDuration == 0 && q.maxRate == 0 {
+		return nil
+	}
+	st := &QuotaStats{MaxBytes: q.maxBytes, MaxPacketsPerSecond: q.maxRate}
+	if q.maxBytes > 0 {
+		left := q.maxBytes - min(q.bytes.Load(), q.maxBytes)
+		st.RemainingBytes = &left
+	}
+	if q.maxDuration > 0 {
+		st.MaxDurationSeconds = q.maxDuration.Seconds()
+		left := max(q.maxDuration-uptime, 0).Seconds()
+		st.RemainingSeconds = &left
+	}
+	return st
+}
@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// containers maps each codec the relay offers to the file format it is
+// recorded in.
+var containers = map[string]struct {
+	ext  string
+	open func(path string, c codec) (media.Writer, error)
+}{
+	strings.ToLower(webrtc.MimeTypeVP8): {"ivf", func(path string, _ codec) (media.Writer, error) {
+		return ivfwriter.New(path, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	}},
+	strings.ToLower(webrtc.MimeTypeOpus): {"ogg", func(path string, c codec) (media.Writer, error) {
+		return oggwriter.New(path, c.params.ClockRate, c.params.Channels)
+	}},
+}
+
+// recorder mirrors a track's relayed packets into a container file. Relay
+// loops share it, so writes are serialized. After the first write error
+// it stops recording rather than failing the relay.
+type recorder struct {
+	path string
+
+	mu sync.Mutex
+	w  media.Writer // nil once closed or failed
+}
+
+// recordPath resolves a StartRequest's recordPath or replayFile, named by
+// field: inside the recordDir config when that is set, and as given
+// otherwise.
+func (c *Config) recordPath(field, p string) (string, error) {
+	if c.RecordDir == "" {
+		return p, nil
+	}
+	if !filepath.IsLocal(p) {
+		return "", fmt.Errorf("%s %q must be a relative path inside recordDir", field, p)
+	}
+	return filepath.Join(c.RecordDir, p), nil
+}
+
+// newRecorder creates dir and the file for mt, named after the session and
+// the track's kind. codecs are the session's, to find the track's.
+func newRecorder(dir, sessionID string, mt *mediaTrack, codecs []codec) (*recorder, error) {
+	if mt.local.multi() {
+		return nil, fmt.Errorf("recording needs a single %s codec, not a choice for the WHIP server", mt.kind)
+	}
+	mimeType := strings.ToLower(mt.local.Codec().MimeType)
+	container, ok := containers[mimeType]
+	i := slices.IndexFunc(codecs, func(c codec) bool { return strings.ToLower(c.params.MimeType) == mimeType })
+	if !ok || i < 0 {
+		return nil, fmt.Errorf("recording %s is not supported", mt.local.Codec().MimeType)
+	}
+	c := codecs[i]
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recordPath: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.%s", sessionID, mt.kind, container.ext))
+	w, err := container.open(path, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	log.Printf("Recording %s to %s", mt.kind, path)
+	return &recorder{path: path, w: w}, nil
+}
+
+// write records pkt, reporting the error that stopped recording, if it
+// just happened.
+func (r *recorder) write(pkt *rtp.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return nil
+	}
+	if err := r.w.WriteRTP(pkt); err != nil {
+		r.w.Close()
+		r.w = nil
+		return fmt.Errorf("recording to %s stopped: %w", r.path, err)
+	}
+	return nil
+}
+
+// close finalizes the file. It is safe to call more than once.
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	if err := r.w.Close(); err != nil {
+		log.Printf("failed to close recording %s: %v", r.path, err)
+	} else {
+		log.Printf("Recording %s closed", r.path)
+	}
+	r.w = nil
+}
@@ -0,0 +1,145 @@
+// Package relay relays RTP, as ffmpeg sends it to local UDP ports, to WHIP
+// servers over WebRTC.
+//
+// A relay is configured once with LoadConfig and SetConfig, after which
+// StartSession starts sessions and Handler serves the HTTP API over them.
+// Sessions started either way share the config and the maxSessions limit,
+// and show up in the API alike.
+//
+// That state is package-level rather than held by a value: the active
+// config, the running sessions, the WHIP circuit breakers and the config
+// path /reload re-reads all belong to the process. A process therefore
+// runs a single relay. Call LoadConfig and SetConfig before serving;
+// sessions can then be started and stopped from any goroutine.
+package relay
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// LoadConfig reads the JSON config at path, if non-empty, and then the
+// environment, as documented on Config. path is also what POST /reload
+// re-reads.
+func LoadConfig(path string) (*Config, error) {
+	configPath = path
+	return loadConfig(path)
+}
+
+// SetConfig makes c the active config, in place of the defaults. Running
+// sessions keep the settings they started with.
+func SetConfig(c *Config) {
+	cfg.Store(c)
+}
+
+// CleanupState deletes the WHIP resources the stateFile config records as
+// left behind by a previous run.
+func CleanupState() error {
+	return cleanupState()
+}
+
+// Session is a running relay session.
+type Session struct {
+	s *session
+}
+
+// StartSession starts relaying req, within the maxSessions limit: it binds
+// the RTP ports and negotiates with the WHIP server. Errors are *RelayError
+// where they have a code, as returned by POST /start. ctx bounds the start:
+// the STUN precheck, the WHIP request and the wait for a keyframe give up
+// once it is done, and a session whose start finishes after that is torn
+// down again. It has no effect on the session once started; use Stop.
+// The session is added to the package's running sessions, see the package
+// documentation.
+func StartSession(ctx context.Context, req StartRequest) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := start(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		s.end(TeardownStartFailed, "start canceled")
+		return nil, err
+	}
+	return &Session{s}, nil
+}
+
+// ID is the session's ID in the HTTP API.
+func (s *Session) ID() string { return s.s.id }
+
+// Info is what POST /start returns for the session.
+func (s *Session) Info() SessionResponse { return s.s.response() }
+
+// Stats are the session's counters, as in GET /session/{id}.
+func (s *Session) Stats() SessionStats { return s.s.stats() }
+
+// Events is the session's event log.
+func (s *Session) Events() []Event { return s.s.events.list() }
+
+// Done is closed once the session has ended, whether through Stop, the
+// HTTP API or on its own, such as on a quota or ICE failure.
+func (s *Session) Done() <-chan struct{} { return s.s.done }
+
+// Stop ends the session and deletes its WHIP resource. The error reports a
+// resource that couldn't be deleted; local resources are always freed.
+// Stopping a stopped session does nothing.
+func (s *Session) Stop() error {
+	mu.Lock()
+	if sessions[s.s.id] == s.s {
+		delete(sessions, s.s.id)
+	}
+	mu.Unlock()
+	return s.s.close(TeardownStopped, "")
+}
+
+// Handler returns the HTTP API, including the web UI, with every request
+// passing through the access log. With testMode it serves
+// /test/generate, and with observability /metrics and /health. POST
+// /shutdown tears down every session like Shutdown but leaves the process
+// running; exit once Stopped is closed.
+func Handler(testMode, observability bool) http.Handler {
+	mux := http.NewServeMux()
+	routes(mux, testMode)
+	if observability {
+		observabilityRoutes(mux)
+	}
+	return accessLog(mux)
+}
+
+// ObservabilityHandler serves only /metrics and /health, for a separate
+// monitoring listener.
+func ObservabilityHandler() http.Handler {
+	mux := http.NewServeMux()
+	observabilityRoutes(mux)
+	return mux
+}
+
+// RunOnce relays req until the process is interrupted, then tears the
+// session down; see the -ingest flag. With generate, the tracks are fed by
+// the test generator instead of ffmpeg.
+func RunOnce(req StartRequest, generate bool) {
+	runOnce(req, generate)
+}
+
+// Shutdown tears down every session, reports them to the webhookUrl config
+// with reason, one of the Shutdown constants, and closes Stopped. It
+// leaves exiting the process to the caller.
+func Shutdown(reason string) {
+	shutdown(reason)
+}
+
+// WatchIdle shuts down as Shutdown does once the server has had no
+// sessions for override, or if zero, the idleTimeout config, and returns
+// then.
+func WatchIdle(override time.Duration) {
+	watchIdle(override)
+}
+
+// Stopped is closed once Shutdown, WatchIdle or POST /shutdown has torn
+// every session down.
+func Stopped() <-chan struct{} {
+	return stopped
+}
@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useConfig makes the JSON config conf active for the rest of the test,
+// loaded as LoadConfig would load it.
+func useConfig(t *testing.T, conf string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cfg.Load()
+	cfg.Store(c)
+	t.Cleanup(func() { cfg.Store(old) })
+}
+
+// freePorts returns n UDP ports on 127.0.0.1 that were free a moment ago.
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	ports := make([]int, n)
+	for i := range ports {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ports[i] = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	return ports
+}
+
+// fixture returns the SDP in testdata/name with CRLF line endings.
+func fixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ReplaceAll(string(b), "\n", "\r\n")
+}
+
+// whipServer is a WHIP server that answers every offer with answer, and
+// accepts the DELETE of the resource it creates.
+type whipServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	offers  []string
+	deletes int
+}
+
+func newWHIPServer(t *testing.T, answer string) *whipServer {
+	t.Helper()
+	ws := &whipServer{}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			offer, _ := io.ReadAll(r.Body)
+			ws.offers = append(ws.offers, string(offer))
+			w.Header().Set("Content-Type", "application/sdp")
+			w.Header().Set("Location", "/resource/1")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, answer)
+		case http.MethodDelete:
+			ws.deletes++
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+// offer returns the last offer ws was sent.
+func (ws *whipServer) offer() string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.offers) == 0 {
+		return ""
+	}
+	return ws.offers[len(ws.offers)-1]
+}
+
+// loopbackConfig is a config that lets sessions use a WHIP server on
+// 127.0.0.1, which is refused by default.
+const loopbackConfig = `{"allowedIngestHosts": ["127.0.0.1"]}`
+
+// endSessions ends every running session when the test is done.
+func endSessions(t *testing.T) {
+	t.Cleanup(func() {
+		mu.Lock()
+		running := make([]*session, 0, len(sessions))
+		for _, s := range sessions {
+			running = append(running, s)
+		}
+		mu.Unlock()
+		for _, s := range running {
+			s.end(TeardownStopped, "")
+		}
+	})
+}
+
+// call serves one request through the API's routes.
+func call(method, path, contentType, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	routes(mux, false)
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// startBody is a /start request relaying two free ports to ingestURL,
+// with extra JSON fields appended.
+func startBody(t *testing.T, ingestURL, extra string) string {
+	ports := freePorts(t, 2)
+	body := fmt.Sprintf(`{"ingestUrl": %q, "videoPort": %d, "audioPort": %d`, ingestURL, ports[0], ports[1])
+	if extra != "" {
+		body += ", " + extra
+	}
+	return body + "}"
+}
+
+// TestStartSessionContext checks that StartSession gives up on each step
+// that waits once its context is done, well before the relay's own
+// timeouts, and leaves nothing running.
+func TestStartSessionContext(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	unstall := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unstall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stalled.Close()
+	defer close(unstall)
+	janus := newWHIPServer(t, fixture(t, "janus-answer.sdp"))
+
+	tests := []struct {
+		name   string
+		ingest string
+		req    func(req *StartRequest)
+	}{
+		{"whip request", stalled.URL, func(req *StartRequest) {}},
+		{"keyframe wait", janus.URL, func(req *StartRequest) { req.WaitKeyframe = Duration(time.Minute) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports := freePorts(t, 2)
+			req := StartRequest{IngestURL: tt.ingest, VideoPort: ports[0], AudioPort: ports[1]}
+			tt.req(&req)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			begin := time.Now()
+			s, err := StartSession(ctx, req)
+			if err == nil {
+				s.Stop()
+				t.Fatal("start succeeded")
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("error %v, want the context's", err)
+			}
+			if d := time.Since(begin); d > 5*time.Second {
+				t.Errorf("took %s to give up", d)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(sessions) != 0 || starting != 0 {
+				t.Errorf("%d sessions and %d starting after a canceled start", len(sessions), starting)
+			}
+		})
+	}
+}
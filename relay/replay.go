@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// replayFormats are the recordings a session can replay, by extension:
+// the containers recordPath writes.
+var replayFormats = map[string]struct {
+	kind      webrtc.RTPCodecType
+	mimeType  string
+	payloader func() rtp.Payloader
+	open      func(io.Reader) (frameReader, error)
+}{
+	".ivf": {webrtc.RTPCodecTypeVideo, webrtc.MimeTypeVP8, func() rtp.Payloader { return &codecs.VP8Payloader{EnablePictureID: true} }, newIVFFrames},
+	".ogg": {webrtc.RTPCodecTypeAudio, webrtc.MimeTypeOpus, func() rtp.Payloader { return &codecs.OpusPayloader{} }, newOggFrames},
+}
+
+// frameReader returns a recording's frames in order, each with its time
+// since the first, and io.EOF after the last.
+type frameReader func() ([]byte, time.Duration, error)
+
+// newIVFFrames reads VP8 frames from an IVF file. The frame timestamps
+// are milliseconds as pion's reader returns them for its writer's files,
+// which is what recordPath writes.
+func newIVFFrames(r io.Reader) (frameReader, error) {
+	ivf, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" {
+		return nil, fmt.Errorf("IVF file holds %q, not VP8", header.FourCC)
+	}
+	first := -1
+	return func() ([]byte, time.Duration, error) {
+		frame, fh, err := ivf.ParseNextFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		if first < 0 {
+			first = int(fh.Timestamp)
+		}
+		return frame, time.Duration(int(fh.Timestamp)-first) * time.Millisecond, nil
+	}, nil
+}
+
+// newOggFrames reads Opus packets from an Ogg file written one packet per
+// page, as recordPath does, timing them by their 48 kHz granule position.
+func newOggFrames(r io.Reader) (frameReader, error) {
+	ogg, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	var first uint64
+	started := false
+	return func() ([]byte, time.Duration, error) {
+		for {
+			page, ph, err := ogg.ParseNextPage()
+			if err != nil {
+				return nil, 0, err
+			}
+			// The OpusTags header page is the only one without audio.
+			if ph.GranulePosition == 0 {
+				continue
+			}
+			if !started {
+				first, started = ph.GranulePosition, true
+			}
+			return page, time.Duration(ph.GranulePosition-first) * time.Second / 48000, nil
+		}
+	}, nil
+}
+
+// replayKind returns the kind of track the recording at path replays into,
+// by its extension.
+func replayKind(path string) (webrtc.RTPCodecType, error) {
+	f, ok := replayFormats[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return 0, fmt.Errorf("replayFile must be a .ivf (VP8) or .ogg (Opus) recording, got %q", path)
+	}
+	return f.kind, nil
+}
+
+// replay is a recording being played into a track in place of RTP from
+// ffmpeg.
+type replay struct {
+	path      string
+	file      *os.File
+	next      frameReader
+	payloader rtp.Payloader
+}
+
+// openReplay opens the recording at path for mt, whose codec has to be the
+// recording's.
+func openReplay(path string, mt *mediaTrack) (*replay, error) {
+	f := replayFormats[strings.ToLower(filepath.Ext(path))]
+	if mt.local.multi() || !strings.EqualFold(mt.local.Codec().MimeType, f.mimeType) {
+		return nil, fmt.Errorf("replaying %s needs %s as the only %s codec", path, f.mimeType, mt.kind)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replayFile: %w", err)
+	}
+	next, err := f.open(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read replayFile %s: %w", path, err)
+	}
+	return &replay{path: path, file: file, next: next, payloader: f.payloader()}, nil
+}
+
+// replay writes mt's recording to its track, each frame at its time in the
+// recording from now, and ends the session once it is done.
+func (s *session) replay(mt *mediaTrack) {
+	r := mt.replay
+	packetizer := rtp.NewPacketizer(1200, mt.payloadType, rand.Uint32(), r.payloader, rtp.NewRandomSequencer(), mt.clockRate)
+	base := rand.Uint32()
+	start := time.Now()
+	s.event("replay", "replaying %s into the %s track", r.path, mt.kind)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for frames := 0; ; frames++ {
+		frame, at, err := r.next()
+		if errors.Is(err, io.EOF) {
+			s.end(TeardownReplayFinished, fmt.Sprintf("replayed %d frames of %s", frames, r.path))
+			return
+		}
+		if err != nil {
+			if s.closed.Load() {
+				return
+			}
+			s.event("error", "replay of %s failed after %d frames: %v", r.path, frames, err)
+			s.end(TeardownReplayFinished, fmt.Sprintf("replay of %s failed: %v", r.path, err))
+			return
+		}
+
+		timer.Reset(time.Until(start.Add(at)))
+		select {
+		case <-s.done:
+			return
+		case <-timer.C:
+		}
+		s.gotRTP(mt, time.Now())
+		if s.paused.Load() {
+			continue
+		}
+		for _, pkt := range packetizer.Packetize(frame, 0) {
+			pkt.Timestamp = base + uint32(at*time.Duration(mt.clockRate)/time.Second)
+			if !s.writeRTP(mt, pkt, pkt.MarshalSize()) {
+				return
+			}
+		}
+	}
+}
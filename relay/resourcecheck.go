@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// resourceCheckTimeout bounds each resource check request.
+const resourceCheckTimeout = 5 * time.Second
+
+// resourceStatus asks the WHIP server about up's resource, with HEAD and
+// then GET if the server doesn't allow HEAD, and returns the status of the
+// last request. WHIP doesn't define either method on resources, so 405 or
+// 501 for both means the server can't be asked.
+func (up *upstream) resourceStatus(token string) (int, error) {
+	var status int
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		ctx, cancel := context.WithTimeout(context.Background(), resourceCheckTimeout)
+		httpReq, err := http.NewRequestWithContext(ctx, method, up.resourceURL, nil)
+		if err != nil {
+			cancel()
+			return 0, fmt.Errorf("failed to build whip resource check: %w", err)
+		}
+		setBearer(httpReq, token)
+		resp, err := whipDo(httpReq)
+		if err != nil {
+			cancel()
+			return 0, fmt.Errorf("whip resource check failed: %w", err)
+		}
+		resp.Body.Close()
+		cancel()
+		status = resp.StatusCode
+		if status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented {
+			break
+		}
+	}
+	return status, nil
+}
+
+// watchResource checks every interval that the current upstream's WHIP
+// resource still exists, to catch a server that dropped the ingest while
+// ICE still looks fine. Once it answers 404 or 410, s negotiates a new
+// resource with reconnect, or ends. Errors reaching the server aren't
+// taken as the resource being gone; ICE and the RTP watchdogs cover those.
+func (s *session) watchResource(interval time.Duration, reconnect bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		up := s.up
+		s.mu.Unlock()
+		if up.resourceURL == "" {
+			s.event("warning", "%s gave no resource URL, not checking it", redactURL(up.ingestURL))
+			return
+		}
+
+		status, err := up.resourceStatus(s.bearerToken())
+		switch {
+		case err != nil:
+			if !warned {
+				warned = true
+				s.event("warning", "%v", err)
+			}
+			continue
+		case status == http.StatusMethodNotAllowed, status == http.StatusNotImplemented:
+			s.event("warning", "%s answers resource checks with %d, not checking it", redactURL(up.resourceURL), status)
+			return
+		case status != http.StatusNotFound && status != http.StatusGone:
+			warned = false
+			continue
+		}
+
+		detail := fmt.Sprintf("whip resource %s is gone (%d)", redactURL(up.resourceURL), status)
+		s.event("resource", "%s", detail)
+		if reconnect {
+			err := s.reconnect(context.Background(), up)
+			if err == nil {
+				continue
+			}
+			detail = fmt.Sprintf("%s and reconnecting failed: %v", detail, err)
+		}
+		s.end(TeardownResourceGone, detail)
+		return
+	}
+}
+
+// reconnect negotiates a new resource at up's ingest URL in place of up,
+// unless a migration or ICE restart replaced up while it waited its turn.
+func (s *session) reconnect(ctx context.Context, up *upstream) error {
+	s.switching.Lock()
+	defer s.switching.Unlock()
+	s.mu.Lock()
+	current := s.up
+	s.mu.Unlock()
+	if current != up {
+		return nil
+	}
+	return s.swapUpstream(ctx, up.ingestURL)
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package relay
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported is whether each reader of a port gets its own socket.
+// Linux spreads a port's datagrams over its SO_REUSEPORT sockets by a hash
+// of the source address and port. Other platforms deliver them all to one
+// of the sockets, so their readers share a single socket instead.
+const reusePortSupported = true
+
+var reusePortConfig = net.ListenConfig{
+	Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	},
+}
+
+// listenReusePort binds n SO_REUSEPORT sockets to addr. The port is first
+// bound without the option, which fails with EADDRINUSE if anything holds
+// it, including another session's SO_REUSEPORT sockets that the new ones
+// would otherwise silently join.
+func listenReusePort(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	probe, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+
+	conns := make([]*net.UDPConn, 0, n)
+	for range n {
+		pc, err := reusePortConfig.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+	}
+	return conns, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenReusePort(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT load balancing is not supported on this platform")
+}
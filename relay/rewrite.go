@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// RTPRewrite declares how the RTP ffmpeg sends for one kind is rewritten
+// before it is relayed, for sources whose payload types or extension IDs
+// can't be made to match the offer.
+//
+// PayloadTypes and Extensions map incoming payload types and header
+// extension IDs to the ones to relay them as, e.g. {"96": 102}; values
+// missing from them pass unchanged. A payload type has to be mapped to one
+// of the kind's offered codecs. SSRC, if set, is the SSRC the track is sent
+// with, like videoSsrc and audioSsrc.
+type RTPRewrite struct {
+	Kind         string      `json:"kind"`
+	PayloadTypes map[int]int `json:"payloadTypes,omitempty"`
+	Extensions   map[int]int `json:"extensions,omitempty"`
+	SSRC         uint32      `json:"ssrc,omitempty"`
+}
+
+// rewriteTable is an RTPRewrite, validated, as the relay loops apply it.
+type rewriteTable struct {
+	pts  map[uint8]uint8
+	exts map[uint8]uint8
+}
+
+// validateRewrites checks rewrites against the codecs offered and the
+// SSRCs req pins.
+func validateRewrites(req StartRequest, codecs []codec) error {
+	seen := make(map[string]bool)
+	ssrcs := make(map[uint32]string)
+	for _, rw := range req.Rewrites {
+		kind := webrtc.NewRTPCodecType(rw.Kind)
+		if kind == 0 {
+			return fmt.Errorf("rewrite: unknown kind %q", rw.Kind)
+		}
+		if seen[rw.Kind] {
+			return fmt.Errorf("rewrite: %s is given twice", rw.Kind)
+		}
+		seen[rw.Kind] = true
+		if !slices.Contains(req.kinds(), kind) {
+			return fmt.Errorf("rewrite: %s isn't enabled, set %sPort", rw.Kind, rw.Kind)
+		}
+
+		var offered []int
+		for _, c := range codecs {
+			if c.kind == kind {
+				offered = append(offered, int(c.params.PayloadType))
+			}
+		}
+		for from, to := range rw.PayloadTypes {
+			if from < 0 || from > 127 {
+				return fmt.Errorf("rewrite %s: payload type %d outside 0-127", rw.Kind, from)
+			}
+			if !slices.Contains(offered, to) {
+				return fmt.Errorf("rewrite %s: payload type %d maps to %d, which isn't an offered %s codec's", rw.Kind, from, to, rw.Kind)
+			}
+		}
+		for from, to := range rw.Extensions {
+			if from < 1 || from > 14 || to < 1 || to > 14 {
+				return fmt.Errorf("rewrite %s: header extension id %d -> %d outside the one-byte range 1-14", rw.Kind, from, to)
+			}
+		}
+
+		pinned := req.VideoSSRC
+		if kind == webrtc.RTPCodecTypeAudio {
+			pinned = req.AudioSSRC
+		}
+		if rw.SSRC != 0 && pinned != 0 && rw.SSRC != pinned {
+			return fmt.Errorf("rewrite %s: ssrc %d conflicts with %sSsrc %d", rw.Kind, rw.SSRC, rw.Kind, pinned)
+		}
+		if ssrc := max(rw.SSRC, pinned); ssrc != 0 {
+			if other, ok := ssrcs[ssrc]; ok {
+				return fmt.Errorf("rewrite %s: ssrc %d is %s's too", rw.Kind, ssrc, other)
+			}
+			ssrcs[ssrc] = rw.Kind
+		}
+	}
+	return nil
+}
+
+// newRewriteTable compiles rw, or returns nil if it only sets the SSRC.
+func newRewriteTable(rw RTPRewrite) *rewriteTable {
+	if len(rw.PayloadTypes) == 0 && len(rw.Extensions) == 0 {
+		return nil
+	}
+	t := &rewriteTable{pts: make(map[uint8]uint8), exts: make(map[uint8]uint8)}
+	for from, to := range rw.PayloadTypes {
+		t.pts[uint8(from)] = uint8(to)
+	}
+	for from, to := range rw.Extensions {
+		t.exts[uint8(from)] = uint8(to)
+	}
+	return t
+}
+
+// apply rewrites h and reports whether it changed anything.
+func (t *rewriteTable) apply(h *rtp.Header) bool {
+	changed := false
+	if to, ok := t.pts[h.PayloadType]; ok && to != h.PayloadType {
+		h.PayloadType = to
+		changed = true
+	}
+	if !h.Extension || len(t.exts) == 0 {
+		return changed
+	}
+
+	ids := h.GetExtensionIDs()
+	if !slices.ContainsFunc(ids, func(id uint8) bool { _, ok := t.exts[id]; return ok }) {
+		return changed
+	}
+	type extension struct {
+		id      uint8
+		payload []byte
+	}
+	all := make([]extension, 0, len(ids))
+	for _, id := range ids {
+		to, ok := t.exts[id]
+		if !ok {
+			to = id
+		}
+		all = append(all, extension{to, h.GetExtension(id)})
+	}
+	// Rebuild in place, keeping the packet's extension profile.
+	h.Extensions = h.Extensions[:0]
+	for _, e := range all {
+		if err := h.SetExtension(e.id, e.payload); err != nil {
+			log.Printf("failed to rewrite header extension %d: %v", e.id, err)
+		}
+	}
+	return true
+}
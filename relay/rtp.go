@@ -0,0 +1,488 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// listenRTP binds the local UDP port ffmpeg sends RTP, or with secure
+// SRTP, to: on loopback, or with anyInterface, on every interface. With
+// sockets above 1, that many SO_REUSEPORT sockets share the port.
+func listenRTP(port int, secure, anyInterface bool, sockets int) ([]*net.UDPConn, error) {
+	addr := net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	if anyInterface {
+		addr.IP = nil
+	}
+	var conns []*net.UDPConn
+	if sockets > 1 {
+		var err error
+		if conns, err = listenReusePort(&addr, sockets); err != nil {
+			return nil, err
+		}
+	} else {
+		conn, err := net.ListenUDP("udp", &addr)
+		if err != nil {
+			return nil, err
+		}
+		conns = []*net.UDPConn{conn}
+	}
+
+	proto := "RTP"
+	if secure {
+		proto = "SRTP"
+	}
+	host := "127.0.0.1"
+	if anyInterface {
+		host = "[::]"
+	}
+	if sockets > 1 {
+		log.Printf("Listening for %s on udp://%s:%d with %d sockets", proto, host, port, sockets)
+	} else {
+		log.Printf("Listening for %s on udp://%s:%d", proto, host, port)
+	}
+	return conns, nil
+}
+
+// trackStats counts what a relay loop has forwarded for one track.
+type trackStats struct {
+	packets    atomic.Uint64
+	bytes      atomic.Uint64
+	malformed  atomic.Uint64
+	rtcp       atomic.Uint64
+	stray      atomic.Uint64
+	srtpFailed atomic.Uint64
+	rewritten  atomic.Uint64
+	foreign    atomic.Uint64
+	nacked     atomic.Uint64
+
+	// estimate is the receiver's latest REMB bandwidth estimate in bits
+	// per second, or 0 if it has sent none.
+	estimate atomic.Uint64
+}
+
+// readRTCP drains the RTCP the WHIP server sends for sender's track until
+// its PeerConnection closes, recording REMB bandwidth estimates and the
+// number of NACKed packets for mt. The NACK interceptor answers the NACKs.
+func readRTCP(sender *webrtc.RTPSender, mt *mediaTrack) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				mt.stats.estimate.Store(uint64(pkt.Bitrate))
+			case *rtcp.TransportLayerNack:
+				for _, pair := range pkt.Nacks {
+					mt.stats.nacked.Add(uint64(len(pair.PacketList())))
+				}
+			}
+		}
+	}
+}
+
+// relayOptions are the per-session settings of the relay loop.
+type relayOptions struct {
+	// stripPadding removes RTP padding before forwarding, for receivers
+	// that mishandle padded packets.
+	stripPadding bool
+
+	// continuity rewrites sequence numbers and timestamps across source
+	// restarts; see continuity.
+	continuity bool
+
+	// readers is how many relay loops read each port, for packet rates
+	// one goroutine can't keep up with. Where reusePortSupported, each has
+	// its own SO_REUSEPORT socket; elsewhere they read one socket
+	// concurrently. Packets may then reach the track out of order, which
+	// the receiver's jitter buffer absorbs.
+	readers int
+
+	// maxMalformed stops the relay loop after that many consecutive
+	// packets fail to parse as RTP, which means something other than
+	// ffmpeg's RTP output is hitting the port. Zero never stops.
+	maxMalformed int
+}
+
+// continuity keeps a track's sequence numbers and timestamps contiguous
+// when the source stream restarts, so the receiver's jitter buffer sees
+// one stream instead of a jump.
+//
+// A restart is detected by a new SSRC, which ffmpeg picks afresh along with
+// random initial sequence number and timestamp whenever it reconnects.
+// From then on every packet is shifted by two offsets: the sequence number
+// so the first new packet follows the last one relayed, and the timestamp
+// so it advances by the wall time elapsed since that packet, in the track's
+// clock rate. The offsets add up across restarts and wrap like the fields.
+type continuity struct {
+	clockRate uint32
+
+	started   bool
+	ssrc      uint32
+	lastSeq   uint16 // last relayed, after the offset
+	lastTS    uint32
+	lastAt    time.Time
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+// apply rewrites h and reports whether it starts a new source stream.
+func (c *continuity) apply(h *rtp.Header) bool {
+	restarted := c.started && h.SSRC != c.ssrc
+	if restarted {
+		elapsed := uint32(time.Since(c.lastAt).Seconds() * float64(c.clockRate))
+		c.seqOffset = c.lastSeq + 1 - h.SequenceNumber
+		c.tsOffset = c.lastTS + max(elapsed, 1) - h.Timestamp
+	}
+	c.started = true
+	c.ssrc = h.SSRC
+
+	h.SequenceNumber += c.seqOffset
+	h.Timestamp += c.tsOffset
+	c.lastSeq = h.SequenceNumber
+	c.lastTS = h.Timestamp
+	c.lastAt = time.Now()
+	return restarted
+}
+
+// isRTCP reports whether b is RTCP multiplexed onto the RTP port, as
+// ffmpeg sends with rtcp-mux. RFC 5761 separates the two by the second
+// byte: RTCP packet types 192-223 fall where RTP would have marker set and
+// payload types 64-95, which dynamic RTP payload types avoid.
+func isRTCP(b []byte) bool {
+	return len(b) >= 2 && b[1] >= 192 && b[1] <= 223
+}
+
+// handleRTCP consumes a compound RTCP packet ffmpeg sent on mt's port. None
+// of it is forwarded: the PeerConnection's interceptors send their own
+// sender reports for each binding, and a second set with ffmpeg's clock
+// would contradict them. A BYE is reported as an event.
+func (s *session) handleRTCP(mt *mediaTrack, b []byte) {
+	pkts, err := rtcp.Unmarshal(b)
+	if err != nil {
+		mt.stats.malformed.Add(1)
+		return
+	}
+	mt.stats.rtcp.Add(1)
+	for _, pkt := range pkts {
+		if _, ok := pkt.(*rtcp.Goodbye); ok {
+			s.event("bye", "%s source sent RTCP BYE", mt.kind)
+		}
+	}
+}
+
+// KeyframeResponse describes the PLI sent by POST /session/{id}/keyframe.
+type KeyframeResponse struct {
+	To        string `json:"to"`
+	MediaSSRC uint32 `json:"mediaSsrc"`
+}
+
+// requestKeyframe sends an RTCP PLI for the video source's SSRC back to
+// the address its RTP comes from, as rtcp-mux feedback on the RTP port.
+// Whether that produces a keyframe is up to the source: ffmpeg's RTP
+// muxer ignores incoming RTCP, while sources such as GStreamer's
+// rtpbin can act on it.
+func (s *session) requestKeyframe() (*KeyframeResponse, error) {
+	mt := s.mediaTrack(webrtc.RTPCodecTypeVideo)
+	if mt == nil {
+		return nil, newRelayError(CodeBadRequest, http.StatusBadRequest, errors.New("session has no video track"))
+	}
+	to := mt.source.Load()
+	if to == nil {
+		return nil, newRelayError(CodeNoSource, http.StatusConflict, errors.New("no video RTP received yet"))
+	}
+	pli := &rtcp.PictureLossIndication{MediaSSRC: mt.sourceSSRC.Load()}
+	b, err := pli.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	conn := mt.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return nil, newRelayError(CodeNoSource, http.StatusConflict, errors.New("video track was dropped"))
+	}
+	if _, err := conn.WriteToUDP(b, to); err != nil {
+		return nil, fmt.Errorf("failed to send PLI to %s: %w", to, err)
+	}
+	s.event("keyframe", "PLI for ssrc=%d sent to %s", pli.MediaSSRC, to)
+	return &KeyframeResponse{To: to.String(), MediaSSRC: pli.MediaSSRC}, nil
+}
+
+// transientReadError reports whether err from reading an RTP socket may
+// clear up by itself: an interrupted or timed-out read, the kernel running
+// short of buffers, or a refusal reported by ICMP. Anything else stops the
+// relay loop.
+func transientReadError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EAGAIN, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNREFUSED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// malformedLogInterval rate-limits the log line for packets that aren't
+// RTP; the ones in between are only counted.
+const malformedLogInterval = 5 * time.Second
+
+// relayRTP writes every RTP packet read from conn to track until conn is
+// closed. RTCP muxed onto the same port goes to handleRTCP instead. Several
+// relayRTP calls may share conn; whichever stops first closes it for all of
+// them.
+//
+// Packets are forwarded as parsed: version, marker, sequence number,
+// timestamp, the CSRC list, header extensions, payload and padding are
+// preserved. The track normalizes SSRC and payload type to the values
+// negotiated for each PeerConnection. The session's rewrites are applied
+// first. With stripPadding, padding is removed, and when the session remaps
+// header extensions their IDs are rewritten as well. With the srtp config,
+// packets are decrypted first. With a write queue, they are handed to
+// drainQueue instead of written.
+func relayRTP(conn *net.UDPConn, s *session, mt *mediaTrack) {
+	defer conn.Close()
+
+	opts := s.relay
+	warnedPT := -1
+	warnedStray := false
+	warnedSRTP := false
+	warnedForeign := false
+	cont := continuity{clockRate: mt.clockRate}
+	var (
+		consecutive int
+		suppressed  int
+		lastLogged  time.Time
+		readErrors  int
+	)
+	buf := make([]byte, 1500)
+	var plain []byte
+	if mt.srtp != nil {
+		plain = make([]byte, 1500)
+	}
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			c := cfg.Load()
+			if !transientReadError(err) || readErrors >= c.RTPReadRetries {
+				s.logf("RTP read error on port %d: %v", mt.port, err)
+				s.event("aborted", "%s: reading port %d failed after %d retries: %v", mt.kind, mt.port, readErrors, err)
+				return
+			}
+			backoff := time.Duration(c.RTPReadBackoff) << readErrors
+			readErrors++
+			s.logf("RTP read error on port %d, retrying in %s: %v", mt.port, backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		readErrors = 0
+		b := buf[:n]
+
+		if !mt.sources.allows(from) {
+			mt.stats.foreign.Add(1)
+			if !warnedForeign {
+				warnedForeign = true
+				s.event("warning", "%s port %d: dropping packets from %s, which isn't in sourceAllowlist", mt.kind, mt.port, from)
+			}
+			continue
+		}
+
+		// The headers stay in the clear, so RTCP is told apart before
+		// decrypting. A packet that fails authentication is dropped:
+		// usually a key that doesn't match ffmpeg's, or plain RTP.
+		if mt.srtp != nil {
+			if b, err = mt.srtp.decrypt(plain, b, isRTCP(b)); err != nil {
+				mt.stats.srtpFailed.Add(1)
+				if !warnedSRTP {
+					warnedSRTP = true
+					s.event("warning", "%s port %d: dropping packets that fail SRTP decryption (%v); does srtp match ffmpeg's -srtp_out_suite and -srtp_out_params?",
+						mt.kind, mt.port, err)
+				}
+				continue
+			}
+			n = len(b)
+		}
+
+		if isRTCP(b) {
+			s.handleRTCP(mt, b)
+			continue
+		}
+
+		// A queued packet outlives buf, so it needs its own copy.
+		if mt.queue != nil {
+			b = slices.Clone(b)
+		}
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(b); err != nil {
+			mt.stats.malformed.Add(1)
+			consecutive++
+			if opts.maxMalformed > 0 && consecutive >= opts.maxMalformed {
+				s.event("aborted", "%s: %d consecutive non-RTP packets on port %d, stopped relaying",
+					mt.kind, consecutive, mt.port)
+				return
+			}
+			if time.Since(lastLogged) < malformedLogInterval {
+				suppressed++
+				continue
+			}
+			s.logf("RTP unmarshal error on port %d: %v (%d more since last report)", mt.port, err, suppressed)
+			suppressed = 0
+			lastLogged = time.Now()
+			continue
+		}
+		consecutive = 0
+		mt.source.Store(from)
+		mt.sourceSSRC.Store(pkt.SSRC)
+		s.gotRTP(mt, time.Now())
+
+		// Packets keep their sequence numbers, so the receiver sees a
+		// pause as loss and recovers on the next keyframe.
+		if s.paused.Load() {
+			continue
+		}
+
+		if mt.rewrite != nil && mt.rewrite.apply(&pkt.Header) {
+			mt.stats.rewritten.Add(1)
+		}
+
+		// Media of the other kind can't be relayed on this track. It isn't
+		// handed to the other track either: its relay loops own its
+		// continuity and pacing state.
+		if pkt.PayloadType != mt.payloadType && slices.Contains(mt.strayPTs, pkt.PayloadType) {
+			mt.stats.stray.Add(1)
+			if !warnedStray {
+				warnedStray = true
+				s.event("warning", "%s port %d is receiving RTP with pt=%d, which is the other track's; dropping it. Is ffmpeg sending both streams to one port?",
+					mt.kind, mt.port, pkt.PayloadType)
+			}
+			continue
+		}
+
+		// With several codecs offered, the payload type is what tells
+		// which one ffmpeg sends, so a packet without a known one can't be
+		// relayed.
+		if mt.local.multi() {
+			if mt.local.index(pkt.PayloadType) < 0 {
+				if int(pkt.PayloadType) != warnedPT {
+					warnedPT = int(pkt.PayloadType)
+					s.event("warning", "%s RTP payload type %d names none of the offered codecs, dropping it",
+						mt.kind, pkt.PayloadType)
+				}
+				continue
+			}
+			mt.sourcePT.Store(uint32(pkt.PayloadType))
+		}
+
+		// The track rewrites the payload type, so a mismatch still relays,
+		// but it usually means ffmpeg is sending a different codec than
+		// the one negotiated.
+		if !mt.local.multi() && pkt.PayloadType != mt.payloadType && int(pkt.PayloadType) != warnedPT {
+			warnedPT = int(pkt.PayloadType)
+			s.event("warning", "%s RTP payload type %d doesn't match %s pt=%d",
+				mt.kind, pkt.PayloadType, mt.local.Codec().MimeType, mt.payloadType)
+		}
+
+		if opts.continuity && cont.apply(&pkt.Header) {
+			s.event("restarted", "%s source restarted with ssrc=%d, continuing at seq=%d ts=%d",
+				mt.kind, cont.ssrc, pkt.SequenceNumber, pkt.Timestamp)
+		}
+
+		if opts.stripPadding {
+			stripPadding(&pkt)
+		}
+
+		if ext := mt.extensions.Load(); ext != nil {
+			ext.apply(&pkt.Header)
+		}
+
+		if mt.queue != nil {
+			mt.queue.push(queuedPacket{pkt: &pkt, size: n})
+			continue
+		}
+		if !s.writeRTP(mt, &pkt, n) {
+			return
+		}
+	}
+}
+
+// stripPadding removes pkt's padding. A packet that is only padding, as
+// senders use to probe bandwidth, is kept with an empty payload: dropping
+// it would leave a gap in the sequence numbers that the receiver takes for
+// loss.
+func stripPadding(pkt *rtp.Packet) {
+	if !pkt.Padding {
+		return
+	}
+	pkt.Padding = false
+	pkt.Header.PaddingSize = 0
+	pkt.PaddingSize = 0 // deprecated, but still consulted when marshaling
+}
+
+// writeRTP writes pkt, n bytes on the wire, to mt's track and accounts it.
+// It reports false when relaying mt must stop.
+func (s *session) writeRTP(mt *mediaTrack, pkt *rtp.Packet, n int) bool {
+	if mt.pacer != nil {
+		mt.pacer.wait(n)
+	}
+	start := time.Now()
+	err := mt.local.WriteRTP(pkt)
+	s.timeWrite(mt, time.Since(start))
+	if err != nil {
+		// A binding whose PeerConnection is being torn down (e.g. the
+		// old upstream during a migration) reports a closed pipe; the
+		// remaining bindings still got the packet.
+		if errors.Is(err, io.ErrClosedPipe) {
+			return true
+		}
+		if errors.Is(err, errCodecNotNegotiated) {
+			detail := fmt.Sprintf("%s codec mismatch: ffmpeg sends pt=%d, but the WHIP server picked another codec", mt.kind, pkt.PayloadType)
+			s.event("error", "%s", detail)
+			go s.end(TeardownCodecMismatch, detail)
+			return false
+		}
+		s.logf("%s RTP write error: %v", mt.kind, err)
+		return false
+	}
+	mt.stats.packets.Add(1)
+	mt.stats.bytes.Add(uint64(n))
+	if mt.kind == webrtc.RTPCodecTypeVideo {
+		if fps, ok := mt.frames.count(pkt.Marker, time.Now()); ok {
+			s.checkFrameRate(mt, fps)
+		}
+		mt.noteKeyframe(pkt.PayloadType, pkt.Payload)
+	}
+	if detail := s.quota.count(n); detail != "" {
+		s.event("quota", "%s", detail)
+		go s.end(TeardownQuotaExceeded, detail)
+		return false
+	}
+	if mt.recorder != nil {
+		if err := mt.recorder.write(pkt); err != nil {
+			s.event("warning", "%s: %v", mt.kind, err)
+		}
+	}
+
+	// log.Printf("Got RTP packet: SSRC=%d Seq=%d TS=%d Size=%d",
+	// 	pkt.SSRC, pkt.SequenceNumber, pkt.Timestamp, len(pkt.Payload))
+	return true
+}
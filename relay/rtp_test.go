@@ -0,0 +1,269 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// Packets with V=2, pt=96, seq=0x1234, ts=0x10 and ssrc=0xdeadbeef.
+var (
+	plainPacket = []byte{
+		0x80, 0x60, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef,
+		0x01, 0x02, 0x03,
+	}
+	paddedPacket = []byte{
+		0xa0, 0x60, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef,
+		0x01, 0x02, 0x03,
+		0x00, 0x00, 0x00, 0x04,
+	}
+	paddingOnlyPacket = []byte{
+		0xa0, 0x60, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08,
+	}
+	// Two CSRCs, with the marker set.
+	csrcPacket = []byte{
+		0x82, 0xe0, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+		0x01, 0x02, 0x03,
+	}
+	// One CSRC, a one-byte header extension with id 1, and padding.
+	csrcExtensionPaddedPacket = []byte{
+		0xb1, 0x60, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef,
+		0x00, 0x00, 0x00, 0x01,
+		0xbe, 0xde, 0x00, 0x01, 0x10, 0xaa, 0x00, 0x00,
+		0x01, 0x02, 0x03,
+		0x00, 0x02,
+	}
+)
+
+func TestRelayedFieldsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"plain", plainPacket},
+		{"padded", paddedPacket},
+		{"padding only", paddingOnlyPacket},
+		{"csrc", csrcPacket},
+		{"csrc, extension and padding", csrcExtensionPaddedPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pkt rtp.Packet
+			if err := pkt.Unmarshal(tt.raw); err != nil {
+				t.Fatal(err)
+			}
+			got, err := pkt.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.raw) {
+				t.Errorf("relayed as\n%x, want\n%x", got, tt.raw)
+			}
+		})
+	}
+}
+
+func TestStripPadding(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want []byte
+	}{
+		{"unpadded", plainPacket, plainPacket},
+		{"padded", paddedPacket, plainPacket},
+		{
+			"padding only",
+			paddingOnlyPacket,
+			[]byte{0x80, 0x60, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef},
+		},
+		{"csrc", csrcPacket, csrcPacket},
+		{
+			"csrc, extension and padding",
+			csrcExtensionPaddedPacket,
+			[]byte{
+				0x91, 0x60, 0x12, 0x34, 0x00, 0x00, 0x00, 0x10, 0xde, 0xad, 0xbe, 0xef,
+				0x00, 0x00, 0x00, 0x01,
+				0xbe, 0xde, 0x00, 0x01, 0x10, 0xaa, 0x00, 0x00,
+				0x01, 0x02, 0x03,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pkt rtp.Packet
+			if err := pkt.Unmarshal(tt.raw); err != nil {
+				t.Fatal(err)
+			}
+			stripPadding(&pkt)
+			got, err := pkt.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("stripped to\n%x, want\n%x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStripPaddingKeepsSequence checks that a run with padding-only
+// packets in it is relayed without gaps in the sequence numbers.
+func TestStripPaddingKeepsSequence(t *testing.T) {
+	run := [][]byte{plainPacket, paddingOnlyPacket, paddingOnlyPacket, paddedPacket}
+	for i, raw := range run {
+		raw = bytes.Clone(raw)
+		raw[3] += byte(i)
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		stripPadding(&pkt)
+		if want := uint16(0x1234 + i); pkt.SequenceNumber != want {
+			t.Errorf("packet %d relayed with seq %#x, want %#x", i, pkt.SequenceNumber, want)
+		}
+		if pkt.Padding {
+			t.Errorf("packet %d still padded", i)
+		}
+	}
+}
+
+func TestListenRTPReaders(t *testing.T) {
+	for _, sockets := range []int{1, 4} {
+		t.Run(fmt.Sprintf("sockets=%d", sockets), func(t *testing.T) {
+			if sockets > 1 && !reusePortSupported {
+				t.Skip("no SO_REUSEPORT load balancing on this platform")
+			}
+			port := freePorts(t, 1)[0]
+			conns, err := listenRTP(port, false, false, sockets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}()
+			if len(conns) != sockets {
+				t.Errorf("got %d sockets, want %d", len(conns), sockets)
+			}
+
+			// Neither a plain socket nor another set of reuseport sockets
+			// may join the port.
+			for _, n := range []int{1, 2} {
+				if n > 1 && !reusePortSupported {
+					continue
+				}
+				if other, err := listenRTP(port, false, false, n); !errors.Is(err, syscall.EADDRINUSE) {
+					for _, conn := range other {
+						conn.Close()
+					}
+					t.Errorf("listening again with %d sockets: %v, want EADDRINUSE", n, err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReaders measures how fast a port's readers take in RTP from
+// several senders, parsing and re-marshaling each packet as relayRTP does.
+// Each sender has its own source port, so the kernel spreads them over the
+// readers' SO_REUSEPORT sockets; "shared" has the readers share one socket
+// instead, as they do where that isn't supported.
+func BenchmarkReaders(b *testing.B) {
+	for _, bm := range []struct {
+		name             string
+		readers, sockets int
+	}{
+		{"readers=1", 1, 1},
+		{"readers=2", 2, 2},
+		{"readers=4", 4, 4},
+		{"readers=4/shared", 4, 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			if bm.sockets > 1 && !reusePortSupported {
+				b.Skip("no SO_REUSEPORT load balancing on this platform")
+			}
+			benchmarkReaders(b, bm.readers, bm.sockets, 8)
+		})
+	}
+}
+
+func benchmarkReaders(b *testing.B, readers, sockets, senders int) {
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	conns, err := listenRTP(port, false, false, sockets)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	packet := append(bytes.Clone(plainPacket[:12]), make([]byte, 1188)...)
+	var (
+		received atomic.Int64
+		done     = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	for i := range readers {
+		conn := conns[i%len(conns)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1500)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				var pkt rtp.Packet
+				if pkt.Unmarshal(buf[:n]) == nil {
+					pkt.Marshal()
+				}
+				if received.Add(1) == int64(b.N) {
+					close(done)
+				}
+			}
+		}()
+	}
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for range senders {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				conn.Write(packet)
+				runtime.Gosched()
+			}
+		}()
+	}
+	<-done
+	b.StopTimer()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// SDPTransform is one declarative edit of the offer before it is POSTed,
+// for WHIP servers with quirks. Exactly one operation is set; it applies to
+// the m-lines of Kind ("audio", "video" or empty for every m-line).
+// Pion keeps the unmodified offer as its local description, so transforms
+// should only change what the server sees, not what Pion sends.
+type SDPTransform struct {
+	Kind string `json:"kind,omitempty"`
+
+	// BandwidthKbps sets the m-line's b=AS line.
+	BandwidthKbps int `json:"bandwidthKbps,omitempty"`
+
+	// RemoveAttribute drops every a= line with this key, e.g.
+	// "extmap-allow-mixed". Without a Kind, session-level lines go too.
+	RemoveAttribute string `json:"removeAttribute,omitempty"`
+
+	// AddAttribute appends an a= line, written as "key" or "key:value".
+	AddAttribute string `json:"addAttribute,omitempty"`
+
+	// CodecOrder moves the named codecs (e.g. ["vp8"]) to the front of the
+	// m-line's format list, in this order.
+	CodecOrder []string `json:"codecOrder,omitempty"`
+}
+
+func validateSDPTransforms(transforms []SDPTransform) error {
+	for i, t := range transforms {
+		if t.Kind != "" && t.Kind != "audio" && t.Kind != "video" {
+			return fmt.Errorf("sdp transform %d: unknown kind %q", i, t.Kind)
+		}
+		ops := 0
+		for _, set := range []bool{t.BandwidthKbps != 0, t.RemoveAttribute != "", t.AddAttribute != "", len(t.CodecOrder) > 0} {
+			if set {
+				ops++
+			}
+		}
+		if ops != 1 {
+			return fmt.Errorf("sdp transform %d: set exactly one operation", i)
+		}
+		if t.BandwidthKbps < 0 {
+			return fmt.Errorf("sdp transform %d: bandwidthKbps must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// mungeSDP applies transforms to the SDP in raw, in order.
+func mungeSDP(raw string, transforms []SDPTransform) (string, error) {
+	if len(transforms) == 0 {
+		return raw, nil
+	}
+
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(raw); err != nil {
+		return "", fmt.Errorf("failed to parse offer for sdp transforms: %w", err)
+	}
+	for _, t := range transforms {
+		if t.RemoveAttribute != "" && t.Kind == "" {
+			desc.Attributes = slices.DeleteFunc(desc.Attributes, func(a sdp.Attribute) bool { return a.Key == t.RemoveAttribute })
+		}
+		for _, m := range desc.MediaDescriptions {
+			if t.Kind == "" || t.Kind == m.MediaName.Media {
+				t.apply(m)
+			}
+		}
+	}
+
+	b, err := desc.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to write transformed offer: %w", err)
+	}
+	return string(b), nil
+}
+
+func (t SDPTransform) apply(m *sdp.MediaDescription) {
+	switch {
+	case t.BandwidthKbps != 0:
+		m.Bandwidth = slices.DeleteFunc(m.Bandwidth, func(b sdp.Bandwidth) bool { return b.Type == "AS" })
+		m.Bandwidth = append(m.Bandwidth, sdp.Bandwidth{Type: "AS", Bandwidth: uint64(t.BandwidthKbps)})
+
+	case t.RemoveAttribute != "":
+		m.Attributes = slices.DeleteFunc(m.Attributes, func(a sdp.Attribute) bool { return a.Key == t.RemoveAttribute })
+
+	case t.AddAttribute != "":
+		key, value, _ := strings.Cut(t.AddAttribute, ":")
+		m.Attributes = append(m.Attributes, sdp.NewAttribute(key, value))
+
+	case len(t.CodecOrder) > 0:
+		// rank is the position of a format's codec in CodecOrder, or
+		// len(CodecOrder) for codecs that aren't listed.
+		rank := func(format string) int {
+			for _, a := range m.Attributes {
+				pt, codec, ok := strings.Cut(a.Value, " ")
+				if a.Key != "rtpmap" || !ok || pt != format {
+					continue
+				}
+				name, _, _ := strings.Cut(codec, "/")
+				for i, want := range t.CodecOrder {
+					if strings.EqualFold(name, want) {
+						return i
+					}
+				}
+			}
+			return len(t.CodecOrder)
+		}
+		slices.SortStableFunc(m.MediaName.Formats, func(a, b string) int { return rank(a) - rank(b) })
+	}
+}
@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// sdpLines joins lines into an SDP with CRLF line endings.
+func sdpLines(lines ...string) string {
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+var mungeOffer = sdpLines(
+	"v=0",
+	"o=- 1 2 IN IP4 127.0.0.1",
+	"s=-",
+	"t=0 0",
+	"a=group:BUNDLE 0 1",
+	"a=extmap-allow-mixed",
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+	"c=IN IP4 0.0.0.0",
+	"a=mid:0",
+	"a=extmap-allow-mixed",
+	"a=rtpmap:111 opus/48000/2",
+	"m=video 9 UDP/TLS/RTP/SAVPF 102 106",
+	"c=IN IP4 0.0.0.0",
+	"b=AS:500",
+	"a=mid:1",
+	"a=extmap-allow-mixed",
+	"a=rtpmap:102 VP8/90000",
+	"a=rtpmap:106 H264/90000",
+)
+
+func TestMungeSDP(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms []SDPTransform
+		want       string
+	}{
+		{"no transforms", nil, mungeOffer},
+		{
+			"video bandwidth replaced",
+			[]SDPTransform{{Kind: "video", BandwidthKbps: 2500}},
+			strings.Replace(mungeOffer, "b=AS:500", "b=AS:2500", 1),
+		},
+		{
+			"audio bandwidth added",
+			[]SDPTransform{{Kind: "audio", BandwidthKbps: 64}},
+			strings.Replace(mungeOffer, "c=IN IP4 0.0.0.0\r\na=mid:0", "c=IN IP4 0.0.0.0\r\nb=AS:64\r\na=mid:0", 1),
+		},
+		{
+			"attribute removed from one kind",
+			[]SDPTransform{{Kind: "audio", RemoveAttribute: "extmap-allow-mixed"}},
+			strings.Replace(mungeOffer, "a=mid:0\r\na=extmap-allow-mixed\r\n", "a=mid:0\r\n", 1),
+		},
+		{
+			"attribute removed everywhere",
+			[]SDPTransform{{RemoveAttribute: "extmap-allow-mixed"}},
+			strings.ReplaceAll(mungeOffer, "a=extmap-allow-mixed\r\n", ""),
+		},
+		{
+			"attributes added",
+			[]SDPTransform{{Kind: "video", AddAttribute: "x-google-flag:conference"}, {AddAttribute: "sendonly"}},
+			strings.NewReplacer(
+				"a=rtpmap:111 opus/48000/2\r\n", "a=rtpmap:111 opus/48000/2\r\na=sendonly\r\n",
+				"a=rtpmap:106 H264/90000\r\n", "a=rtpmap:106 H264/90000\r\na=x-google-flag:conference\r\na=sendonly\r\n",
+			).Replace(mungeOffer),
+		},
+		{
+			"codec moved to the front",
+			[]SDPTransform{{Kind: "video", CodecOrder: []string{"h264"}}},
+			strings.Replace(mungeOffer, "SAVPF 102 106", "SAVPF 106 102", 1),
+		},
+		{
+			"codec order of an unlisted codec kept",
+			[]SDPTransform{{CodecOrder: []string{"av1", "vp8"}}},
+			mungeOffer,
+		},
+		{
+			"in order",
+			[]SDPTransform{{Kind: "video", BandwidthKbps: 1000}, {Kind: "video", BandwidthKbps: 2000}},
+			strings.Replace(mungeOffer, "b=AS:500", "b=AS:2000", 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mungeSDP(mungeOffer, tt.transforms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSDPTransformsPosted checks that config transforms run before the
+// request's, on the offer the WHIP server gets but not on Pion's own.
+func TestSDPTransformsPosted(t *testing.T) {
+	useConfig(t, `{"allowedIngestHosts": ["127.0.0.1"], "sdpTransforms": [{"kind": "video", "bandwidthKbps": 1000}]}`)
+	ws := newWHIPServer(t, fixture(t, "janus-answer.sdp"))
+	ports := freePorts(t, 2)
+	s, err := start(context.Background(), StartRequest{
+		IngestURL:     ws.URL + "/whip",
+		VideoPort:     ports[0],
+		AudioPort:     ports[1],
+		SDPTransforms: []SDPTransform{{Kind: "video", BandwidthKbps: 2000}, {AddAttribute: "x-relay"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.end(TeardownStopped, "")
+
+	offer := ws.offer()
+	if !strings.Contains(offer, "b=AS:2000\r\n") || strings.Contains(offer, "b=AS:1000") {
+		t.Errorf("posted offer doesn't have the request's bandwidth last:\n%s", offer)
+	}
+	if n := strings.Count(offer, "a=x-relay\r\n"); n != 2 {
+		t.Errorf("posted offer has a=x-relay on %d m-lines, want 2", n)
+	}
+	if local := s.up.pc.LocalDescription().SDP; strings.Contains(local, "x-relay") || strings.Contains(local, "b=AS") {
+		t.Errorf("local description was transformed:\n%s", local)
+	}
+}
+
+func TestMungeSDPUnparsable(t *testing.T) {
+	if _, err := mungeSDP("v=1\r\n", []SDPTransform{{BandwidthKbps: 1}}); err == nil {
+		t.Error("unparsable offer was transformed")
+	}
+}
+
+func TestValidateSDPTransforms(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms []SDPTransform
+		wantErr    string
+	}{
+		{"none", nil, ""},
+		{"one of each", []SDPTransform{
+			{Kind: "video", BandwidthKbps: 1},
+			{Kind: "audio", RemoveAttribute: "ssrc"},
+			{AddAttribute: "sendonly"},
+			{CodecOrder: []string{"vp8"}},
+		}, ""},
+		{"unknown kind", []SDPTransform{{Kind: "application", BandwidthKbps: 1}}, `sdp transform 0: unknown kind "application"`},
+		{"no operation", []SDPTransform{{BandwidthKbps: 1}, {Kind: "video"}}, "sdp transform 1: set exactly one operation"},
+		{"two operations", []SDPTransform{{BandwidthKbps: 1, AddAttribute: "sendonly"}}, "sdp transform 0: set exactly one operation"},
+		{"negative bandwidth", []SDPTransform{{BandwidthKbps: -1}}, "sdp transform 0: bandwidthKbps must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errString(validateSDPTransforms(tt.transforms)); got != tt.wantErr {
+				t.Errorf("error %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
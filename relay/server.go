@@ -0,0 +1,1172 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type StartRequest struct {
+	// Profile names a profile from the server config whose fields this
+	// request starts from; any it sets itself override the profile's.
+	Profile string `json:"profile,omitempty"`
+
+	IngestURL string `json:"ingestUrl"`
+
+	// Replace ends a running session to the same ingest URL before
+	// starting, instead of the 409 rejectDuplicateIngest answers with.
+	Replace bool `json:"replace,omitempty"`
+
+	// BearerToken authenticates requests to the WHIP server, defaulting
+	// to the whipToken config. It can be rotated with
+	// POST /session/{id}/token.
+	BearerToken string `json:"bearerToken,omitempty"`
+
+	// VideoPort and AudioPort are the local RTP ports ffmpeg sends to. A
+	// zero port disables that kind, so audio- or video-only relays just
+	// omit the other port.
+	VideoPort int `json:"videoPort"`
+	AudioPort int `json:"audioPort"`
+
+	// SourceAllowlist, if set, binds the ports on every interface instead
+	// of loopback, for ffmpeg on another host, and accepts RTP only from
+	// these addresses or CIDR networks, e.g. ["10.0.0.5", "10.1.0.0/24"].
+	// Packets from anywhere else are dropped and counted in /stats.
+	SourceAllowlist []string `json:"sourceAllowlist,omitempty"`
+
+	// PortRetryCount, when a port is in use, tries up to that many ports
+	// above it in turn instead of failing with 409 PORT_IN_USE. The ports
+	// bound are in the response, and ffmpeg has to be sent there.
+	PortRetryCount int `json:"portRetryCount,omitempty"`
+
+	// CodecAllowlist limits which codecs are registered for the session,
+	// e.g. ["vp8", "opus"]. Empty means every supported codec but H.264,
+	// which has to be named. Naming several video codecs, e.g. ["vp8",
+	// "h264", "opus"], offers them all and lets the WHIP server pick; ffmpeg
+	// then has to send the picked one with its payload type from the offer.
+	CodecAllowlist []string `json:"codecAllowlist,omitempty"`
+
+	// CodecPreference reorders the offered codecs, naming them like
+	// CodecAllowlist, e.g. ["h264", "vp8"] to prefer H.264; codecs it leaves
+	// out follow in their usual order. Each kind's first codec is also the
+	// one ffmpeg is expected to send when the WHIP server picks none.
+	CodecPreference []string `json:"codecPreference,omitempty"`
+
+	// ICEServerRef names an ICE server set from the server config.
+	ICEServerRef string `json:"iceServerRef,omitempty"`
+
+	// RelayOnly forces all media through TURN by setting the ICE transport
+	// policy to relay. The server config can force it for every session.
+	RelayOnly bool `json:"relayOnly,omitempty"`
+
+	// STUNPrecheck gathers candidates against the ICE servers before
+	// negotiating and fails the start with 502 STUN_UNREACHABLE if none of
+	// them answers; see stunPrecheck.
+	STUNPrecheck bool `json:"stunPrecheck,omitempty"`
+
+	// BundlePolicy ("balanced", "max-compat" or "max-bundle") and
+	// RTCPMuxPolicy ("negotiate" or "require") set the PeerConnection
+	// policies for WHIP servers with specific expectations, such as Janus.
+	// Empty uses the bundlePolicy and rtcpMuxPolicy config, by default
+	// max-bundle and require. max-bundle needs require.
+	BundlePolicy  string `json:"bundlePolicy,omitempty"`
+	RTCPMuxPolicy string `json:"rtcpMuxPolicy,omitempty"`
+
+	// ClockRates overrides the RTP clock rate offered for a codec, keyed
+	// like CodecAllowlist, e.g. {"opus": 24000}, for sources that don't
+	// use the standard rate. The offer's rtpmap carries the override, which
+	// receivers that expect the standard rate may reject.
+	ClockRates map[string]uint32 `json:"clockRates,omitempty"`
+
+	// AudioFEC offers Opus with in-band FEC (useinbandfec=1) for lossy
+	// paths. ffmpeg has to encode it too: -fec 1 -packet_loss <percent>.
+	// RED (RFC 2198) isn't offered: ffmpeg doesn't produce it, so the relay
+	// would have to encapsulate the Opus packets itself.
+	AudioFEC bool `json:"audioFec,omitempty"`
+
+	// VideoRTX offers RTX (RFC 4588) for each video codec, so the packets
+	// the receiver NACKs are resent on a separate SSRC and payload type
+	// instead of as duplicates on the media stream, which some receivers
+	// require. The nacked counter in /stats shows how many were requested.
+	VideoRTX bool `json:"videoRtx,omitempty"`
+
+	// DataChannel, if set, is the label of a data channel negotiated
+	// alongside the media, for metadata such as timecodes or cue points.
+	// Messages are sent with POST /session/{id}/data. The WHIP server has to
+	// accept the application m-line.
+	DataChannel string `json:"dataChannel,omitempty"`
+
+	// SDPTransforms edit the offer before it is POSTed, after any from
+	// the server config.
+	SDPTransforms []SDPTransform `json:"sdpTransforms,omitempty"`
+
+	// DetectCodecs (experimental) listens for up to DetectWindow (default
+	// 2s) before negotiating and picks, per kind, the supported codec whose
+	// payload type matches the first RTP packet ffmpeg sends.
+	DetectCodecs bool     `json:"detectCodecs,omitempty"`
+	DetectWindow Duration `json:"detectWindow,omitempty"`
+
+	// StripPadding removes RTP padding before relaying, for receivers that
+	// mishandle padded packets. Packets that are only padding are relayed
+	// empty, keeping the sequence numbers contiguous.
+	StripPadding bool `json:"stripPadding,omitempty"`
+
+	// Readers is the number of goroutines reading each RTP port, 1 by
+	// default and at most maxReaders. It helps at packet rates a single
+	// read loop can't sustain, and can't be combined with KeepContinuity.
+	// On Linux each reader has its own SO_REUSEPORT socket, and the kernel
+	// spreads packets over them by source address and port, so one sender
+	// is still read by one goroutine. Elsewhere the readers share a socket.
+	Readers int `json:"readers,omitempty"`
+
+	// MaxBitrateKbps caps the video bitrate advertised to the WHIP server
+	// with b=AS and asks for REMB feedback. The relay can't transcode, so
+	// the receiver's estimate is reported in /stats for throttling ffmpeg.
+	MaxBitrateKbps int `json:"maxBitrateKbps,omitempty"`
+
+	// PaceVideoBitrate, in bits per second, smooths video output to that
+	// rate instead of forwarding each frame's packets in one burst. It adds
+	// up to 200ms of latency when ffmpeg exceeds the rate; zero disables it.
+	PaceVideoBitrate int `json:"paceVideoBitrate,omitempty"`
+
+	// MinVideoKbps and MinAudioKbps flag a track whose bitrate, averaged
+	// over BitrateWindow (default 5s, at one-second resolution), falls
+	// below them, e.g. a throttled or partial feed, with a warning event
+	// and a bitrate.low webhook, and bitrate.recovered once it is back.
+	// Zero doesn't check the track.
+	MinVideoKbps  int      `json:"minVideoKbps,omitempty"`
+	MinAudioKbps  int      `json:"minAudioKbps,omitempty"`
+	BitrateWindow Duration `json:"bitrateWindow,omitempty"`
+
+	// KeepContinuity rewrites RTP sequence numbers and timestamps so that
+	// when ffmpeg reconnects, the relayed stream carries on from the last
+	// packet instead of jumping.
+	KeepContinuity bool `json:"keepContinuity,omitempty"`
+
+	// MaxSourceGap keeps the session and its WHIP connection up while no
+	// RTP arrives for at most that long, e.g. while ffmpeg restarts for a
+	// scene change, and ends it after; the first packet has to arrive
+	// within that long of the start too. Relaying resumes when ffmpeg sends
+	// to the same ports again; with KeepContinuity the receiver sees one
+	// stream. Zero never ends a session for lack of RTP.
+	MaxSourceGap Duration `json:"maxSourceGap,omitempty"`
+
+	// NegotiationTimeout bounds negotiating with the WHIP server, here and
+	// on migrations, in place of the negotiationTimeout config. A /start
+	// that runs out fails with 504 NEGOTIATION_TIMEOUT, deleting the WHIP
+	// resource if one was created.
+	NegotiationTimeout Duration `json:"negotiationTimeout,omitempty"`
+
+	// ResourceCheckInterval, if set, asks the WHIP server that often
+	// whether the session's resource still exists, with HEAD or GET, to
+	// notice an ingest the server dropped while ICE hasn't. A resource that
+	// is gone (404 or 410) ends the session, or with ResourceCheckReconnect,
+	// is replaced by POSTing a new offer. Servers that support neither
+	// method aren't checked.
+	ResourceCheckInterval  Duration `json:"resourceCheckInterval,omitempty"`
+	ResourceCheckReconnect bool     `json:"resourceCheckReconnect,omitempty"`
+
+	// WaitKeyframe makes /start wait up to that long after negotiating
+	// for the first video keyframe to be relayed, and fail with NO_VIDEO,
+	// ending the session, if none is. It needs videoPort; zero returns as
+	// soon as the WHIP server answers.
+	WaitKeyframe Duration `json:"waitKeyframe,omitempty"`
+
+	// WriteQueue, if set, buffers up to that many packets per track
+	// between reading them and writing them to the PeerConnection, dropping
+	// the oldest when full, so a write that backs up under load costs
+	// packets instead of memory. Drops are counted in /stats.
+	WriteQueue int `json:"writeQueue,omitempty"`
+
+	// MaxMalformedPackets stops relaying a kind after that many
+	// consecutive packets on its port fail to parse as RTP. Zero keeps
+	// relaying, counting and rate-limiting the log instead.
+	MaxMalformedPackets int `json:"maxMalformedPackets,omitempty"`
+
+	// HeaderExtensions declares the RTP header extensions ffmpeg sends.
+	// They are negotiated with the WHIP server and rewritten to the
+	// negotiated IDs; any other extension is stripped. Empty means
+	// extensions are neither negotiated nor touched.
+	HeaderExtensions []HeaderExtension `json:"headerExtensions,omitempty"`
+
+	// Rewrites rewrite the payload types and header extension IDs of the
+	// RTP ffmpeg sends, per kind, and can pin the SSRC; see RTPRewrite. A
+	// packet is rewritten as soon as it is read, so everything after sees
+	// the rewritten values: the payload type checks, keepContinuity,
+	// stripPadding and the headerExtensions remapping, whose IDs are then
+	// the rewritten ones. Rewritten packets are counted in /stats.
+	Rewrites []RTPRewrite `json:"rewrites,omitempty"`
+
+	// VideoSSRC and AudioSSRC pin the SSRC each track is sent with, on
+	// every upstream including migrations, for receivers that route or
+	// record by SSRC. Zero lets pion pick one at random.
+	VideoSSRC uint32 `json:"videoSsrc,omitempty"`
+	AudioSSRC uint32 `json:"audioSsrc,omitempty"`
+
+	// RecordPath, if set, is a directory to record each relayed track to,
+	// as <session id>-video.ivf and <session id>-audio.ogg. With the
+	// recordDir config it must be relative and lands inside that.
+	RecordPath string `json:"recordPath,omitempty"`
+
+	// Labels are key-value pairs describing the session, e.g.
+	// {"game": "chess", "region": "us-east"}, for filtering: they are in
+	// every log line about it, the session endpoints and webhooks, and in
+	// /metrics for the names in the metricLabels config. At most 16, named
+	// like Prometheus labels, with values up to 128 bytes.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ReplayFile, if set, is a recording made with RecordPath to play
+	// into the session in place of RTP from ffmpeg, at the pace of its
+	// timestamps, to reproduce a stream against a WHIP server. A .ivf file
+	// replays into the VP8 video track and a .ogg file into the Opus audio
+	// track, whose port must be omitted; the other kind can still come
+	// from ffmpeg. The session ends once the file does. With the recordDir
+	// config it must be relative and is read from inside that.
+	ReplayFile string `json:"replayFile,omitempty"`
+
+	// H264Profile, e.g. "42e01f" for constrained baseline level 3.1, is
+	// the profile-level-id H.264 is offered with and has to be negotiated
+	// with, for downstream decoders that only handle that profile. An
+	// answer with another fails with 502 CODEC_MISMATCH. It needs h264 in
+	// CodecAllowlist.
+	H264Profile string `json:"h264Profile,omitempty"`
+
+	// MaxBytes, MaxDuration and MaxPacketsPerSecond end the session once
+	// it has relayed that many bytes, run that long, or received more than
+	// that many packets within a second, across tracks. Zero uses the
+	// server's limit, which is also the largest value accepted.
+	MaxBytes            int      `json:"maxBytes,omitempty"`
+	MaxDuration         Duration `json:"maxDuration,omitempty"`
+	MaxPacketsPerSecond int      `json:"maxPacketsPerSecond,omitempty"`
+}
+
+// HeaderExtension is an RTP header extension by URI and the ID ffmpeg uses
+// for it. Kind is "audio", "video" or empty for both.
+type HeaderExtension struct {
+	URI  string `json:"uri"`
+	ID   int    `json:"id"`
+	Kind string `json:"kind,omitempty"`
+}
+
+// validate checks everything about req that can be rejected before any
+// resources are allocated.
+func (req StartRequest) validate() error {
+	if err := validateLabels(req.Labels); err != nil {
+		return err
+	}
+	if req.ReplayFile != "" {
+		kind, err := replayKind(req.ReplayFile)
+		if err != nil {
+			return err
+		}
+		if req.port(kind) != 0 {
+			return fmt.Errorf("replayFile replaces %sPort; omit it", kind)
+		}
+		path, err := cfg.Load().recordPath("replayFile", req.ReplayFile)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("replayFile: %w", err)
+		}
+	}
+	if len(req.kinds()) == 0 {
+		return errNoTracks
+	}
+	codecs, err := selectCodecs(req.CodecAllowlist, req.kinds())
+	if err != nil {
+		return err
+	}
+	if _, err := withClockRates(codecs, req.ClockRates); err != nil {
+		return err
+	}
+	if _, err := withPreference(codecs, req.CodecPreference); err != nil {
+		return err
+	}
+	if req.H264Profile != "" {
+		if !h264ProfilePattern.MatchString(req.H264Profile) {
+			return fmt.Errorf("h264Profile must be a profile-level-id of 6 hex digits, got %q", req.H264Profile)
+		}
+		if !slices.ContainsFunc(codecs, func(c codec) bool { return c.is("h264") }) {
+			return errors.New("h264Profile needs h264 in codecAllowlist")
+		}
+	}
+	iceServers, err := cfg.Load().iceServers(req.ICEServerRef)
+	if err != nil {
+		return err
+	}
+	if req.relayOnly() && !hasTURN(iceServers) {
+		return errors.New("relay-only mode needs an iceServerRef with at least one TURN server")
+	}
+	if req.STUNPrecheck && len(iceServers) == 0 {
+		return errors.New("stunPrecheck needs an iceServerRef")
+	}
+	if err := validateSDPTransforms(req.SDPTransforms); err != nil {
+		return err
+	}
+	if err := req.checkLimits(); err != nil {
+		return err
+	}
+	if err := cfg.Load().checkQuota(req); err != nil {
+		return err
+	}
+	if req.Readers > 1 && req.KeepContinuity {
+		return errors.New("keepContinuity needs a single reader")
+	}
+	if req.RecordPath != "" {
+		if _, err := cfg.Load().recordPath("recordPath", req.RecordPath); err != nil {
+			return err
+		}
+	}
+	if req.VideoPort != 0 && req.VideoPort == req.AudioPort {
+		return fmt.Errorf("videoPort and audioPort must differ, both are %d", req.VideoPort)
+	}
+	if _, err := parseNetworks("sourceAllowlist", req.SourceAllowlist); err != nil {
+		return err
+	}
+	if req.ResourceCheckReconnect && req.ResourceCheckInterval == 0 {
+		return errors.New("resourceCheckReconnect needs resourceCheckInterval")
+	}
+	if req.VideoRTX && req.VideoPort == 0 {
+		return errors.New("videoRtx needs videoPort")
+	}
+	if req.WaitKeyframe > 0 && req.VideoPort == 0 {
+		return errors.New("waitKeyframe needs videoPort")
+	}
+	if req.VideoSSRC != 0 && req.VideoSSRC == req.AudioSSRC {
+		return fmt.Errorf("videoSsrc and audioSsrc must differ, both are %d", req.VideoSSRC)
+	}
+	if err := checkPolicies(req.policies(cfg.Load())); err != nil {
+		return err
+	}
+	if err := validateRewrites(req, codecs); err != nil {
+		return err
+	}
+	if req.VideoRTX {
+		codecs = withVideoRTX(codecs)
+	}
+	if err := checkPayloadTypes(codecs); err != nil {
+		return err
+	}
+	return validateHeaderExtensions(req.HeaderExtensions)
+}
+
+const maxReaders = 16
+
+var h264ProfilePattern = regexp.MustCompile(`^[0-9A-Fa-f]{6}$`)
+
+var bundlePolicies = map[string]webrtc.BundlePolicy{
+	"balanced":   webrtc.BundlePolicyBalanced,
+	"max-compat": webrtc.BundlePolicyMaxCompat,
+	"max-bundle": webrtc.BundlePolicyMaxBundle,
+}
+
+var rtcpMuxPolicies = map[string]webrtc.RTCPMuxPolicy{
+	"negotiate": webrtc.RTCPMuxPolicyNegotiate,
+	"require":   webrtc.RTCPMuxPolicyRequire,
+}
+
+const (
+	defaultBundlePolicy  = "max-bundle"
+	defaultRTCPMuxPolicy = "require"
+)
+
+// policies returns the bundle and RTCP mux policies req asks for, or c's.
+func (req StartRequest) policies(c *Config) (bundle, rtcpMux string) {
+	return cmp.Or(req.BundlePolicy, c.BundlePolicy, defaultBundlePolicy),
+		cmp.Or(req.RTCPMuxPolicy, c.RTCPMuxPolicy, defaultRTCPMuxPolicy)
+}
+
+// checkPolicies rejects unknown policies, and max-bundle with negotiated
+// RTCP mux: BUNDLE requires rtcp-mux (RFC 8843), so a bundled offer can't
+// fall back to separate RTCP candidates.
+func checkPolicies(bundle, rtcpMux string) error {
+	if _, ok := bundlePolicies[bundle]; !ok {
+		return fmt.Errorf("unknown bundlePolicy %q", bundle)
+	}
+	if _, ok := rtcpMuxPolicies[rtcpMux]; !ok {
+		return fmt.Errorf("unknown rtcpMuxPolicy %q", rtcpMux)
+	}
+	if bundle == "max-bundle" && rtcpMux == "negotiate" {
+		return errors.New(`bundlePolicy "max-bundle" needs rtcpMuxPolicy "require"`)
+	}
+	return nil
+}
+
+// checkLimits checks req's numeric fields against their limits. req is a
+// copy, so the defaults filled in along the way are discarded.
+func (req StartRequest) checkLimits() error {
+	videoPort, audioPort := portLimit, portLimit
+	videoPort.name, audioPort.name = "videoPort", "audioPort"
+	for _, f := range []struct {
+		limit intLimit
+		v     *int
+	}{
+		{videoPort, &req.VideoPort},
+		{audioPort, &req.AudioPort},
+		{portRetryLimit, &req.PortRetryCount},
+		{readersLimit, &req.Readers},
+		{maxMalformedLimit, &req.MaxMalformedPackets},
+		{writeQueueLimit, &req.WriteQueue},
+		{paceBitrateLimit, &req.PaceVideoBitrate},
+		{maxBitrateLimit, &req.MaxBitrateKbps},
+		{minVideoKbpsLimit, &req.MinVideoKbps},
+		{minAudioKbpsLimit, &req.MinAudioKbps},
+		{quotaBytesLimit, &req.MaxBytes},
+		{quotaRateLimit, &req.MaxPacketsPerSecond},
+	} {
+		if err := f.limit.apply(f.v); err != nil {
+			return err
+		}
+	}
+	if err := quotaDurationLimit.apply(&req.MaxDuration); err != nil {
+		return err
+	}
+	if err := sourceGapLimit.apply(&req.MaxSourceGap); err != nil {
+		return err
+	}
+	if err := bitrateWindowLimit.apply(&req.BitrateWindow); err != nil {
+		return err
+	}
+	if err := waitKeyframeLimit.apply(&req.WaitKeyframe); err != nil {
+		return err
+	}
+	if err := resourceCheckLimit.apply(&req.ResourceCheckInterval); err != nil {
+		return err
+	}
+	if err := negotiationLimit.apply(&req.NegotiationTimeout); err != nil {
+		return err
+	}
+	return detectWindowLimit.apply(&req.DetectWindow)
+}
+
+// kinds returns the media kinds req enables. A kind is enabled by giving it
+// a non-zero port, or a replayFile to play into it.
+func (req StartRequest) kinds() []webrtc.RTPCodecType {
+	var kinds []webrtc.RTPCodecType
+	replayed, _ := replayKind(req.ReplayFile)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if req.port(kind) != 0 || (req.ReplayFile != "" && kind == replayed) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// port returns the port req gives kind.
+func (req StartRequest) port(kind webrtc.RTPCodecType) int {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return req.AudioPort
+	}
+	return req.VideoPort
+}
+
+// relayOnly reports whether req must use the relay ICE transport policy.
+func (req StartRequest) relayOnly() bool {
+	return req.RelayOnly || cfg.Load().RelayOnly
+}
+
+type MigrateRequest struct {
+	IngestURL string `json:"ingestUrl"`
+}
+
+type TokenRequest struct {
+	BearerToken string `json:"bearerToken"`
+}
+
+type ErrorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+
+	// WHIP holds the WHIP server's response when the failure came from it.
+	WHIP *whipError `json:"whip,omitempty"`
+
+	// Answer describes a WHIP answer that couldn't be applied.
+	Answer *answerError `json:"answer,omitempty"`
+
+	// SessionID is the running session a DUPLICATE_INGEST refers to.
+	SessionID string `json:"sessionId,omitempty"`
+}
+
+type SessionResponse struct {
+	ID        string `json:"id"`
+	IngestURL string `json:"ingestUrl"`
+	VideoPort int    `json:"videoPort"`
+	AudioPort int    `json:"audioPort"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Negotiated is the codec each track agreed on with the WHIP server.
+	Negotiated []NegotiatedCodec `json:"negotiated,omitempty"`
+
+	// Teardown is set by /stop: "complete", or "teardown-failed" when the
+	// WHIP resource couldn't be deleted and is listed in /stats.
+	Teardown string `json:"teardown,omitempty"`
+
+	// Reason is set by /stop: why the session ended, which is "stopped"
+	// unless it was already ending on its own.
+	Reason TeardownReason `json:"reason,omitempty"`
+}
+
+type StatsResponse struct {
+	Sessions []SessionStats `json:"sessions"`
+
+	// TeardownFailed lists the most recent stopped sessions whose WHIP
+	// resource may still exist on the server.
+	TeardownFailed []FailedTeardown `json:"teardownFailed,omitempty"`
+
+	// Ended lists the most recent sessions that ended, and why.
+	Ended []EndedSession `json:"ended,omitempty"`
+
+	// Breakers lists the WHIP hosts with recent consecutive failures.
+	Breakers []BreakerStats `json:"breakers,omitempty"`
+}
+
+type SessionStats struct {
+	ID            string      `json:"id"`
+	IngestURL     string      `json:"ingestUrl"`
+	UptimeSeconds float64     `json:"uptimeSeconds"`
+	Paused        bool        `json:"paused"`
+	MaxBitrate    int         `json:"maxBitrateKbps,omitempty"`
+	Quota         *QuotaStats `json:"quota,omitempty"`
+	Audio         *TrackStats `json:"audio,omitempty"`
+	Video         *TrackStats `json:"video,omitempty"`
+
+	// SourceGapSeconds is how long no RTP has arrived, while that is at
+	// least a second.
+	SourceGapSeconds float64 `json:"sourceGapSeconds,omitempty"`
+
+	// CountersSince is set once the counters were reset with /stats/reset;
+	// they count from then on.
+	CountersSince *time.Time `json:"countersSince,omitempty"`
+}
+
+// FailedTeardown is an upstream whose WHIP DELETE never succeeded.
+type FailedTeardown struct {
+	ID          string    `json:"id"`
+	IngestURL   string    `json:"ingestUrl"`
+	ResourceURL string    `json:"resourceUrl"`
+	Time        time.Time `json:"time"`
+	Error       string    `json:"error"`
+}
+
+const maxFailedTeardowns = 100
+
+type TrackStats struct {
+	Port    int    `json:"port"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+
+	// Malformed counts packets dropped because they weren't valid RTP.
+	Malformed uint64 `json:"malformed"`
+
+	// RTCP counts RTCP packets ffmpeg sent on the port with rtcp-mux.
+	// They are consumed by the relay, not forwarded; see handleRTCP.
+	RTCP uint64 `json:"rtcp"`
+
+	// Stray counts packets dropped because their payload type is the
+	// other track's.
+	Stray uint64 `json:"stray,omitempty"`
+
+	// SRTPFailed counts packets dropped because they failed SRTP
+	// decryption; see the srtp config.
+	SRTPFailed uint64 `json:"srtpFailed,omitempty"`
+
+	// Rewritten counts packets the track's rewrites changed.
+	Rewritten uint64 `json:"rewritten,omitempty"`
+
+	// Foreign counts packets dropped because their source isn't in the
+	// sourceAllowlist.
+	Foreign uint64 `json:"foreign,omitempty"`
+
+	// Nacked counts the packets the receiver asked to be retransmitted,
+	// once per request, so a packet NACKed again counts again.
+	Nacked uint64 `json:"nacked,omitempty"`
+
+	// QueueDrops counts packets dropped from a full writeQueue.
+	QueueDrops uint64 `json:"queueDrops,omitempty"`
+
+	// EstimateKbps is the receiver's latest REMB estimate, if any.
+	EstimateKbps uint64 `json:"estimateKbps,omitempty"`
+
+	// WriteP50Ms and WriteP99Ms estimate the median and 99th percentile
+	// time writing a packet to the PeerConnection took, since the session
+	// started; /metrics has the histogram. High values mean the upstream,
+	// not ffmpeg, is the bottleneck.
+	WriteP50Ms float64 `json:"writeP50Ms"`
+	WriteP99Ms float64 `json:"writeP99Ms"`
+
+	// WindowKbps is the bitrate over the bitrateWindow and LowBitrate
+	// whether it is below the track's minimum; both are only reported with
+	// one.
+	WindowKbps uint64 `json:"windowKbps,omitempty"`
+	LowBitrate bool   `json:"lowBitrate,omitempty"`
+
+	// Frames and FrameRate are only reported for video; see frameCounter.
+	// LowFrameRate is set while FrameRate is below the minFrameRate config
+	// and the session isn't paused.
+	Frames       uint64  `json:"frames,omitempty"`
+	FrameRate    *uint64 `json:"frameRate,omitempty"`
+	LowFrameRate bool    `json:"lowFrameRate,omitempty"`
+}
+
+type HealthResponse struct {
+	Status      string `json:"status"`
+	Sessions    int    `json:"sessions"`
+	MaxSessions int    `json:"maxSessions"`
+}
+
+var (
+	mu       sync.Mutex
+	sessions = make(map[string]*session)
+	starting int // sessions reserved by in-flight /start calls
+
+	// startingIngests counts the in-flight /start calls by ingestKey.
+	startingIngests = make(map[string]int)
+
+	configPath string
+
+	// failedTeardowns is guarded by mu.
+	failedTeardowns []FailedTeardown
+)
+
+// routes registers the HTTP API on mux, with /test/generate in testMode.
+func routes(mux *http.ServeMux, testMode bool) {
+	mux.HandleFunc("/start", requireAuth(startHandler))
+	mux.HandleFunc("POST /probe", requireAuth(probeHandler))
+	mux.HandleFunc("POST /session/{id}/migrate", requireAuth(migrateHandler))
+	mux.HandleFunc("POST /session/{id}/stop", requireAuth(stopHandler))
+	mux.HandleFunc("POST /session/{id}/pause", requireAuth(pauseHandler))
+	mux.HandleFunc("POST /session/{id}/resume", requireAuth(resumeHandler))
+	mux.HandleFunc("GET /sessions", requireAuth(sessionsHandler))
+	mux.HandleFunc("GET /session/{id}", requireAuth(sessionHandler))
+	mux.HandleFunc("GET /session/{id}/events", requireAuth(eventsHandler))
+	mux.HandleFunc("GET /session/{id}/logs", requireAuth(logsHandler))
+	mux.HandleFunc("POST /session/{id}/data", requireAuth(dataHandler))
+	mux.HandleFunc("POST /session/{id}/token", requireAuth(tokenHandler))
+	mux.HandleFunc("POST /session/{id}/keyframe", requireAuth(keyframeHandler))
+	mux.HandleFunc("POST /session/{id}/restart-ice", requireAuth(restartICEHandler))
+	mux.HandleFunc("/stats", requireAuth(statsHandler))
+	mux.HandleFunc("POST /stats/reset", requireAuth(statsResetHandler))
+	mux.HandleFunc("/shutdown", requireAuth(shutdownHandler))
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("GET /codecs", requireAuth(codecsHandler))
+	mux.HandleFunc("POST /reload", requireAuth(reloadHandler))
+	mux.HandleFunc("GET /{$}", requireAuth(uiHandler))
+	mux.HandleFunc("GET /ui/static/", requireAuth(uiAssets.ServeHTTP))
+	if testMode {
+		mux.HandleFunc("POST /test/generate", requireAuth(generateHandler))
+	}
+}
+
+func startHandler(w http.ResponseWriter, r *http.Request) {
+	var req StartRequest
+	if err := decodeStartRequest(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	s, err := start(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.response())
+}
+
+// start starts a session for req within the maxSessions limit and adds it
+// to the running sessions. Invalid requests fail with 400. ctx bounds the
+// start only; the session outlives it.
+func start(ctx context.Context, req StartRequest) (*session, error) {
+	if err := req.validate(); err != nil {
+		return nil, newRelayError(CodeBadRequest, http.StatusBadRequest, err)
+	}
+
+	key := ingestKey(req.IngestURL)
+	if err := checkDuplicateIngest(key, req.Replace); err != nil {
+		return nil, err
+	}
+
+	// Reserve a slot up front so concurrent starts can't overshoot the limit
+	// while they negotiate.
+	mu.Lock()
+	if cfg.Load().RejectDuplicateIngest && startingIngests[key] > 0 {
+		mu.Unlock()
+		return nil, newRelayError(CodeDuplicateIngest, http.StatusConflict, &duplicateIngestError{})
+	}
+	limit := cfg.Load().MaxSessions
+	if len(sessions)+starting >= limit {
+		mu.Unlock()
+		return nil, newRelayError(CodeSessionLimit, http.StatusServiceUnavailable,
+			fmt.Errorf("session limit reached (%d/%d)", limit, limit))
+	}
+	starting++
+	startingIngests[key]++
+	mu.Unlock()
+
+	s, err := startSession(ctx, req)
+
+	mu.Lock()
+	starting--
+	if startingIngests[key]--; startingIngests[key] == 0 {
+		delete(startingIngests, key)
+	}
+	// A session that hit its quota while negotiating has already ended.
+	if err == nil && !s.closed.Load() {
+		sessions[s.id] = s
+	}
+	mu.Unlock()
+	return s, err
+}
+
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	var req MigrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IngestURL == "" {
+		writeError(w, errBadRequest)
+		return
+	}
+
+	if err := s.migrate(r.Context(), req.IngestURL); err != nil {
+		writeError(w, fmt.Errorf("migration failed: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.response())
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.BearerToken == "" {
+		writeError(w, errBadRequest)
+		return
+	}
+
+	s.setBearerToken(req.BearerToken)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func stopHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	s := sessions[r.PathValue("id")]
+	delete(sessions, r.PathValue("id"))
+	mu.Unlock()
+
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	resp := s.response()
+	resp.Teardown = "complete"
+	if err := s.close(TeardownStopped, ""); err != nil {
+		resp.Teardown = "teardown-failed"
+	}
+	resp.Reason = s.endReason()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pauseHandler and resumeHandler toggle relaying for a session. Both are
+// idempotent and return the session's stats.
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	s.pause()
+	writeJSON(w, http.StatusOK, s.stats())
+}
+
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	s.resume()
+	writeJSON(w, http.StatusOK, s.stats())
+}
+
+// maxDataMessage keeps data channel messages within what SCTP peers accept
+// without negotiating a larger size.
+const maxDataMessage = 64 << 10
+
+// dataHandler sends the request body on the session's data channel. Bodies
+// with a text/* or JSON content type go out as text messages, anything else
+// as binary.
+func dataHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	msg, err := readBody(r.Body, maxDataMessage)
+	if err != nil {
+		writeError(w, newRelayError(CodeBadRequest, http.StatusRequestEntityTooLarge, err))
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	if err := s.sendData(msg, strings.HasPrefix(ct, "text/") || isJSON(ct)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func keyframeHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	resp, err := s.requestKeyframe()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func restartICEHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	resp, err := s.restartICE(r.Context())
+	if err != nil {
+		writeError(w, fmt.Errorf("ice restart failed: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	list := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	failed := slices.Clone(failedTeardowns)
+	ended := slices.Clone(endedSessions)
+	mu.Unlock()
+
+	resp := StatsResponse{
+		Sessions:       make([]SessionStats, 0, len(list)),
+		TeardownFailed: failed,
+		Ended:          ended,
+		Breakers:       breakerStats(),
+	}
+	for _, s := range list {
+		resp.Sessions = append(resp.Sessions, s.stats())
+	}
+	slices.SortFunc(resp.Sessions, func(a, b SessionStats) int {
+		return cmp.Compare(b.UptimeSeconds, a.UptimeSeconds)
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	n := len(sessions)
+	mu.Unlock()
+
+	writeJSON(w, http.StatusOK, HealthResponse{
+		Status:      "ok",
+		Sessions:    n,
+		MaxSessions: cfg.Load().MaxSessions,
+	})
+}
+
+// reloadHandler re-reads the config file and environment. Running sessions
+// keep the settings they started with.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := loadConfig(configPath)
+	if err != nil {
+		writeError(w, newRelayError(CodeConfigInvalid, http.StatusInternalServerError, err))
+		return
+	}
+	cfg.Store(c)
+
+	log.Printf("Reloaded config: maxSessions=%d", c.MaxSessions)
+	writeJSON(w, http.StatusOK, c.summary())
+}
+
+// ShutdownRequest must be POSTed to /shutdown with Confirm set, so a stray
+// GET such as a link prefetch can't stop the server.
+type ShutdownRequest struct {
+	Confirm bool `json:"confirm"`
+}
+
+func shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	var req ShutdownRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || !req.Confirm {
+		writeError(w, newRelayError(CodeBadRequest, http.StatusBadRequest,
+			errors.New(`shutdown needs a POST with body {"confirm": true}`)))
+		return
+	}
+
+	who := r.RemoteAddr
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		who += " (forwarded for " + fwd + ")"
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		who += " as " + user
+	}
+	log.Printf("Shutting down Pion server, requested by %s with %q", who, r.UserAgent())
+	w.Write([]byte("Relay server shutting down"))
+	go shutdown(ShutdownExplicit)
+}
+
+// Reasons for a shutdown, as reported in ShutdownEvent.
+const (
+	ShutdownSignal      = "signal"
+	ShutdownExplicit    = "explicit"
+	ShutdownIdleTimeout = "idle-timeout"
+)
+
+// stopped is closed once a shutdown has torn every session down, for the
+// process to exit on; see Stopped.
+var (
+	stopped     = make(chan struct{})
+	stoppedOnce sync.Once
+)
+
+// shutdown tears down every session in parallel, each bounded by the
+// teardown timeout, reports them to the webhook and closes stopped.
+func shutdown(reason string) {
+	mu.Lock()
+	all := slices.Collect(maps.Values(sessions))
+	clear(sessions)
+	mu.Unlock()
+
+	ev := ShutdownEvent{
+		Event:    "server.shutdown",
+		Reason:   reason,
+		Sessions: make([]ShutdownSession, len(all)),
+	}
+	var wg sync.WaitGroup
+	for i, s := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ss := ShutdownSession{ID: s.id, IngestURL: redactURL(s.ingestURL()), Teardown: "complete"}
+			if err := s.close(TeardownShutdown, reason); err != nil {
+				ss.Teardown, ss.Error = "teardown-failed", err.Error()
+			}
+			ev.Sessions[i] = ss
+		}()
+	}
+	wg.Wait()
+	ev.Time = time.Now()
+	postShutdownWebhook(ev)
+	stoppedOnce.Do(func() { close(stopped) })
+}
+
+// watchIdle shuts the server down once it has had no sessions, and no
+// /start in flight, for the idle timeout: override if non-zero, otherwise
+// the configured one, re-read on every check so /reload applies. It
+// returns once it has.
+func watchIdle(override time.Duration) {
+	idleSince := time.Now()
+	for range time.Tick(time.Second) {
+		mu.Lock()
+		busy := len(sessions)+starting > 0
+		mu.Unlock()
+		if busy {
+			idleSince = time.Now()
+			continue
+		}
+
+		timeout := override
+		if timeout == 0 {
+			timeout = time.Duration(cfg.Load().IdleTimeout)
+		}
+		if timeout > 0 && time.Since(idleSince) >= timeout {
+			log.Printf("No sessions for %s, shutting down", timeout)
+			shutdown(ShutdownIdleTimeout)
+			return
+		}
+	}
+}
+
+// end removes s from the running sessions and tears it down, for a
+// session that stops on its own rather than through /stop.
+func (s *session) end(reason TeardownReason, detail string) {
+	mu.Lock()
+	if sessions[s.id] == s {
+		delete(sessions, s.id)
+	}
+	mu.Unlock()
+	s.close(reason, detail)
+}
+
+// endReason is why s ended, or "" while it runs.
+func (s *session) endReason() TeardownReason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ended
+}
+
+func lookupSession(id string) *session {
+	mu.Lock()
+	defer mu.Unlock()
+	return sessions[id]
+}
+
+// runOnce relays req until the process is interrupted, then tears the
+// session down. It is the command-line equivalent of a /start call. With
+// generate, the tracks are fed by the test generator.
+func runOnce(req StartRequest, generate bool) {
+	s, err := startSession(context.Background(), req)
+	if err != nil {
+		log.Fatalf("Failed to start relay: %v", err)
+	}
+	status, _ := json.Marshal(s.response())
+	fmt.Printf("Relay started: %s\n", status)
+	if generate {
+		if err := s.generateAll(context.Background()); err != nil {
+			s.end(TeardownStartFailed, "generator failed to start")
+			log.Fatalf("Failed to start generator: %v", err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+		s.close(TeardownShutdown, "interrupted")
+	case <-s.done:
+	}
+	fmt.Printf("Relay %s stopped\n", s.id)
+}
+
+func (s *session) response() SessionResponse {
+	s.mu.Lock()
+	negotiated := s.up.negotiated
+	s.mu.Unlock()
+	return SessionResponse{
+		ID:         s.id,
+		IngestURL:  s.ingestURL(),
+		VideoPort:  s.port(webrtc.RTPCodecTypeVideo),
+		AudioPort:  s.port(webrtc.RTPCodecTypeAudio),
+		Labels:     s.labels,
+		Negotiated: negotiated,
+	}
+}
+
+// rawStats reports the session's counters since it started; see stats.
+func (s *session) rawStats() SessionStats {
+	st := SessionStats{
+		ID:            s.id,
+		IngestURL:     s.ingestURL(),
+		UptimeSeconds: time.Since(s.startedAt).Seconds(),
+		Paused:        s.paused.Load(),
+		MaxBitrate:    s.maxBitrate,
+		Quota:         s.quota.stats(time.Since(s.startedAt)),
+	}
+	if gap := s.sourceGap(time.Now()); gap >= sourceGapNotice {
+		st.SourceGapSeconds = gap.Seconds()
+	}
+	if s.audio != nil {
+		st.Audio = s.audio.trackStats()
+	}
+	if s.video != nil {
+		st.Video = s.video.trackStats()
+		fps := s.video.frames.rate(time.Now())
+		st.Video.Frames = s.video.frames.frames.Load()
+		st.Video.FrameRate = &fps
+		// Give the source its first second before judging its rate.
+		minRate := uint64(cfg.Load().MinFrameRate)
+		st.Video.LowFrameRate = minRate > 0 && fps < minRate && !st.Paused && st.UptimeSeconds >= 2
+	}
+	return st
+}
+
+func (mt *mediaTrack) trackStats() *TrackStats {
+	st := &TrackStats{
+		Port:       mt.port,
+		Packets:    mt.stats.packets.Load(),
+		Bytes:      mt.stats.bytes.Load(),
+		Malformed:  mt.stats.malformed.Load(),
+		RTCP:       mt.stats.rtcp.Load(),
+		Stray:      mt.stats.stray.Load(),
+		SRTPFailed: mt.stats.srtpFailed.Load(),
+		Rewritten:  mt.stats.rewritten.Load(),
+		Foreign:    mt.stats.foreign.Load(),
+		Nacked:     mt.stats.nacked.Load(),
+
+		EstimateKbps: mt.stats.estimate.Load() / 1000,
+
+		WriteP50Ms: mt.writeLatency.quantile(0.5).Seconds() * 1000,
+		WriteP99Ms: mt.writeLatency.quantile(0.99).Seconds() * 1000,
+	}
+	if mt.minKbps > 0 {
+		st.WindowKbps = mt.windowKbps.Load()
+		st.LowBitrate = mt.lowBitrate.Load()
+	}
+	if mt.queue != nil {
+		st.QueueDrops = mt.queue.drops.Load()
+	}
+	return st
+}
+
+// port returns the RTP port for kind, or 0 if the kind is disabled.
+func (s *session) port(kind webrtc.RTPCodecType) int {
+	if mt := s.mediaTrack(kind); mt != nil {
+		return mt.port
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	re := newRelayError(CodeInternal, http.StatusInternalServerError, err)
+	errors.As(err, &re)
+
+	resp := ErrorResponse{Code: re.Code, Error: err.Error()}
+	errors.As(err, &resp.WHIP)
+	errors.As(err, &resp.Answer)
+	var dup *duplicateIngestError
+	if errors.As(err, &dup) {
+		resp.SessionID = dup.sessionID
+	}
+	writeJSON(w, re.Status, resp)
+}
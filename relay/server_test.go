@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartWithoutTracks(t *testing.T) {
+	var offers int
+	whip := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offers++
+		http.Error(w, "unexpected offer", http.StatusInternalServerError)
+	}))
+	defer whip.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"no ports", "application/json", `{"ingestUrl": "` + whip.URL + `"}`},
+		{"zero ports", "application/json", `{"ingestUrl": "` + whip.URL + `", "videoPort": 0, "audioPort": 0}`},
+		{"only audio options", "application/json", `{"ingestUrl": "` + whip.URL + `", "audioSsrc": 1234}`},
+		{"form", "application/x-www-form-urlencoded", "ingestUrl=" + whip.URL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/start", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			startHandler(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != CodeBadRequest || resp.Error != errNoTracks.Error() {
+				t.Errorf("response = %s %q, want %s %q", resp.Code, resp.Error, CodeBadRequest, errNoTracks)
+			}
+		})
+	}
+
+	if offers != 0 {
+		t.Errorf("WHIP server got %d offers, want none", offers)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) != 0 || starting != 0 {
+		t.Errorf("%d sessions and %d starting after rejected starts", len(sessions), starting)
+	}
+}
+
+func TestStartBodyTooLarge(t *testing.T) {
+	padding := strings.Repeat(" ", maxFormBytes)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"json", "application/json", `{"videoPort": 5004` + padding + `}`},
+		{"no content type", "", `{"videoPort": 5004` + padding + `}`},
+		{"form", "application/x-www-form-urlencoded", "videoPort=5004&labels=" + padding},
+		{"multipart", "multipart/form-data; boundary=b", "--b\r\nContent-Disposition: form-data; name=\"labels\"\r\n\r\n" + padding + "\r\n--b--\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call(http.MethodPost, "/start", tt.contentType, tt.body)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+			}
+		})
+	}
+}
+
+// TestShutdownReturns checks that POST /shutdown tears the sessions down
+// and closes Stopped without exiting, leaving that to the embedder.
+func TestShutdownReturns(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	endSessions(t)
+	id := startOK(t, startBody(t, newWHIPServer(t, fixture(t, "janus-answer.sdp")).URL, ""))
+
+	w := call(http.MethodPost, "/shutdown", "application/json", `{"confirm": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("shutdown: %d %s", w.Code, w.Body)
+	}
+	select {
+	case <-Stopped():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stopped not closed after /shutdown")
+	}
+	if s := lookupSession(id); s != nil {
+		t.Errorf("session %s still running after shutdown", id)
+	}
+}
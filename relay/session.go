@@ -0,0 +1,1130 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// session is a running relay. It owns the ffmpeg-facing tracks and UDP
+// listeners, which live for the whole session, and the current upstream,
+// which can be replaced while the session keeps running.
+type session struct {
+	id         string
+	startedAt  time.Time
+	codecs     []codec
+	extensions []HeaderExtension
+	iceServers []webrtc.ICEServer
+	icePolicy  webrtc.ICETransportPolicy
+	bundle     webrtc.BundlePolicy
+	rtcpMux    webrtc.RTCPMuxPolicy
+	dscp       int
+	audioFEC   bool
+	videoRTX   bool
+
+	// negotiationTimeout bounds each negotiate.
+	negotiationTimeout time.Duration
+
+	// h264Profile, if set, is the profile-level-id H.264 has to be
+	// negotiated with.
+	h264Profile string
+	relay       relayOptions
+	events      eventLog
+	logs        logRing
+
+	// dataChannel is the label of the data channel negotiated with every
+	// upstream, or empty for none.
+	dataChannel string
+
+	// transforms are the server config's SDP transforms followed by the
+	// request's.
+	transforms []SDPTransform
+
+	// maxBitrate is the video cap in kbps advertised with b=AS, or 0.
+	maxBitrate int
+
+	quota *quota
+
+	// statsMu guards statsBase, the counters at the last /stats/reset or
+	// nil before one, and statsResetAt, when it was.
+	statsMu      sync.Mutex
+	statsBase    *SessionStats
+	statsResetAt time.Time
+
+	// closed makes close run once, however many ways the session ends, and
+	// done is closed when it does.
+	closed atomic.Bool
+	done   chan struct{}
+
+	// labels are the StartRequest's, and logLabels them as formatLabels
+	// renders them for log lines.
+	labels    map[string]string
+	logLabels string
+
+	// ended is why the session ended, once close has run; guarded by mu.
+	ended TeardownReason
+
+	// deadline ends the session at its maxDuration quota.
+	deadline *time.Timer
+
+	// lastRTP is when the latest RTP packet of any kind arrived, in Unix
+	// nanoseconds, or when the session started; inGap is set while the
+	// watchdog reports no RTP. See watchSource.
+	lastRTP atomic.Int64
+	inGap   atomic.Bool
+
+	// paused makes the relay loops drop packets while the upstream stays
+	// connected, so resuming is instant.
+	paused atomic.Bool
+
+	// audio and video are nil when the kind is disabled.
+	audio *mediaTrack
+	video *mediaTrack
+
+	mu sync.Mutex
+	up *upstream
+
+	// switching makes migrate, restartICE and the resource check's
+	// reconnect take turns, so only one at a time replaces up.
+	switching sync.Mutex
+
+	// token is the WHIP bearer token, sent on every request to the WHIP
+	// server. It can be rotated while the session runs.
+	token string
+}
+
+// mediaTrack is one relayed kind: the UDP port ffmpeg sends to, the local
+// track every upstream carries, and the state the relay loop keeps for it.
+type mediaTrack struct {
+	kind  webrtc.RTPCodecType
+	port  int
+	local *codecTrack
+	stats trackStats
+
+	// frames counts video frames; it is unused for audio.
+	frames frameCounter
+
+	// source is where the latest RTP packet came from, and sourceSSRC
+	// its SSRC; requestKeyframe addresses its PLI with them.
+	source     atomic.Pointer[net.UDPAddr]
+	sourceSSRC atomic.Uint32
+
+	// payloadType is the PT of the track's first codec in our offer, which
+	// ffmpeg is expected to send unless several are offered.
+	payloadType uint8
+	clockRate   uint32
+
+	// sourcePT is the payload type of the latest packet naming one of
+	// several offered codecs, or zero before any; offered PTs are dynamic.
+	sourcePT atomic.Uint32
+
+	// strayPTs are the payload types of the session's codecs of the other
+	// kind. Packets with one of them on this port were meant for the other
+	// track, which happens when ffmpeg sends both streams to one port.
+	strayPTs []uint8
+
+	// minKbps, if set, is the bitrate below which watchBitrate flags the
+	// track; windowKbps and lowBitrate are what it last measured.
+	minKbps    uint64
+	windowKbps atomic.Uint64
+	lowBitrate atomic.Bool
+
+	// sources, if set, are the addresses RTP is accepted from; the port is
+	// then bound on every interface.
+	sources sourceFilter
+
+	// srtp, if set, decrypts what ffmpeg sends to port; see SRTPConfig.
+	srtp *srtpReader
+
+	// queue, if set, sits between the relay loops and writing to local.
+	queue *writeQueue
+
+	// pacer, if set, smooths what the relay loops write to local.
+	pacer *pacer
+
+	// keyframe is closed by the first keyframe written to local while
+	// awaitKeyframe is set; it is nil unless the session waits for one.
+	keyframe      chan struct{}
+	awaitKeyframe atomic.Bool
+
+	// writeLatency times the writes to local.
+	writeLatency latencyHistogram
+
+	// ssrc, if non-zero, is the SSRC every binding of local sends with.
+	ssrc webrtc.SSRC
+
+	// rewrite, if set, is applied to every packet read; see RTPRewrite.
+	rewrite *rewriteTable
+
+	// recorder, if set, gets a copy of every packet written to local.
+	recorder *recorder
+
+	// replay, if set, is played into local instead of relaying RTP from
+	// the port, which isn't bound.
+	replay *replay
+
+	// extensions rewrites incoming header extension IDs to the negotiated
+	// ones. It is nil when the session doesn't remap extensions.
+	extensions atomic.Pointer[extensionMap]
+
+	conn *net.UDPConn // guarded by session.mu, nil once dropped
+
+	// readerConns are the SO_REUSEPORT sockets on conn's port for the
+	// readers after the first. Guarded by session.mu, nil once dropped.
+	readerConns []*net.UDPConn
+}
+
+// takeConns returns mt's sockets and forgets them. session.mu must be
+// held.
+func (mt *mediaTrack) takeConns() []*net.UDPConn {
+	if mt.conn == nil {
+		return nil
+	}
+	conns := append([]*net.UDPConn{mt.conn}, mt.readerConns...)
+	mt.conn, mt.readerConns = nil, nil
+	return conns
+}
+
+// upstream is a single negotiated PeerConnection to a WHIP server.
+type upstream struct {
+	ingestURL   string
+	resourceURL string
+	pc          *webrtc.PeerConnection
+	whipStatus  int
+
+	// rejected lists the kinds the WHIP answer declined to receive.
+	rejected []webrtc.RTPCodecType
+
+	// negotiated is the codec each sending track agreed on.
+	negotiated []NegotiatedCodec
+
+	// iceGrace runs out the iceDisconnectGrace config while ICE is
+	// disconnected. Guarded by session.mu.
+	iceGrace *time.Timer
+
+	// dc is the session's data channel on this PeerConnection, if any.
+	dc *webrtc.DataChannel
+
+	// transforms are applied to the offer before it is POSTed.
+	transforms []SDPTransform
+
+	// logf logs for the session the upstream belongs to.
+	logf func(format string, args ...any)
+
+	// candidates are the local ICE candidates of the latest gathering.
+	candidatesMu sync.Mutex
+	candidates   []LocalCandidate
+}
+
+// errNoTracks is returned when a StartRequest enables neither audio nor
+// video, which would negotiate an offer without media.
+var errNoTracks = errors.New("no tracks to relay: set videoPort and/or audioPort")
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSession creates the tracks, starts the UDP listeners and negotiates
+// the first upstream for req. If ctx is done first, the STUN precheck,
+// negotiation or wait for a keyframe is cut short and the start fails.
+func startSession(ctx context.Context, req StartRequest) (*session, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Load().checkIngestURL(req.IngestURL); err != nil {
+		return nil, err
+	}
+	codecs, _ := selectCodecs(req.CodecAllowlist, req.kinds())
+	codecs, _ = withClockRates(codecs, req.ClockRates)
+	codecs, _ = withPreference(codecs, req.CodecPreference)
+	codecs = req.withOptions(codecs)
+	iceServers, _ := cfg.Load().iceServers(req.ICEServerRef)
+	bundle, rtcpMux := req.policies(cfg.Load())
+
+	s := &session{
+		id:          newSessionID(),
+		startedAt:   time.Now(),
+		codecs:      codecs,
+		extensions:  req.HeaderExtensions,
+		iceServers:  iceServers,
+		icePolicy:   webrtc.ICETransportPolicyAll,
+		bundle:      bundlePolicies[bundle],
+		rtcpMux:     rtcpMuxPolicies[rtcpMux],
+		dscp:        cfg.Load().DSCP,
+		audioFEC:    req.AudioFEC,
+		videoRTX:    req.VideoRTX,
+		h264Profile: strings.ToLower(req.H264Profile),
+
+		negotiationTimeout: req.NegotiationTimeout.or(time.Duration(cfg.Load().NegotiationTimeout)),
+
+		labels:      req.Labels,
+		logLabels:   formatLabels(req.Labels),
+		dataChannel: req.DataChannel,
+		token:       cmp.Or(req.BearerToken, cfg.Load().WHIPToken),
+		transforms:  slices.Concat(cfg.Load().SDPTransforms, req.SDPTransforms),
+		maxBitrate:  req.MaxBitrateKbps,
+		quota:       newQuota(req, cfg.Load()),
+		done:        make(chan struct{}),
+		relay: relayOptions{
+			stripPadding: req.StripPadding,
+			continuity:   req.KeepContinuity,
+			readers:      max(req.Readers, 1),
+			maxMalformed: req.MaxMalformedPackets,
+		},
+	}
+	s.lastRTP.Store(s.startedAt.UnixNano())
+	if req.relayOnly() {
+		s.icePolicy = webrtc.ICETransportPolicyRelay
+	}
+	s.event("created", "ingest=%s video=%d audio=%d", redactURL(req.IngestURL), req.VideoPort, req.AudioPort)
+	if s.maxBitrate > 0 {
+		s.transforms = append(s.transforms, SDPTransform{Kind: "video", BandwidthKbps: s.maxBitrate})
+	}
+
+	if req.STUNPrecheck {
+		if err := s.stunPrecheck(ctx); err != nil {
+			s.event("ice", "precheck failed: %v", err)
+			return nil, err
+		}
+	}
+
+	if req.DetectCodecs {
+		codecs = s.detectCodecs(req, codecs)
+		s.codecs = codecs
+	}
+
+	// Create tracks and bind ports
+	var err error
+	kinds := req.kinds()
+	if slices.Contains(kinds, webrtc.RTPCodecTypeAudio) {
+		if s.audio, err = newMediaTrack(webrtc.RTPCodecTypeAudio, req.AudioPort, codecs); err != nil {
+			return nil, fmt.Errorf("failed audio track: %w", err)
+		}
+		s.audio.ssrc = webrtc.SSRC(req.AudioSSRC)
+	}
+	if slices.Contains(kinds, webrtc.RTPCodecTypeVideo) {
+		if s.video, err = newMediaTrack(webrtc.RTPCodecTypeVideo, req.VideoPort, codecs); err != nil {
+			return nil, fmt.Errorf("failed video track: %w", err)
+		}
+		s.video.ssrc = webrtc.SSRC(req.VideoSSRC)
+		if req.PaceVideoBitrate > 0 {
+			s.video.pacer = newPacer(req.PaceVideoBitrate)
+		}
+	}
+
+	if len(req.SourceAllowlist) > 0 {
+		sources, _ := parseNetworks("sourceAllowlist", req.SourceAllowlist)
+		for _, mt := range s.media() {
+			mt.sources = sources
+		}
+	}
+
+	for _, rw := range req.Rewrites {
+		mt := s.mediaTrack(webrtc.NewRTPCodecType(rw.Kind))
+		mt.rewrite = newRewriteTable(rw)
+		if rw.SSRC != 0 {
+			mt.ssrc = webrtc.SSRC(rw.SSRC)
+		}
+	}
+
+	if req.RecordPath != "" {
+		dir, _ := cfg.Load().recordPath("recordPath", req.RecordPath)
+		for _, mt := range s.media() {
+			if mt.recorder, err = newRecorder(dir, s.id, mt, codecs); err != nil {
+				s.close(TeardownStartFailed, "")
+				return nil, err
+			}
+		}
+	}
+
+	if req.ReplayFile != "" {
+		kind, _ := replayKind(req.ReplayFile)
+		mt := s.mediaTrack(kind)
+		path, _ := cfg.Load().recordPath("replayFile", req.ReplayFile)
+		if mt.replay, err = openReplay(path, mt); err != nil {
+			s.close(TeardownStartFailed, "")
+			return nil, err
+		}
+	}
+
+	// Bind every RTP port before negotiating, so a port that's already in
+	// use fails the start instead of leaving a session with no media path.
+	for _, mt := range s.media() {
+		if mt.replay != nil {
+			continue
+		}
+		if err := s.listen(mt, req.PortRetryCount); err != nil {
+			s.close(TeardownStartFailed, "")
+			return nil, err
+		}
+	}
+
+	if req.WaitKeyframe > 0 {
+		s.video.keyframe = make(chan struct{})
+	}
+
+	// Listen for RTP from ffmpeg
+	for _, mt := range s.media() {
+		if mt.replay != nil {
+			continue
+		}
+		conns := append([]*net.UDPConn{mt.conn}, mt.readerConns...)
+		if req.WriteQueue > 0 {
+			mt.queue = newWriteQueue(req.WriteQueue)
+			go s.drainQueue(conns, mt)
+		}
+		for i := range s.relay.readers {
+			go relayRTP(conns[i%len(conns)], s, mt)
+		}
+	}
+
+	s.up, err = s.negotiate(ctx, req.IngestURL)
+	if err != nil {
+		s.close(TeardownStartFailed, "")
+		return nil, err
+	}
+	for _, mt := range s.media() {
+		if mt.replay != nil {
+			go s.replay(mt)
+		}
+	}
+	if d := s.quota.maxDuration; d > 0 {
+		s.mu.Lock()
+		s.deadline = time.AfterFunc(max(d-time.Since(s.startedAt), 0), func() {
+			s.event("quota", "max duration %s reached", d)
+			s.end(TeardownMaxDuration, fmt.Sprintf("ran for %s", d))
+		})
+		s.mu.Unlock()
+	}
+	if req.MaxSourceGap > 0 {
+		go s.watchSource(time.Duration(req.MaxSourceGap))
+	}
+	if s.audio != nil {
+		s.audio.minKbps = uint64(req.MinAudioKbps)
+	}
+	if s.video != nil {
+		s.video.minKbps = uint64(req.MinVideoKbps)
+	}
+	if req.MinAudioKbps > 0 || req.MinVideoKbps > 0 {
+		go s.watchBitrate(req.BitrateWindow.or(defaultBitrateWindow).Round(time.Second))
+	}
+	if d := time.Duration(req.ResourceCheckInterval); d > 0 {
+		go s.watchResource(d, req.ResourceCheckReconnect)
+	}
+	if d := time.Duration(req.WaitKeyframe); d > 0 {
+		// Keyframes written before the WHIP server answered went nowhere.
+		s.video.awaitKeyframe.Store(true)
+		if err := s.waitKeyframe(ctx, d); err != nil {
+			s.close(TeardownStartFailed, "no keyframe")
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// migrate negotiates a new upstream to ingestURL and swaps it in. The tracks
+// are shared between the old and new PeerConnection, so the RTP read loops
+// keep writing without interruption; once the switch is done the old
+// upstream is torn down. ctx bounds the negotiation like negotiate's.
+func (s *session) migrate(ctx context.Context, ingestURL string) error {
+	s.switching.Lock()
+	defer s.switching.Unlock()
+	return s.swapUpstream(ctx, ingestURL)
+}
+
+// swapUpstream is migrate with s.switching held.
+func (s *session) swapUpstream(ctx context.Context, ingestURL string) error {
+	if err := cfg.Load().checkIngestURL(ingestURL); err != nil {
+		return err
+	}
+	up, err := s.negotiate(ctx, ingestURL)
+	if err != nil {
+		s.event("migration", "to %s failed: %v", redactURL(ingestURL), err)
+		return err
+	}
+
+	// close sets closed before it takes s.mu to read s.up, so once the
+	// swap is done close is sure to tear down the new upstream; a session
+	// that already ended leaves it to us.
+	s.mu.Lock()
+	ended := s.closed.Load()
+	old := s.up
+	if !ended {
+		s.up = up
+	}
+	s.mu.Unlock()
+
+	tctx, cancel := teardownContext()
+	defer cancel()
+	if ended {
+		s.closeUpstream(tctx, up)
+		return newRelayError(CodeSessionNotFound, http.StatusNotFound, errors.New("session ended during the migration"))
+	}
+	s.event("migration", "%s -> %s", redactURL(old.ingestURL), redactURL(ingestURL))
+	s.closeUpstream(tctx, old)
+	return nil
+}
+
+// newMediaTrack creates the local track for kind, offering every selected
+// codec of that kind. The first is the one ffmpeg is expected to send
+// unless the WHIP server picks another.
+func newMediaTrack(kind webrtc.RTPCodecType, port int, codecs []codec) (*mediaTrack, error) {
+	var strayPTs []uint8
+	for _, c := range codecs {
+		if c.kind != kind {
+			strayPTs = append(strayPTs, uint8(c.params.PayloadType))
+		}
+	}
+	local, err := newCodecTrack(kind, codecs)
+	if err != nil {
+		return nil, err
+	}
+	first := local.codecs[0].params
+	return &mediaTrack{
+		kind:        kind,
+		port:        port,
+		local:       local,
+		payloadType: uint8(first.PayloadType),
+		clockRate:   first.ClockRate,
+		strayPTs:    strayPTs,
+	}, nil
+}
+
+// media returns the session's enabled tracks.
+func (s *session) media() []*mediaTrack {
+	var media []*mediaTrack
+	for _, mt := range []*mediaTrack{s.audio, s.video} {
+		if mt != nil {
+			media = append(media, mt)
+		}
+	}
+	return media
+}
+
+func (s *session) mediaTrack(kind webrtc.RTPCodecType) *mediaTrack {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return s.audio
+	}
+	return s.video
+}
+
+// listen binds mt's UDP port. If it is in use, up to retries ports above
+// it are tried in turn, and mt.port becomes the one bound.
+func (s *session) listen(mt *mediaTrack, retries int) error {
+	reader, err := newSRTPReader(cfg.Load().SRTP)
+	if err != nil {
+		return err
+	}
+	sockets := 1
+	if reusePortSupported {
+		sockets = s.relay.readers
+	}
+	var conns []*net.UDPConn
+	port := mt.port
+	for {
+		conns, err = listenRTP(port, reader != nil, mt.sources != nil, sockets)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || port-mt.port >= retries || port == 65535 {
+			break
+		}
+		port++
+	}
+	if err != nil {
+		if port != mt.port {
+			err = fmt.Errorf("failed to listen on UDP %d-%d: %w", mt.port, port, err)
+		} else {
+			err = fmt.Errorf("failed to listen on UDP %d: %w", port, err)
+		}
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return newRelayError(CodePortInUse, http.StatusConflict, err)
+		}
+		return err
+	}
+	if port != mt.port {
+		s.event("port", "%s port %d is in use, listening on %d instead", mt.kind, mt.port, port)
+		mt.port = port
+	}
+
+	mt.srtp = reader
+	s.mu.Lock()
+	mt.conn, mt.readerConns = conns[0], conns[1:]
+	s.mu.Unlock()
+	return nil
+}
+
+// pause stops forwarding RTP upstream without renegotiating. Pausing a
+// paused session does nothing.
+func (s *session) pause() {
+	if s.paused.CompareAndSwap(false, true) {
+		s.event("paused", "relaying paused")
+	}
+}
+
+// resume undoes pause.
+func (s *session) resume() {
+	if s.paused.CompareAndSwap(true, false) {
+		s.event("resumed", "relaying resumed")
+	}
+}
+
+// sendData writes msg to the current upstream's data channel, as a text
+// message if text is set and as binary otherwise.
+func (s *session) sendData(msg []byte, text bool) error {
+	s.mu.Lock()
+	dc := s.up.dc
+	s.mu.Unlock()
+
+	if dc == nil {
+		return newRelayError(CodeBadRequest, http.StatusBadRequest, errors.New("session has no data channel"))
+	}
+	if state := dc.ReadyState(); state != webrtc.DataChannelStateOpen {
+		return newRelayError(CodeDataChannelNotOpen, http.StatusConflict, fmt.Errorf("data channel is %s", state))
+	}
+	if text {
+		return dc.SendText(string(msg))
+	}
+	return dc.Send(msg)
+}
+
+// drop stops listening for kind, freeing its UDP port.
+func (s *session) drop(kind webrtc.RTPCodecType) {
+	mt := s.mediaTrack(kind)
+	if mt == nil {
+		return
+	}
+
+	s.mu.Lock()
+	conns := mt.takeConns()
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if len(conns) > 0 {
+		s.event("dropped", "%s track rejected by WHIP answer, freed %s", kind, conns[0].LocalAddr())
+	}
+	if mt.recorder != nil {
+		mt.recorder.close()
+	}
+}
+
+// close stops the UDP listeners and tears down the current upstream.
+// reason and detail are recorded as the session's teardown event and in
+// endedSessions. Local resources are always freed; the error reports a
+// WHIP resource that couldn't be deleted.
+func (s *session) close(reason TeardownReason, detail string) error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer close(s.done)
+	ctx, cancel := teardownContext()
+	defer cancel()
+
+	s.mu.Lock()
+	s.ended = reason
+	if s.deadline != nil {
+		s.deadline.Stop()
+	}
+	up := s.up
+	var conns []*net.UDPConn
+	for _, mt := range s.media() {
+		conns = append(conns, mt.takeConns()...)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	s.logf("teardown: closed %d sockets", len(conns))
+	for _, mt := range s.media() {
+		if mt.recorder != nil {
+			mt.recorder.close()
+		}
+		if mt.replay != nil {
+			mt.replay.file.Close()
+		}
+	}
+	var err error
+	if up != nil {
+		err = s.closeUpstream(ctx, up)
+	}
+	if detail != "" {
+		s.event("teardown", "%s: %s", reason, detail)
+	} else {
+		s.event("teardown", "%s", reason)
+	}
+	ended := EndedSession{ID: s.id, Reason: reason, Detail: detail, Time: time.Now()}
+	if up != nil {
+		ended.IngestURL = redactURL(up.ingestURL)
+	}
+	recordEnded(ended)
+
+	// A session that never negotiated was never reported as started.
+	if up != nil {
+		ev := SessionEndedEvent{
+			Event:     "session.ended",
+			ID:        s.id,
+			IngestURL: redactURL(up.ingestURL),
+			Labels:    s.labels,
+			Reason:    reason,
+			Detail:    detail,
+			Time:      time.Now(),
+			Teardown:  "complete",
+			Stats:     s.rawStats(),
+		}
+		ev.Stats.IngestURL = ev.IngestURL
+		if err != nil {
+			ev.Teardown = "teardown-failed"
+		}
+		postWebhook(ev)
+	}
+	return err
+}
+
+// teardownContext bounds one teardown by the configured TeardownTimeout.
+func teardownContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(cfg.Load().TeardownTimeout))
+}
+
+// closeUpstream closes up and, if its WHIP resource couldn't be deleted,
+// records it in failedTeardowns for reconciliation.
+func (s *session) closeUpstream(ctx context.Context, up *upstream) error {
+	err := up.close(ctx, s.bearerToken())
+	if err == nil {
+		return nil
+	}
+	s.event("teardown-failed", "DELETE %s: %v", redactURL(up.resourceURL), err)
+	recordFailedTeardown(s.id, up.ingestURL, up.resourceURL, err)
+	return err
+}
+
+func recordFailedTeardown(id, ingestURL, resourceURL string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failedTeardowns) == maxFailedTeardowns {
+		failedTeardowns = failedTeardowns[1:]
+	}
+	failedTeardowns = append(failedTeardowns, FailedTeardown{
+		ID:          id,
+		IngestURL:   ingestURL,
+		ResourceURL: resourceURL,
+		Time:        time.Now(),
+		Error:       err.Error(),
+	})
+}
+
+func (s *session) bearerToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// setBearerToken replaces the WHIP bearer token for subsequent requests,
+// such as the DELETE on teardown or the POST of a migration. Media is not
+// affected.
+func (s *session) setBearerToken(token string) {
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+	saveToken(s.id, token)
+	s.event("token", "bearer token rotated")
+}
+
+func (s *session) ingestURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.up.ingestURL
+}
+
+// negotiate creates a PeerConnection carrying the session's tracks and
+// performs the WHIP offer/answer exchange with ingestURL, within
+// s.negotiationTimeout and for no longer than ctx allows.
+func (s *session) negotiate(parent context.Context, ingestURL string) (*upstream, error) {
+	ctx, cancel := context.WithTimeout(parent, s.negotiationTimeout)
+	defer cancel()
+
+	// Create PeerConnection
+	api, err := s.api()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers:         s.iceServers,
+		ICETransportPolicy: s.icePolicy,
+		BundlePolicy:       s.bundle,
+		RTCPMuxPolicy:      s.rtcpMux,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pc: %w", err)
+	}
+	if cfg.Load().Debug {
+		s.logf("offering to %s with bundlePolicy=%s rtcpMuxPolicy=%s codecs=%s",
+			redactURL(ingestURL), s.bundle, s.rtcpMux, codecOrder(s.codecs))
+	}
+
+	up := &upstream{ingestURL: ingestURL, pc: pc, transforms: s.transforms, logf: s.logf}
+	up.watchCandidates()
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		s.event("ice", "%s: %s", redactURL(ingestURL), state)
+		s.watchICE(up, state)
+	})
+
+	if s.dataChannel != "" {
+		if up.dc, err = pc.CreateDataChannel(s.dataChannel, nil); err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("failed to create data channel: %w", err)
+		}
+		up.dc.OnOpen(func() {
+			s.event("datachannel", "%s: %q open", redactURL(ingestURL), s.dataChannel)
+		})
+	}
+	host := breakerHost(ingestURL)
+	if err := breakerAllow(host); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	err = up.connect(ctx, s.media(), s.bearerToken())
+	if err != nil && ctx.Err() != nil {
+		err = s.negotiationTimedOut(parent, ingestURL, err)
+	}
+	breakerRecord(host, err)
+	saveResource(s.id, up, s.bearerToken())
+	if up.whipStatus != 0 {
+		s.event("whip", "POST %s: %d", redactURL(ingestURL), up.whipStatus)
+	}
+	if err != nil {
+		if up.resourceURL == "" {
+			pc.Close()
+			return nil, err
+		}
+		// The server created a resource for a session that won't happen.
+		ctx, cancel := teardownContext()
+		defer cancel()
+		s.closeUpstream(ctx, up)
+		return nil, err
+	}
+	// The answer was applied, so it parses; were it not to, fmtp would
+	// fall back to the offered lines.
+	var answer sdp.SessionDescription
+	answer.UnmarshalString(pc.RemoteDescription().SDP)
+	for _, t := range pc.GetTransceivers() {
+		sender := t.Sender()
+		if sender == nil || sender.Track() == nil {
+			continue // rejected by the answer
+		}
+		if c := sender.GetParameters().Codecs; len(c) > 0 {
+			nc := NegotiatedCodec{
+				Kind:        sender.Track().Kind().String(),
+				MimeType:    c[0].MimeType,
+				PayloadType: uint8(c[0].PayloadType),
+				ClockRate:   c[0].ClockRate,
+				Channels:    c[0].Channels,
+				Fmtp:        cmp.Or(answerFmtp(&answer, t.Mid(), uint8(c[0].PayloadType)), c[0].SDPFmtpLine),
+			}
+			if strings.EqualFold(nc.MimeType, webrtc.MimeTypeH264) {
+				nc.Profile = strings.ToLower(fmtpParam(nc.Fmtp, "profile-level-id"))
+			}
+			up.negotiated = append(up.negotiated, nc)
+			s.event("negotiated", "%s %s pt=%d clock=%d fmtp=%q", nc.Kind, nc.MimeType, nc.PayloadType, nc.ClockRate, nc.Fmtp)
+			go readRTCP(sender, s.mediaTrack(sender.Track().Kind()))
+		}
+	}
+	err = s.checkPicked(up)
+	if err == nil {
+		err = s.checkProfile(up)
+	}
+	if err != nil {
+		ctx, cancel := teardownContext()
+		defer cancel()
+		s.closeUpstream(ctx, up)
+		return nil, err
+	}
+
+	if s.audioFEC && s.audio != nil {
+		if answerKeepsFEC(pc.RemoteDescription()) {
+			s.event("negotiated", "audio in-band FEC accepted")
+		} else {
+			s.event("warning", "audio in-band FEC not accepted by %s", redactURL(ingestURL))
+		}
+	}
+	if s.videoRTX && s.video != nil {
+		if ssrc := rtxSSRC(pc, webrtc.RTPCodecTypeVideo); ssrc != 0 {
+			s.event("negotiated", "video RTX accepted, retransmitting on ssrc=%d", ssrc)
+		} else {
+			s.event("warning", "video RTX not accepted by %s; retransmitting on the media SSRC", redactURL(ingestURL))
+		}
+	}
+
+	if len(up.rejected) == len(pc.GetTransceivers()) {
+		ctx, cancel := teardownContext()
+		defer cancel()
+		s.closeUpstream(ctx, up)
+		return nil, newRelayError(CodeMediaRejected, http.StatusBadGateway, errors.New("whip answer rejected all media"))
+	}
+	for _, kind := range up.rejected {
+		s.drop(kind)
+	}
+	if len(s.extensions) > 0 {
+		s.remapExtensions(up)
+	}
+	if ctx.Err() != nil {
+		ctx, cancel := teardownContext()
+		defer cancel()
+		s.closeUpstream(ctx, up)
+		return nil, s.negotiationTimedOut(parent, ingestURL, nil)
+	}
+	return up, nil
+}
+
+// negotiationTimedOut reports a negotiation with ingestURL that ran out of
+// s.negotiationTimeout, in the step that failed with err if any. If it was
+// parent that ended instead, the error wraps parent's.
+func (s *session) negotiationTimedOut(parent context.Context, ingestURL string, err error) error {
+	if cause := parent.Err(); cause != nil {
+		return fmt.Errorf("negotiation with %s stopped: %w", redactURL(ingestURL), cause)
+	}
+	msg := fmt.Sprintf("negotiation with %s took longer than %s", redactURL(ingestURL), s.negotiationTimeout)
+	s.event("error", "%s", msg)
+	if err == nil {
+		return newRelayError(CodeNegotiationTimeout, http.StatusGatewayTimeout, errors.New(msg))
+	}
+	return newRelayError(CodeNegotiationTimeout, http.StatusGatewayTimeout, fmt.Errorf("%s: %w", msg, err))
+}
+
+func (up *upstream) connect(ctx context.Context, tracks []*mediaTrack, token string) error {
+	for _, mt := range tracks {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv}
+		if mt.ssrc != 0 {
+			init.SendEncodings = []webrtc.RTPEncodingParameters{{
+				RTPCodingParameters: webrtc.RTPCodingParameters{SSRC: mt.ssrc},
+			}}
+		}
+		if _, err := up.pc.AddTransceiverFromTrack(mt.local, init); err != nil {
+			return fmt.Errorf("failed %s track: %w", mt.kind, err)
+		}
+	}
+
+	// Create livekit offer
+	offer, err := up.pc.CreateOffer(nil)
+	// fmt.Printf("SDP OFFER: %s\n", offer.SDP)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err = up.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local desc: %w", err)
+	}
+
+	offerSDP, err := mungeSDP(offer.SDP, up.transforms)
+	if err != nil {
+		return err
+	}
+
+	// Send offer to livekit
+	reqBody := strings.NewReader(offerSDP)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", up.ingestURL, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to build whip request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/sdp")
+	setBearer(httpReq, token)
+
+	resp, err := whipDo(httpReq)
+	if err != nil {
+		return newRelayError(CodeWHIPUnreachable, http.StatusBadGateway, fmt.Errorf("whip request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	up.whipStatus = resp.StatusCode
+	if resp.StatusCode != 201 && resp.StatusCode != 200 {
+		return newWHIPError(resp).relayError()
+	}
+
+	if loc, err := resp.Location(); err == nil {
+		up.resourceURL = loc.String()
+	}
+
+	answerSDP, err := readBody(resp.Body, cfg.Load().MaxAnswerBytes)
+	// fmt.Printf("SDP ANSWER: %s\n", string(answerSDP))
+	if err != nil {
+		return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, fmt.Errorf("failed to read whip answer: %w", err))
+	}
+	if len(bytes.TrimSpace(answerSDP)) == 0 {
+		emptyErr := errEmptyAnswer
+		if cfg.Load().EmptyAnswer != "fail" {
+			up.logf("whip answer from %s is empty, fetching it from the resource URL", redactURL(up.ingestURL))
+			if answerSDP, err = up.fetchAnswer(ctx, token); err != nil {
+				emptyErr = fmt.Errorf("%w, and fetching it failed: %v", errEmptyAnswer, err)
+			}
+		}
+		if len(bytes.TrimSpace(answerSDP)) == 0 {
+			return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, newAnswerError(emptyErr, ""))
+		}
+	}
+
+	answer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answerSDP),
+	}
+	if err = up.removeRejected(answer); err != nil {
+		return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, newAnswerError(err, answer.SDP))
+	}
+	if err = up.pc.SetRemoteDescription(answer); err != nil {
+		return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway,
+			fmt.Errorf("failed to set remote desc: %w", newAnswerError(err, answer.SDP)))
+	}
+	if !hasCandidates(answer.SDP) {
+		if cfg.Load().AnswerCandidates == "warn" {
+			up.logf("whip answer from %s has no ICE candidates; ICE will not connect", redactURL(up.ingestURL))
+		} else {
+			return newRelayError(CodeWHIPBadAnswer, http.StatusBadGateway, newAnswerError(errNoCandidates, answer.SDP))
+		}
+	}
+
+	return nil
+}
+
+// removeRejected removes the senders whose m-line the answer rejected (port
+// 0) or declined to receive on, recording their kinds in up.rejected. It
+// must run before SetRemoteDescription, which would otherwise fail trying to
+// start a sender the remote has no codec for.
+func (up *upstream) removeRejected(answer webrtc.SessionDescription) error {
+	parsed, err := answer.Unmarshal()
+	if err != nil {
+		return fmt.Errorf("failed to parse whip answer: %w", err)
+	}
+
+	for _, t := range up.pc.GetTransceivers() {
+		if t.Sender() == nil || acceptsMedia(parsed, t.Mid()) {
+			continue
+		}
+		if err := up.pc.RemoveTrack(t.Sender()); err != nil {
+			return fmt.Errorf("failed to remove rejected %s track: %w", t.Kind(), err)
+		}
+		up.rejected = append(up.rejected, t.Kind())
+	}
+	return nil
+}
+
+// watchICE ends s when ICE on its current upstream fails, or stays
+// disconnected for longer than the iceDisconnectGrace config. A
+// disconnection that recovers in time is only logged. Without a grace
+// period, ICE states are never acted on.
+func (s *session) watchICE(up *upstream, state webrtc.ICEConnectionState) {
+	grace := time.Duration(cfg.Load().ICEDisconnectGrace)
+	if grace == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting := up.iceGrace != nil && up.iceGrace.Stop()
+	up.iceGrace = nil
+	switch state {
+	case webrtc.ICEConnectionStateDisconnected:
+		up.iceGrace = time.AfterFunc(grace, func() {
+			s.iceFailed(up, fmt.Sprintf("ice disconnected for more than %s", grace))
+		})
+	case webrtc.ICEConnectionStateFailed:
+		// Not from pion's callback, which closing the pc would wait on.
+		go s.iceFailed(up, "ice failed")
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		if waiting {
+			s.event("ice", "%s: reconnected within %s", redactURL(up.ingestURL), grace)
+		}
+	}
+}
+
+// iceFailed ends s with detail, unless up has since been migrated away
+// from.
+func (s *session) iceFailed(up *upstream, detail string) {
+	s.mu.Lock()
+	current := s.up == up
+	s.mu.Unlock()
+	if current {
+		s.end(TeardownICEFailed, detail)
+	}
+}
+
+// answerFmtp returns the fmtp parameters answer gives payload type pt in
+// the m-section for mid, or "" if it gives none.
+func answerFmtp(answer *sdp.SessionDescription, mid string, pt uint8) string {
+	prefix := strconv.Itoa(int(pt)) + " "
+	for _, m := range answer.MediaDescriptions {
+		if v, _ := m.Attribute("mid"); v != mid {
+			continue
+		}
+		for _, a := range m.Attributes {
+			if params, ok := strings.CutPrefix(a.Value, prefix); ok && a.Key == "fmtp" {
+				return params
+			}
+		}
+	}
+	return ""
+}
+
+// acceptsMedia reports whether the answer's m-line for mid will receive what
+// we send.
+func acceptsMedia(answer *sdp.SessionDescription, mid string) bool {
+	for _, m := range answer.MediaDescriptions {
+		if v, _ := m.Attribute("mid"); v != mid {
+			continue
+		}
+		if m.MediaName.Port.Value == 0 {
+			return false
+		}
+		for _, dir := range []string{"sendonly", "inactive"} {
+			if _, ok := m.Attribute(dir); ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// close tears down the PeerConnection and, if the WHIP server gave us a
+// resource URL, deletes the ingest resource. The error is the final DELETE
+// failure, meaning the resource may still exist on the server.
+func (up *upstream) close(ctx context.Context, token string) error {
+	closed := make(chan error, 1)
+	go func() { closed <- up.pc.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			up.logf("failed to close pc for %s: %v", redactURL(up.ingestURL), err)
+		} else {
+			up.logf("closed pc for %s", redactURL(up.ingestURL))
+		}
+	case <-ctx.Done():
+		up.logf("closing pc for %s timed out, abandoning it", redactURL(up.ingestURL))
+	}
+
+	if up.resourceURL == "" {
+		return nil
+	}
+	c := cfg.Load()
+	if err := deleteResource(ctx, up.resourceURL, token, c.DeleteAttempts, time.Duration(c.DeleteBackoff)); err != nil {
+		up.logf("whip delete %s gave up: %v", redactURL(up.resourceURL), err)
+		return err
+	}
+	up.logf("whip delete %s confirmed", redactURL(up.resourceURL))
+	forgetResource(up.resourceURL)
+	return nil
+}
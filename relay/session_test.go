@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// TestPolicyInterop negotiates with canned answers from WHIP servers the
+// relay is used with, under each bundle and RTCP mux policy combination
+// that can be configured.
+func TestPolicyInterop(t *testing.T) {
+	useConfig(t, loopbackConfig)
+
+	servers := []string{"janus", "mediasoup"}
+	policies := []struct {
+		bundle, rtcpMux string
+		wantBundle      webrtc.BundlePolicy
+		wantRTCPMux     webrtc.RTCPMuxPolicy
+	}{
+		{"", "", webrtc.BundlePolicyMaxBundle, webrtc.RTCPMuxPolicyRequire},
+		{"balanced", "require", webrtc.BundlePolicyBalanced, webrtc.RTCPMuxPolicyRequire},
+		{"max-compat", "require", webrtc.BundlePolicyMaxCompat, webrtc.RTCPMuxPolicyRequire},
+		{"balanced", "negotiate", webrtc.BundlePolicyBalanced, webrtc.RTCPMuxPolicyNegotiate},
+		{"max-compat", "negotiate", webrtc.BundlePolicyMaxCompat, webrtc.RTCPMuxPolicyNegotiate},
+	}
+	for _, server := range servers {
+		answer := fixture(t, server+"-answer.sdp")
+		for _, p := range policies {
+			t.Run(server+"/"+p.bundle+"/"+p.rtcpMux, func(t *testing.T) {
+				ws := newWHIPServer(t, answer)
+				ports := freePorts(t, 2)
+				s, err := start(context.Background(), StartRequest{
+					IngestURL:     ws.URL + "/whip",
+					VideoPort:     ports[0],
+					AudioPort:     ports[1],
+					BundlePolicy:  p.bundle,
+					RTCPMuxPolicy: p.rtcpMux,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.end(TeardownStopped, "")
+
+				if s.bundle != p.wantBundle {
+					t.Errorf("bundle policy = %s, want %s", s.bundle, p.wantBundle)
+				}
+				if s.rtcpMux != p.wantRTCPMux {
+					t.Errorf("rtcp mux policy = %s, want %s", s.rtcpMux, p.wantRTCPMux)
+				}
+
+				var offer sdp.SessionDescription
+				if err := offer.UnmarshalString(ws.offer()); err != nil {
+					t.Fatalf("offer doesn't parse: %v", err)
+				}
+				if group, _ := offer.Attribute("group"); group != "BUNDLE 0 1" {
+					t.Errorf("offer has group %q, want BUNDLE 0 1", group)
+				}
+				if len(offer.MediaDescriptions) != 2 {
+					t.Fatalf("offer has %d m-lines, want 2", len(offer.MediaDescriptions))
+				}
+				for i, want := range []string{"audio", "video"} {
+					m := offer.MediaDescriptions[i]
+					if m.MediaName.Media != want {
+						t.Errorf("m-line %d is %s, want %s", i, m.MediaName.Media, want)
+					}
+					if mid, _ := m.Attribute("mid"); mid != []string{"0", "1"}[i] {
+						t.Errorf("%s m-line has mid %q", want, mid)
+					}
+					if _, ok := m.Attribute("rtcp-mux"); !ok {
+						t.Errorf("%s m-line doesn't offer rtcp-mux", want)
+					}
+				}
+
+				var got []string
+				for _, nc := range s.response().Negotiated {
+					got = append(got, nc.Kind+" "+nc.MimeType)
+				}
+				if want := "audio audio/opus, video video/VP8"; strings.Join(got, ", ") != want {
+					t.Errorf("negotiated %s, want %s", strings.Join(got, ", "), want)
+				}
+			})
+		}
+	}
+}
+
+// TestPolicyValidation checks the policy combinations a StartRequest can
+// ask for.
+func TestPolicyValidation(t *testing.T) {
+	tests := []struct {
+		bundle, rtcpMux string
+		wantErr         string
+	}{
+		{"max-bundle", "require", ""},
+		{"balanced", "negotiate", ""},
+		{"max-compat", "negotiate", ""},
+		{"max-bundle", "negotiate", `bundlePolicy "max-bundle" needs rtcpMuxPolicy "require"`},
+		{"bundle-everything", "require", `unknown bundlePolicy "bundle-everything"`},
+		{"balanced", "maybe", `unknown rtcpMuxPolicy "maybe"`},
+	}
+	for _, tt := range tests {
+		err := checkPolicies(tt.bundle, tt.rtcpMux)
+		if got := errString(err); got != tt.wantErr {
+			t.Errorf("checkPolicies(%q, %q) = %q, want %q", tt.bundle, tt.rtcpMux, got, tt.wantErr)
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// TestMigrateAfterEnd checks that an upstream negotiated by a migration
+// that the session's end overtook is torn down instead of swapped in.
+func TestMigrateAfterEnd(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	answer := fixture(t, "janus-answer.sdp")
+	first := newWHIPServer(t, answer)
+	ports := freePorts(t, 2)
+	s, err := start(context.Background(), StartRequest{IngestURL: first.URL, VideoPort: ports[0], AudioPort: ports[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new WHIP server answers only once the session has ended.
+	second := newWHIPServer(t, answer)
+	post := second.Config.Handler
+	second.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			s.end(TeardownStopped, "")
+		}
+		post.ServeHTTP(w, r)
+	})
+
+	if err := s.migrate(context.Background(), second.URL); err == nil {
+		t.Error("migration of an ended session succeeded")
+	}
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	if second.deletes != 1 {
+		t.Errorf("new WHIP resource got %d DELETEs, want 1", second.deletes)
+	}
+	if s.ingestURL() != first.URL {
+		t.Errorf("session ended with upstream %s, want %s", s.ingestURL(), first.URL)
+	}
+}
+
+// TestEventsRedactURLs checks that the stream keys ingest URLs carry stay
+// out of a session's events and logs, which are served unredacted.
+func TestEventsRedactURLs(t *testing.T) {
+	useConfig(t, loopbackConfig)
+	endSessions(t)
+	answer := fixture(t, "janus-answer.sdp")
+	id := startOK(t, startBody(t, newWHIPServer(t, answer).URL+"/whip?key=s3cret", ""))
+	s := lookupSession(id)
+
+	if err := s.migrate(context.Background(), newWHIPServer(t, answer).URL+"/whip/s3cretstreamkey0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	if err := s.migrate(context.Background(), gone.URL+"/whip?key=s3cret"); err == nil {
+		t.Fatal("migration to a closed port succeeded")
+	}
+
+	for _, path := range []string{"/session/" + id + "/events", "/session/" + id + "/logs"} {
+		w := call(http.MethodGet, path, "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", path, w.Code)
+		}
+		if body := w.Body.String(); strings.Contains(body, "s3cret") {
+			t.Errorf("GET %s shows a stream key:\n%s", path, body)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// SessionInfo describes a running session for GET /sessions and
+// GET /session/{id}. IngestURL is redacted, so it is safe to show.
+type SessionInfo struct {
+	ID            string   `json:"id"`
+	IngestURL     string   `json:"ingestUrl"`
+	State         string   `json:"state"`
+	Paused        bool     `json:"paused"`
+	UptimeSeconds float64  `json:"uptimeSeconds"`
+	VideoPort     int      `json:"videoPort"`
+	AudioPort     int      `json:"audioPort"`
+	Codecs        []string `json:"codecs"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Negotiated is what each track agreed on with the WHIP server.
+	Negotiated []NegotiatedCodec `json:"negotiated"`
+
+	// LocalCandidates are the relay's locally gathered ICE candidates,
+	// unredacted since they are its own. The offer may have gone out before
+	// gathering finished and none are trickled, so the WHIP server may not
+	// know them all; compare them with the answer's to see which pairs can
+	// work. SelectedPair is set once ICE has connected.
+	LocalCandidates []LocalCandidate `json:"localCandidates"`
+	SelectedPair    *CandidatePair   `json:"selectedPair,omitempty"`
+
+	// Stats is only filled in with ?verbose=true.
+	Stats *SessionStats `json:"stats,omitempty"`
+}
+
+// NegotiatedCodec is a track's codec as negotiated: the payload type,
+// clock rate and channels from its transceiver's parameters, and the fmtp
+// line the answer gives that payload type, falling back to the offered one.
+type NegotiatedCodec struct {
+	Kind        string `json:"kind"`
+	MimeType    string `json:"mimeType"`
+	PayloadType uint8  `json:"payloadType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    uint16 `json:"channels,omitempty"`
+	Fmtp        string `json:"fmtp,omitempty"`
+
+	// Profile is H.264's profile-level-id from Fmtp.
+	Profile string `json:"profile,omitempty"`
+}
+
+// info describes s without any network I/O. State is the current upstream's
+// ICE connection state.
+func (s *session) info(verbose bool) SessionInfo {
+	s.mu.Lock()
+	up := s.up
+	s.mu.Unlock()
+
+	info := SessionInfo{
+		ID:            s.id,
+		IngestURL:     redactURL(up.ingestURL),
+		State:         up.pc.ICEConnectionState().String(),
+		Paused:        s.paused.Load(),
+		UptimeSeconds: time.Since(s.startedAt).Seconds(),
+		VideoPort:     s.port(webrtc.RTPCodecTypeVideo),
+		AudioPort:     s.port(webrtc.RTPCodecTypeAudio),
+		Labels:        s.labels,
+		Negotiated:    up.negotiated,
+
+		LocalCandidates: up.localCandidates(),
+		SelectedPair:    selectedPair(up.pc),
+	}
+	for _, mt := range s.media() {
+		for _, c := range mt.local.codecs {
+			info.Codecs = append(info.Codecs, c.params.MimeType)
+		}
+	}
+	if verbose {
+		st := s.stats()
+		st.IngestURL = info.IngestURL
+		info.Stats = &st
+	}
+	return info
+}
+
+// tokenLike matches path segments that look like stream keys or tokens.
+var tokenLike = regexp.MustCompile(`^[A-Za-z0-9_.~-]{16,}$`)
+
+// redactURL hides the parts of a WHIP URL that usually carry credentials:
+// userinfo, query values and a token-like last path segment.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	q := u.Query()
+	for k := range q {
+		q.Set(k, "REDACTED")
+	}
+	u.RawQuery = q.Encode()
+	if dir, last := path.Split(u.Path); tokenLike.MatchString(last) {
+		u.Path = dir + "REDACTED"
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+
+	mu.Lock()
+	list := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		infos = append(infos, s.info(verbose))
+	}
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return cmp.Compare(b.UptimeSeconds, a.UptimeSeconds)
+	})
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	s := lookupSession(r.PathValue("id"))
+	if s == nil {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	writeJSON(w, http.StatusOK, s.info(verbose))
+}
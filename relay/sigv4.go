@@ -0,0 +1,262 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SigV4Config signs every WHIP request with AWS Signature Version 4, for
+// AWS ingest endpoints that authenticate with IAM credentials. Signing
+// replaces the bearer token: both use the Authorization header.
+//
+// Region falls back to AWS_REGION or AWS_DEFAULT_REGION. Credentials not
+// set here come from the first link of the standard chain that has them:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, then
+// Profile (default AWS_PROFILE, or "default") in the shared credentials
+// file (AWS_SHARED_CREDENTIALS_FILE, or ~/.aws/credentials). They are
+// resolved when the config is loaded, so rotated credentials need a
+// /reload. Instance and container roles, SSO and credential_process are
+// not supported.
+type SigV4Config struct {
+	Service         string `json:"service"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+	Profile         string `json:"profile"`
+}
+
+// awsCredentials are the keys a request is signed with.
+type awsCredentials struct {
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+// signer returns a signer for c, or nil if c enables no signing.
+func (c SigV4Config) signer() (*sigV4Signer, error) {
+	if c.Service == "" {
+		if c != (SigV4Config{}) {
+			return nil, errors.New("whipClient.sigv4 needs a service, e.g. \"ivs\"")
+		}
+		return nil, nil
+	}
+	region := cmp.Or(c.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+	if region == "" {
+		return nil, errors.New("whipClient.sigv4 needs a region, or AWS_REGION")
+	}
+	creds, source, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Signing WHIP requests for %s in %s with AWS access key %s from %s", c.Service, region, creds.accessKeyID, source)
+	return &sigV4Signer{service: c.Service, region: region, creds: creds}, nil
+}
+
+// credentials walks the credential chain, naming the link it used.
+func (c SigV4Config) credentials() (awsCredentials, string, error) {
+	if c.AccessKeyID != "" || c.SecretAccessKey != "" {
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return awsCredentials{}, "", errors.New("whipClient.sigv4 accessKeyId and secretAccessKey must be set together")
+		}
+		return awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken}, "the config", nil
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{id, secret, os.Getenv("AWS_SESSION_TOKEN")}, "the environment", nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, "", errors.New("no AWS credentials in the config or environment, and no home directory for ~/.aws/credentials")
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := cmp.Or(c.Profile, os.Getenv("AWS_PROFILE"), "default")
+	f, err := os.Open(path)
+	if err != nil {
+		return awsCredentials{}, "", fmt.Errorf("no AWS credentials in the config or environment, and %w", err)
+	}
+	defer f.Close()
+	section := sharedCredentials(f, profile)
+	creds := awsCredentials{section["aws_access_key_id"], section["aws_secret_access_key"], section["aws_session_token"]}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return awsCredentials{}, "", fmt.Errorf("no AWS credentials for profile %q in %s", profile, path)
+	}
+	return creds, fmt.Sprintf("profile %q in %s", profile, path), nil
+}
+
+// sharedCredentials returns the keys of profile's section in an AWS shared
+// credentials file.
+func sharedCredentials(r io.Reader, profile string) map[string]string {
+	keys := make(map[string]string)
+	in := false
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == profile
+		case in:
+			if k, v, ok := strings.Cut(line, "="); ok {
+				keys[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return keys
+}
+
+// sigV4Signer signs requests for one service and region.
+type sigV4Signer struct {
+	service, region string
+	creds           awsCredentials
+}
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+// sign adds the X-Amz-Date, X-Amz-Security-Token and Authorization headers
+// to r, whose body is body. The signed headers are Host, Content-Type and
+// the X-Amz ones.
+func (s *sigV4Signer) sign(r *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	r.Header.Set("X-Amz-Date", amzDate)
+	if s.creds.sessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", s.creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": cmp.Or(r.Host, r.URL.Host)}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL),
+		canonicalQuery(r.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.creds.secretAccessKey)
+	for _, part := range []string{date, s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalURI is u's path as SigV4 signs it for services other than S3:
+// each segment of the escaped path escaped once more.
+func canonicalURI(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = awsEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery is u's query with keys and values escaped and sorted.
+func canonicalQuery(u *url.URL) string {
+	var pairs []string
+	for k, vs := range u.Query() {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but RFC 3986's unreserved
+// characters, as SigV4 requires.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4Transport signs every request before handing it to next.
+type sigV4Transport struct {
+	next   http.RoundTripper
+	signer *sigV4Signer
+}
+
+func (t *sigV4Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.GetBody == nil {
+			r.Body.Close()
+			return nil, errors.New("sigv4: request body can't be replayed for signing")
+		}
+		rc, err := r.GetBody()
+		if err != nil {
+			r.Body.Close()
+			return nil, err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			r.Body.Close()
+			return nil, err
+		}
+	}
+	// A RoundTripper mustn't modify the request it is given.
+	signed := r.Clone(r.Context())
+	signed.Header.Del("Authorization")
+	t.signer.sign(signed, body, time.Now())
+	if body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+		r.Body.Close()
+	}
+	return t.next.RoundTrip(signed)
+}
@@ -0,0 +1,24 @@
+package relay
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// sourceFilter is a StartRequest's SourceAllowlist, parsed. A nil filter
+// accepts every source.
+type sourceFilter []netip.Prefix
+
+// allows reports whether RTP from addr is accepted.
+func (f sourceFilter) allows(addr *net.UDPAddr) bool {
+	if f == nil {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	return slices.ContainsFunc(f, func(p netip.Prefix) bool { return p.Contains(ip) })
+}
@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"fmt"
+	"time"
+)
+
+// sourceGapNotice is how long RTP has to stop for before the gap is
+// reported. ffmpeg's own pacing leaves no gaps near this long.
+const sourceGapNotice = time.Second
+
+// gotRTP notes an RTP packet arriving for mt, and the end of a gap it
+// closes.
+func (s *session) gotRTP(mt *mediaTrack, now time.Time) {
+	last := s.lastRTP.Swap(now.UnixNano())
+	if s.inGap.Load() && s.inGap.CompareAndSwap(true, false) {
+		gap := now.Sub(time.Unix(0, last))
+		s.event("source-resumed", "%s RTP resumed after %s", mt.kind, gap.Round(time.Millisecond))
+	}
+}
+
+// sourceGap is how long no RTP has arrived as of now.
+func (s *session) sourceGap(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.lastRTP.Load()))
+}
+
+// watchSource ends the session once no RTP has arrived for maxGap. Shorter
+// gaps are only reported, so the WHIP connection survives a source
+// restart. It returns when the session is closed.
+func (s *session) watchSource(maxGap time.Duration) {
+	tick := time.NewTicker(sourceGapNotice / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-tick.C:
+			gap := s.sourceGap(now)
+			if gap >= maxGap {
+				detail := fmt.Sprintf("source gone: no RTP for %s", maxGap)
+				s.event("source-gap", "%s", detail)
+				s.end(TeardownWatchdog, detail)
+				return
+			}
+			if gap >= sourceGapNotice && s.inGap.CompareAndSwap(false, true) {
+				s.event("source-gap", "no RTP for %s, keeping the session up for %s", gap.Round(time.Millisecond), maxGap)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v3"
+)
+
+// SRTPConfig is the SRTP ffmpeg protects its output with when it sends to
+// srtp:// instead of rtp://. Suite and Key are the values of ffmpeg's
+// -srtp_out_suite and -srtp_out_params: a suite name and the base64 master
+// key followed by the master salt. Every port is then expected to receive
+// SRTP, and RTCP muxed onto it SRTCP.
+type SRTPConfig struct {
+	Suite string `json:"suite"`
+	Key   string `json:"key"`
+}
+
+// srtpSuites are the suites ffmpeg's srtp protocol supports, by both of
+// the names it accepts for each.
+var srtpSuites = map[string]srtp.ProtectionProfile{
+	"AES_CM_128_HMAC_SHA1_80":     srtp.ProtectionProfileAes128CmHmacSha1_80,
+	"SRTP_AES128_CM_HMAC_SHA1_80": srtp.ProtectionProfileAes128CmHmacSha1_80,
+	"AES_CM_128_HMAC_SHA1_32":     srtp.ProtectionProfileAes128CmHmacSha1_32,
+	"SRTP_AES128_CM_HMAC_SHA1_32": srtp.ProtectionProfileAes128CmHmacSha1_32,
+}
+
+// srtpReplayWindow is how far behind the newest packet an SRTP packet may
+// arrive and still be accepted; packets seen before are dropped.
+const srtpReplayWindow = 128
+
+func (c SRTPConfig) isZero() bool {
+	return c.Suite == "" && c.Key == ""
+}
+
+// keys checks c and returns its profile, master key and master salt.
+func (c SRTPConfig) keys() (srtp.ProtectionProfile, []byte, []byte, error) {
+	profile, ok := srtpSuites[c.Suite]
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("unknown srtp suite %q", c.Suite)
+	}
+	params, err := base64.StdEncoding.DecodeString(c.Key)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("srtp key is not base64: %w", err)
+	}
+	keyLen, err := profile.KeyLen()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	saltLen, err := profile.SaltLen()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(params) != keyLen+saltLen {
+		return 0, nil, nil, fmt.Errorf("srtp key for %s must be %d bytes of key and salt, got %d", c.Suite, keyLen+saltLen, len(params))
+	}
+	return profile, params[:keyLen], params[keyLen:], nil
+}
+
+// validate checks c, which may be unset.
+func (c SRTPConfig) validate() error {
+	if c.isZero() {
+		return nil
+	}
+	_, _, _, err := c.keys()
+	return err
+}
+
+// srtpReader decrypts what ffmpeg sends to one port. The relay loops
+// sharing the port share it: the SRTP context tracks rollover and replays
+// per SSRC, and isn't safe for concurrent use.
+type srtpReader struct {
+	mu  sync.Mutex
+	ctx *srtp.Context
+}
+
+// newSRTPReader returns a reader for c, or nil if c is unset.
+func newSRTPReader(c SRTPConfig) (*srtpReader, error) {
+	if c.isZero() {
+		return nil, nil
+	}
+	profile, key, salt, err := c.keys()
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := srtp.CreateContext(key, salt, profile,
+		srtp.SRTPReplayProtection(srtpReplayWindow), srtp.SRTCPReplayProtection(srtpReplayWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create srtp context: %w", err)
+	}
+	return &srtpReader{ctx: ctx}, nil
+}
+
+// decrypt authenticates and decrypts the SRTP packet b, or the SRTCP one
+// if isRTCP is set, into dst.
+func (r *srtpReader) decrypt(dst, b []byte, isRTCP bool) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if isRTCP {
+		var h rtcp.Header
+		return r.ctx.DecryptRTCP(dst, b, &h)
+	}
+	var h rtp.Header
+	return r.ctx.DecryptRTP(dst, b, &h)
+}
@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateEntry is a WHIP resource the relay created and hasn't deleted yet,
+// as kept in the stateFile config. It holds the bearer token needed to
+// delete the resource, so the file is written readable by its owner only.
+type StateEntry struct {
+	ID          string    `json:"id"`
+	IngestURL   string    `json:"ingestUrl"`
+	ResourceURL string    `json:"resourceUrl"`
+	Token       string    `json:"token,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// resources mirrors the state file, keyed by resource URL. A resource whose
+// DELETE failed stays in it, so the next start tries once more.
+var (
+	resourcesMu sync.Mutex
+	resources   = make(map[string]StateEntry)
+)
+
+// saveResource records up's WHIP resource as live.
+func saveResource(id string, up *upstream, token string) {
+	if up.resourceURL == "" {
+		return
+	}
+	updateState(func() {
+		resources[up.resourceURL] = StateEntry{
+			ID:          id,
+			IngestURL:   up.ingestURL,
+			ResourceURL: up.resourceURL,
+			Token:       token,
+			Created:     time.Now(),
+		}
+	})
+}
+
+// forgetResource records that resourceURL was deleted.
+func forgetResource(resourceURL string) {
+	updateState(func() { delete(resources, resourceURL) })
+}
+
+// saveToken replaces the token kept for session id's resources.
+func saveToken(id, token string) {
+	updateState(func() {
+		for url, e := range resources {
+			if e.ID == id {
+				e.Token = token
+				resources[url] = e
+			}
+		}
+	})
+}
+
+// updateState applies change to resources and rewrites the state file, if
+// one is configured. A failed write is logged: it only weakens the crash
+// cleanup, which is no reason to fail a session.
+func updateState(change func()) {
+	resourcesMu.Lock()
+	defer resourcesMu.Unlock()
+	change()
+	path := cfg.Load().StateFile
+	if path == "" {
+		return
+	}
+	entries := slices.SortedFunc(maps.Values(resources), func(a, b StateEntry) int {
+		return strings.Compare(a.ResourceURL, b.ResourceURL)
+	})
+	if err := writeState(path, entries); err != nil {
+		log.Printf("failed to write state file: %v", err)
+	}
+}
+
+// writeState replaces path with entries through a temporary file, so a
+// crash mid-write leaves the old state rather than a truncated one.
+func writeState(path string, entries []StateEntry) error {
+	if entries == nil {
+		entries = []StateEntry{}
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// cleanupState deletes the WHIP resources left in the state file by a
+// previous run that didn't shut down cleanly. Resources that still can't
+// be deleted are listed in failedTeardowns and dropped from the file.
+func cleanupState() error {
+	path := cfg.Load().StateFile
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+	var orphans []StateEntry
+	if err := json.Unmarshal(b, &orphans); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	updateState(func() {
+		for _, e := range orphans {
+			resources[e.ResourceURL] = e
+		}
+	})
+
+	log.Printf("Deleting %d WHIP resources left by the previous run", len(orphans))
+	var wg sync.WaitGroup
+	for _, e := range orphans {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := teardownContext()
+			defer cancel()
+			c := cfg.Load()
+			err := deleteResource(ctx, e.ResourceURL, e.Token, c.DeleteAttempts, time.Duration(c.DeleteBackoff))
+			forgetResource(e.ResourceURL)
+			if err != nil {
+				log.Printf("whip delete %s (session %s) gave up: %v", redactURL(e.ResourceURL), e.ID, err)
+				recordFailedTeardown(e.ID, e.IngestURL, e.ResourceURL, err)
+				return
+			}
+			log.Printf("whip delete %s (session %s) confirmed", redactURL(e.ResourceURL), e.ID)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// The JSON stats (/stats, /session/{id}, /sessions?verbose) can be reset
+// to measure an interval of traffic, e.g. one test run. /metrics can't:
+// Prometheus counters must be monotonic, so it always reports the totals
+// since the session started, as does the session.ended webhook.
+//
+// The relay loops increment the counters without a lock, and a reset
+// doesn't zero them either. It records them as a baseline that the JSON
+// view subtracts, so every packet is counted either in the snapshot a
+// reset returns or in the interval after it, never both or neither.
+// Gauges, such as frameRate and estimateKbps, and the quota aren't reset.
+
+// StatsResetResponse is returned by /stats/reset.
+type StatsResetResponse struct {
+	// Sessions are the reset sessions' stats just before the reset, i.e.
+	// over the interval since the previous one, or since they started.
+	Sessions []SessionStats `json:"sessions"`
+	ResetAt  time.Time      `json:"resetAt"`
+}
+
+// statsResetHandler resets the JSON stats of every session, or with a
+// session query parameter, of that one.
+func statsResetHandler(w http.ResponseWriter, r *http.Request) {
+	var list []*session
+	if id := r.URL.Query().Get("session"); id != "" {
+		s := lookupSession(id)
+		if s == nil {
+			writeError(w, errSessionNotFound)
+			return
+		}
+		list = append(list, s)
+	} else {
+		mu.Lock()
+		for _, s := range sessions {
+			list = append(list, s)
+		}
+		mu.Unlock()
+	}
+
+	now := time.Now()
+	resp := StatsResetResponse{Sessions: make([]SessionStats, 0, len(list)), ResetAt: now}
+	for _, s := range list {
+		resp.Sessions = append(resp.Sessions, s.resetStats(now))
+	}
+	slices.SortFunc(resp.Sessions, func(a, b SessionStats) int {
+		return cmp.Compare(b.UptimeSeconds, a.UptimeSeconds)
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// stats reports the session's counters since the last /stats/reset.
+func (s *session) stats() SessionStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.sinceReset(s.rawStats())
+}
+
+// resetStats makes the counters read now the new baseline, returning the
+// stats since the previous one.
+func (s *session) resetStats(now time.Time) SessionStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	raw := s.rawStats()
+	st := s.sinceReset(raw)
+	s.statsBase, s.statsResetAt = &raw, now
+	return st
+}
+
+// sinceReset returns raw less the baseline. s.statsMu must be held.
+func (s *session) sinceReset(raw SessionStats) SessionStats {
+	if s.statsBase == nil {
+		return raw
+	}
+	since := s.statsResetAt
+	raw.CountersSince = &since
+	raw.Audio = raw.Audio.since(s.statsBase.Audio)
+	raw.Video = raw.Video.since(s.statsBase.Video)
+	return raw
+}
+
+// since returns a copy of t with the counters less base's.
+func (t *TrackStats) since(base *TrackStats) *TrackStats {
+	if t == nil || base == nil {
+		return t
+	}
+	d := *t
+	d.Packets -= base.Packets
+	d.Bytes -= base.Bytes
+	d.Malformed -= base.Malformed
+	d.RTCP -= base.RTCP
+	d.Stray -= base.Stray
+	d.SRTPFailed -= base.SRTPFailed
+	d.Rewritten -= base.Rewritten
+	d.Foreign -= base.Foreign
+	d.Nacked -= base.Nacked
+	d.QueueDrops -= base.QueueDrops
+	d.Frames -= base.Frames
+	return &d
+}
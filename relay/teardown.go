@@ -0,0 +1,64 @@
+package relay
+
+import "time"
+
+// TeardownReason is why a session ended, as reported in its teardown
+// event, SessionEndedEvent, /stop and the ended sessions in /stats. The
+// detail that goes with it is free text.
+type TeardownReason string
+
+const (
+	// TeardownStopped is a /stop or Session.Stop.
+	TeardownStopped TeardownReason = "stopped"
+	// TeardownShutdown is the server shutting down, or -ingest mode
+	// being interrupted.
+	TeardownShutdown TeardownReason = "shutdown"
+	// TeardownStartFailed is a /start that failed after creating the
+	// session, including on waitKeyframe or a canceled StartSession.
+	TeardownStartFailed TeardownReason = "start-failed"
+	// TeardownICEFailed is ICE failing, or staying disconnected past the
+	// iceDisconnectGrace config.
+	TeardownICEFailed TeardownReason = "ice-failed"
+	// TeardownWatchdog is no RTP arriving for maxSourceGap.
+	TeardownWatchdog TeardownReason = "watchdog-timeout"
+	// TeardownMaxDuration is the maxDuration quota running out.
+	TeardownMaxDuration TeardownReason = "max-duration"
+	// TeardownQuotaExceeded is the maxBytes or maxPacketsPerSecond quota
+	// being exceeded.
+	TeardownQuotaExceeded TeardownReason = "quota-exceeded"
+	// TeardownResourceGone is the resource check finding the WHIP
+	// resource gone, without resourceCheckReconnect or when reconnecting
+	// failed.
+	TeardownResourceGone TeardownReason = "resource-gone"
+	// TeardownCodecMismatch is ffmpeg sending a codec other than the one
+	// the WHIP server picked.
+	TeardownCodecMismatch TeardownReason = "codec-mismatch"
+	// TeardownReplaced is a /start with replace to the same ingest URL.
+	TeardownReplaced TeardownReason = "replaced"
+	// TeardownReplayFinished is a replayFile played to its end, or
+	// failing to read.
+	TeardownReplayFinished TeardownReason = "replay-finished"
+)
+
+// EndedSession is a session that ended, as listed in /stats.
+type EndedSession struct {
+	ID        string         `json:"id"`
+	IngestURL string         `json:"ingestUrl,omitempty"`
+	Reason    TeardownReason `json:"reason"`
+	Detail    string         `json:"detail,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+const maxEndedSessions = 100
+
+// endedSessions is guarded by mu.
+var endedSessions []EndedSession
+
+func recordEnded(e EndedSession) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(endedSessions) == maxEndedSessions {
+		endedSessions = endedSessions[1:]
+	}
+	endedSessions = append(endedSessions, e)
+}
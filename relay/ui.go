@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+//go:embed ui
+var uiFS embed.FS
+
+var (
+	uiTemplate = template.Must(template.ParseFS(uiFS, "ui/index.html"))
+	uiAssets   = http.FileServerFS(uiFS)
+)
+
+type uiPage struct {
+	Codecs    []uiCodec
+	VideoPort int
+	AudioPort int
+}
+
+// uiCodec is a codec checkbox, checked if the codec is offered by default.
+type uiCodec struct {
+	MimeType string
+	Checked  bool
+}
+
+// uiHandler serves the operator page. It talks to the same JSON endpoints
+// as any other client.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	page := uiPage{VideoPort: 5004, AudioPort: 5006}
+	for _, c := range supportedCodecs {
+		page.Codecs = append(page.Codecs, uiCodec{c.params.MimeType, !c.optIn})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uiTemplate.Execute(w, page); err != nil {
+		log.Printf("failed to render ui: %v", err)
+	}
+}
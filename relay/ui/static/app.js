@@ -0,0 +1,70 @@
+"use strict";
+
+const errorBox = document.getElementById("error");
+const tbody = document.getElementById("sessions");
+
+async function call(method, path, body) {
+  const resp = await fetch(path, {
+    method,
+    headers: body ? { "Content-Type": "application/json" } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function track(t) {
+  return t ? `:${t.port} ${t.packets} pkts / ${(t.bytes / 1e6).toFixed(1)} MB` : "-";
+}
+
+function cell(row, text) {
+  row.insertCell().textContent = text;
+}
+
+async function refresh() {
+  try {
+    const stats = await call("GET", "/stats");
+    tbody.replaceChildren();
+    for (const s of stats.sessions) {
+      const row = tbody.insertRow();
+      cell(row, s.id);
+      cell(row, s.ingestUrl);
+      cell(row, `${Math.round(s.uptimeSeconds)}s`);
+      cell(row, track(s.video));
+      cell(row, track(s.audio));
+      const stop = document.createElement("button");
+      stop.textContent = "Stop";
+      stop.onclick = () => run(() => call("POST", `/session/${s.id}/stop`));
+      row.insertCell().appendChild(stop);
+    }
+  } catch (e) {
+    errorBox.textContent = e.message;
+  }
+}
+
+async function run(action) {
+  errorBox.textContent = "";
+  try {
+    await action();
+  } catch (e) {
+    errorBox.textContent = e.message;
+  }
+  refresh();
+}
+
+document.getElementById("start").onsubmit = (ev) => {
+  ev.preventDefault();
+  const form = new FormData(ev.target);
+  run(() => call("POST", "/start", {
+    ingestUrl: form.get("ingestUrl"),
+    videoPort: Number(form.get("videoPort")),
+    audioPort: Number(form.get("audioPort")),
+    codecAllowlist: form.getAll("codec"),
+  }));
+};
+
+refresh();
+setInterval(refresh, 2000);
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit are what the embedding binary passes to
+// SetBuildInfo.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// SetBuildInfo sets the version and commit /version reports. An empty
+// commit is taken from the build's VCS info, if any.
+func SetBuildInfo(v, c string) {
+	version, commit = v, c
+}
+
+type VersionResponse struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	GoVersion     string `json:"goVersion"`
+	WebRTCVersion string `json:"webrtcVersion,omitempty"`
+}
+
+func versionInfo() VersionResponse {
+	v := VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/pion/webrtc/v4" {
+			v.WebRTCVersion = dep.Version
+		}
+	}
+	// Builds from a git checkout record the revision themselves.
+	if v.Commit == "" {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				v.Commit = s.Value
+			}
+		}
+	}
+	return v
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionInfo())
+}
@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds each webhook delivery, which is attempted once.
+const webhookTimeout = 5 * time.Second
+
+// shutdownWebhookTimeout bounds the ShutdownEvent delivery, which holds up
+// the exit.
+const shutdownWebhookTimeout = 2 * time.Second
+
+// SessionEndedEvent is POSTed to the webhookUrl config when a session is
+// torn down. Its Stats count the whole session, ignoring /stats/reset.
+type SessionEndedEvent struct {
+	Event     string            `json:"event"` // "session.ended"
+	ID        string            `json:"id"`
+	IngestURL string            `json:"ingestUrl"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Reason    TeardownReason    `json:"reason"`
+	Detail    string            `json:"detail,omitempty"`
+	Time      time.Time         `json:"time"`
+	Teardown  string            `json:"teardown"` // "complete" or "teardown-failed"
+	Stats     SessionStats      `json:"stats"`
+}
+
+// postWebhook delivers payload to the configured webhook in the
+// background, logging failures. It does nothing without a webhookUrl.
+func postWebhook(payload any) {
+	url := cfg.Load().WebhookURL
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		if err := sendWebhook(ctx, url, body); err != nil {
+			log.Printf("webhook %s failed: %v", redactURL(url), err)
+		}
+	}()
+}
+
+func sendWebhook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ShutdownEvent is POSTed to the webhookUrl config when the server shuts
+// down, after tearing down the sessions that were running, so a control
+// plane can reconcile them. Reason is one of the Shutdown constants.
+type ShutdownEvent struct {
+	Event    string            `json:"event"` // "server.shutdown"
+	Reason   string            `json:"reason"`
+	Time     time.Time         `json:"time"`
+	Sessions []ShutdownSession `json:"sessions"`
+}
+
+// ShutdownSession is a session's teardown outcome in a ShutdownEvent.
+type ShutdownSession struct {
+	ID        string `json:"id"`
+	IngestURL string `json:"ingestUrl"`
+	Teardown  string `json:"teardown"` // "complete" or "teardown-failed"
+	Error     string `json:"error,omitempty"`
+}
+
+// postShutdownWebhook delivers ev, waiting at most shutdownWebhookTimeout
+// since the process exits right after.
+func postShutdownWebhook(ev ShutdownEvent) {
+	url := cfg.Load().WebhookURL
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownWebhookTimeout)
+	defer cancel()
+	if err := sendWebhook(ctx, url, body); err != nil {
+		log.Printf("webhook %s failed: %v", redactURL(url), err)
+	}
+}
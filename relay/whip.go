@@ -0,0 +1,352 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// whipError is a non-2xx response from the WHIP server. When the body is a
+// JSON problem document (RFC 7807) or a common {"error": ...} shape, the
+// parsed fields are filled in; otherwise only the raw body is kept. Hint
+// names the likely cause of an auth failure.
+type whipError struct {
+	Status int    `json:"status"`
+	Type   string `json:"type,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Body   string `json:"body,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+func (e *whipError) Error() string {
+	msg := e.Body
+	if e.Title != "" || e.Detail != "" {
+		msg = strings.TrimSuffix(strings.TrimPrefix(e.Title+": "+e.Detail, ": "), ": ")
+	}
+	if e.Hint != "" {
+		return fmt.Sprintf("whip error %d: %s (%s)", e.Status, msg, e.Hint)
+	}
+	return fmt.Sprintf("whip error %d: %s", e.Status, msg)
+}
+
+// answerError is a WHIP answer the PeerConnection couldn't apply. Hint
+// names the likely cause when it is a common one, and SDP carries the
+// answer itself when the debug config is set, since it may include
+// addresses and credentials.
+type answerError struct {
+	Hint string `json:"hint,omitempty"`
+	SDP  string `json:"sdp,omitempty"`
+	err  error
+}
+
+func newAnswerError(err error, answer string) *answerError {
+	e := &answerError{Hint: answerHint(err, answer), err: err}
+	if cfg.Load().Debug {
+		e.SDP = answer
+		log.Printf("whip answer rejected: %v\n%s", err, answer)
+	}
+	return e
+}
+
+func (e *answerError) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("%v (%s)", e.err, e.Hint)
+	}
+	return e.err.Error()
+}
+
+func (e *answerError) Unwrap() error { return e.err }
+
+// errNoCandidates is an answer without ICE candidates. WHIP servers can't
+// trickle theirs later, so such a session could never connect.
+var errNoCandidates = errors.New("whip answer has no ICE candidates")
+
+// errEmptyAnswer is a successful WHIP response without an SDP answer,
+// whether in its body or, with the emptyAnswer config "fetch", from the
+// resource URL.
+var errEmptyAnswer = errors.New("whip answer is empty")
+
+// hasCandidates reports whether answer has an a=candidate line.
+func hasCandidates(answer string) bool {
+	for line := range strings.Lines(answer) {
+		if strings.HasPrefix(line, "a=candidate:") {
+			return true
+		}
+	}
+	return false
+}
+
+// answerHint explains the usual reasons err happens when applying answer.
+func answerHint(err error, answer string) string {
+	switch {
+	case errors.Is(err, errEmptyAnswer):
+		return "the WHIP server accepted the offer without sending an SDP answer in the 201 body or from the resource URL"
+	case errors.Is(err, errNoCandidates):
+		return "WHIP servers send their candidates only in the answer; check the server's ICE setup, such as its public IP or port range"
+	case errors.Is(err, webrtc.ErrSessionDescriptionMissingIceUfrag), !strings.Contains(answer, "a=ice-ufrag:"):
+		return "the answer has no ice-ufrag/ice-pwd, so the WHIP server didn't include its ICE credentials"
+	case errors.Is(err, webrtc.ErrSessionDescriptionNoFingerprint), errors.Is(err, webrtc.ErrSessionDescriptionInvalidFingerprint):
+		return "the answer has no usable DTLS fingerprint"
+	case errors.Is(err, webrtc.ErrUnsupportedCodec), errors.Is(err, webrtc.ErrCodecNotFound):
+		return "no codec in the answer matches the offer; check codecAllowlist against the server's codecs with /probe"
+	case strings.Contains(err.Error(), "candidate"):
+		return "the answer has a malformed ICE candidate"
+	case strings.Contains(err.Error(), "sdp:") || !strings.HasPrefix(answer, "v=0"):
+		return "the answer isn't valid SDP"
+	}
+	return ""
+}
+
+// relayError classifies e for API clients, telling a rejected bearer token
+// apart so that they can ask for a new one. Either way the relay answers
+// 502, since it was the WHIP server that failed.
+func (e *whipError) relayError() *RelayError {
+	code := CodeWHIPUpstream4xx
+	switch {
+	case e.Status == http.StatusUnauthorized, e.Status == http.StatusForbidden:
+		code = CodeWHIPAuthFailed
+		e.Hint = "the WHIP server rejected the bearer token; check bearerToken or the whipToken config, or rotate it with POST /session/{id}/token"
+	case e.Status >= 500:
+		code = CodeWHIPUpstream5xx
+	}
+	return newRelayError(code, http.StatusBadGateway, e)
+}
+
+func newWHIPError(resp *http.Response) *whipError {
+	// Error bodies are only informational, so an oversized one is truncated
+	// rather than treated as a failure.
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, int64(cfg.Load().MaxAnswerBytes)))
+	e := &whipError{Status: resp.StatusCode}
+
+	var problem struct {
+		Type    string `json:"type"`
+		Title   string `json:"title"`
+		Detail  string `json:"detail"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if isJSON(resp.Header.Get("Content-Type")) && json.Unmarshal(b, &problem) == nil {
+		e.Type = problem.Type
+		e.Title = problem.Title
+		e.Detail = problem.Detail
+		if e.Title == "" {
+			e.Title = problem.Error
+		}
+		if e.Detail == "" {
+			e.Detail = problem.Message
+		}
+	}
+	if e.Title == "" && e.Detail == "" {
+		e.Body = string(b)
+	}
+	return e
+}
+
+// newWHIPClient builds the HTTP client for WHIP requests. HTTP/2 is
+// negotiated when the server offers it unless c.ForceHTTP1 is set.
+// Internal addresses are only dialed, or requested through an
+// HTTP(S)_PROXY, for hosts allowedHosts names. It fails if the client
+// certificate or CA bundle can't be loaded.
+func newWHIPClient(c HTTPClientConfig, allowedHosts hostList) (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout.or(defaultDialTimeout),
+		KeepAlive: c.KeepAlive.or(defaultKeepAlive),
+	}
+
+	signer, err := c.SigV4.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(!c.ForceHTTP1)
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               guardProxy(http.ProxyFromEnvironment, allowedHosts),
+		DialContext:         guardDial(dialer, allowedHosts),
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout.or(defaultTLSHandshakeTimeout),
+		IdleConnTimeout:     c.IdleConnTimeout.or(defaultIdleConnTimeout),
+		DisableKeepAlives:   c.DisableKeepAlives,
+		MaxIdleConns:        100,
+		Protocols:           protocols,
+	}
+	if signer != nil {
+		transport = &sigV4Transport{next: transport, signer: signer}
+	}
+	transport = &userAgentTransport{next: transport, userAgent: c.UserAgent}
+	return &http.Client{Transport: transport}, nil
+}
+
+// userAgentTransport sets the User-Agent of every WHIP request: userAgent,
+// or by default this relay's name and version.
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", cmp.Or(t.userAgent, "streamwithfriends-whip-server/"+version))
+	return t.next.RoundTrip(r)
+}
+
+// tlsConfig loads the client certificate and CA bundle, if configured. It
+// returns nil, for the transport's defaults, when neither is.
+func (c HTTPClientConfig) tlsConfig() (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("whipClient.certFile and whipClient.keyFile must be set together")
+	}
+	if c.CertFile == "" && c.CAFile == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load whip client certificate: %w", err)
+		}
+		log.Printf("WHIP client certificate %s, valid until %s", cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read whip ca bundle: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("whip ca bundle %s has no PEM certificates", c.CAFile)
+		}
+	}
+	return tc, nil
+}
+
+// whipDo sends r with the WHIP client. The URL the client puts in its
+// errors is redacted, since they end up in session events and logs.
+func whipDo(r *http.Request) (*http.Response, error) {
+	resp, err := cfg.Load().whipClient.Do(r)
+	if ue, ok := err.(*url.Error); ok {
+		ue.URL = redactURL(ue.URL)
+	}
+	return resp, err
+}
+
+// readBody reads r up to limit bytes, failing if there is more.
+func readBody(r io.Reader, limit int) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, fmt.Errorf("body exceeds %d bytes", limit)
+	}
+	return b, nil
+}
+
+// fetchAnswer GETs the SDP answer from up's resource URL, for WHIP servers
+// that answer the offer with an empty 201 body.
+func (up *upstream) fetchAnswer(ctx context.Context, token string) ([]byte, error) {
+	if up.resourceURL == "" {
+		return nil, errors.New("no resource URL to fetch it from")
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, up.resourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/sdp")
+	setBearer(httpReq, token)
+	resp, err := whipDo(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s answered %d", redactURL(up.resourceURL), resp.StatusCode)
+	}
+	return readBody(resp.Body, cfg.Load().MaxAnswerBytes)
+}
+
+// setBearer authenticates req to the WHIP server with token, if any.
+func setBearer(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// isJSON reports whether contentType is application/json or a +json type
+// such as application/problem+json.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// deleteResource ends the WHIP session at resourceURL. Network errors, 429
+// and 5xx responses are retried up to attempts times with doubling backoff;
+// a 404 means the server already dropped the session and counts as done.
+// It gives up early, with the last error, once ctx is done.
+func deleteResource(ctx context.Context, resourceURL, token string, attempts int, backoff time.Duration) error {
+	var err error
+	for i := range attempts {
+		if i > 0 {
+			select {
+			case <-time.After(backoff << (i - 1)):
+			case <-ctx.Done():
+				return fmt.Errorf("%w after %d attempts: %w", ctx.Err(), i, err)
+			}
+		}
+		var retry bool
+		if retry, err = tryDelete(ctx, resourceURL, token); err == nil || !retry {
+			return err
+		}
+		log.Printf("whip delete %s attempt %d/%d: %v", redactURL(resourceURL), i+1, attempts, err)
+	}
+	return err
+}
+
+// tryDelete sends one DELETE and reports whether a failure is worth retrying.
+func tryDelete(ctx context.Context, resourceURL, token string) (retry bool, err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "DELETE", resourceURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to build whip delete: %w", err)
+	}
+	setBearer(httpReq, token)
+	resp, err := whipDo(httpReq)
+	if err != nil {
+		return true, fmt.Errorf("whip delete failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299, resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, newWHIPError(resp)
+	default:
+		return false, newWHIPError(resp)
+	}
+}
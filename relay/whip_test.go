@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestWHIPErrorResponses posts offers to a WHIP server that rejects them,
+// and checks how /start reports each rejection.
+func TestWHIPErrorResponses(t *testing.T) {
+	useConfig(t, loopbackConfig)
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantCode    string
+		wantTitle   string
+		wantHint    bool
+	}{
+		{"401", http.StatusUnauthorized, "application/problem+json", `{"title": "invalid token", "detail": "token expired"}`, CodeWHIPAuthFailed, "invalid token", true},
+		{"401 plain", http.StatusUnauthorized, "text/plain", "go away", CodeWHIPAuthFailed, "", true},
+		{"403", http.StatusForbidden, "application/json", `{"error": "stream key revoked"}`, CodeWHIPAuthFailed, "stream key revoked", true},
+		{"400", http.StatusBadRequest, "application/json", `{"type": "about:blank", "title": "bad offer"}`, CodeWHIPUpstream4xx, "bad offer", false},
+		{"500", http.StatusInternalServerError, "text/plain", "oops", CodeWHIPUpstream5xx, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auth string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+
+			w := call(http.MethodPost, "/start", "application/json", startBody(t, ts.URL, `"bearerToken": "s3cret"`))
+			if auth != "Bearer s3cret" {
+				t.Errorf("WHIP server got Authorization %q", auth)
+			}
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.wantCode {
+				t.Errorf("code = %s, want %s", resp.Code, tt.wantCode)
+			}
+			if resp.WHIP == nil {
+				t.Fatalf("response has no WHIP details: %s", w.Body)
+			}
+			if resp.WHIP.Status != tt.status || resp.WHIP.Title != tt.wantTitle {
+				t.Errorf("whip = %d %q, want %d %q", resp.WHIP.Status, resp.WHIP.Title, tt.status, tt.wantTitle)
+			}
+			if tt.wantTitle == "" && resp.WHIP.Body != tt.body {
+				t.Errorf("whip body = %q, want %q", resp.WHIP.Body, tt.body)
+			}
+			if hasHint := strings.Contains(resp.WHIP.Hint, "bearer token"); hasHint != tt.wantHint {
+				t.Errorf("hint = %q, want one: %v", resp.WHIP.Hint, tt.wantHint)
+			}
+			if tt.wantHint && !strings.Contains(resp.Error, resp.WHIP.Hint) {
+				t.Errorf("error %q doesn't carry the hint", resp.Error)
+			}
+		})
+	}
+}
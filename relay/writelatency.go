@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// writeLatencyBuckets are the upper bounds of the buckets WriteRTP
+// latencies are counted in. An uncongested write takes microseconds; one
+// that backs up blocks the relay loop, and the socket buffer fills behind
+// it.
+var writeLatencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// writeWarnInterval rate-limits the slow write warning per track.
+const writeWarnInterval = 10 * time.Second
+
+// latencyHistogram counts durations into writeLatencyBuckets, with one
+// more bucket for anything longer. Relay loops sharing a track observe
+// into it concurrently.
+type latencyHistogram struct {
+	counts [len(writeLatencyBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64 // nanoseconds
+
+	// lastWarn is when the last slow write was reported, in unix
+	// nanoseconds.
+	lastWarn atomic.Int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(writeLatencyBuckets) && d > writeLatencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// quantile estimates the q-quantile as the upper bound of the bucket it
+// falls in, the largest bound if it falls beyond them, and 0 without
+// observations.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	var counts [len(writeLatencyBuckets) + 1]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(total))
+	var seen uint64
+	for i, c := range counts[:len(writeLatencyBuckets)] {
+		seen += c
+		if seen > rank {
+			return writeLatencyBuckets[i]
+		}
+	}
+	return writeLatencyBuckets[len(writeLatencyBuckets)-1]
+}
+
+// writeProm writes h as the Prometheus histogram name with labels, which
+// are formatted like session="...",kind="...".
+func (h *latencyHistogram) writeProm(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, le := range writeLatencyBuckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le.Seconds(), cumulative)
+	}
+	cumulative += h.counts[len(writeLatencyBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, cumulative)
+}
+
+// timeWrite accounts a WriteRTP on mt that took d, and reports it once
+// per writeWarnInterval if it took longer than the writeLatencyWarning
+// config.
+func (s *session) timeWrite(mt *mediaTrack, d time.Duration) {
+	mt.writeLatency.observe(d)
+	limit := time.Duration(cfg.Load().WriteLatencyWarning)
+	if limit == 0 || d <= limit {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := mt.writeLatency.lastWarn.Load()
+	if now-last < int64(writeWarnInterval) || !mt.writeLatency.lastWarn.CompareAndSwap(last, now) {
+		return
+	}
+	s.event("warning", "%s WriteRTP took %s, above writeLatencyWarning %s; the upstream is backing up",
+		mt.kind, d.Round(time.Microsecond), limit)
+}